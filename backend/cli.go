@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ConfusedPolarBear/garden/internal/firmware"
+)
+
+// Runs a command line subcommand instead of starting the server. Returns the exit code and false if no subcommand was
+// given.
+func runCommand(args []string) (int, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+
+	switch args[0] {
+	case "blobs":
+		return blobsCommand(args[1:]), true
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s\n", args[0])
+		return 2, true
+	}
+}
+
+// Manages the ESP32 support files without network access.
+//
+//	garden blobs status
+//	garden blobs import [-sha256 HASH] esp32.zip
+//	garden blobs import -bootloader FILE -bootloader-sha256 HASH [-partitions ...] [-boot_app0 ...]
+func blobsCommand(args []string) int {
+	usage := "usage: garden blobs status | garden blobs import [flags] [archive]"
+
+	if len(args) > 0 && args[0] == "status" {
+		return printBlobStatus()
+	}
+
+	if len(args) == 0 || args[0] != "import" {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	flags := flag.NewFlagSet("blobs import", flag.ContinueOnError)
+	checksum := flags.String("sha256", "", "SHA256 checksum of the archive. Defaults to esp32.hash or the official archive's checksum.")
+
+	paths := make(map[string]*string)
+	checksums := make(map[string]*string)
+	for _, key := range firmware.BlobKeys() {
+		paths[key] = flags.String(key, "", "Path to the "+key+" blob.")
+		checksums[key] = flags.String(key+"-sha256", "", "SHA256 checksum of the "+key+" blob.")
+	}
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	var err error
+
+	if archive := flags.Arg(0); archive != "" {
+		var contents []byte
+		if contents, err = os.ReadFile(archive); err == nil {
+			err = firmware.ImportBlobArchive(contents, *checksum)
+		}
+
+	} else {
+		files := make(map[string]firmware.BlobFile)
+		for key, p := range paths {
+			if *p == "" {
+				continue
+			}
+
+			contents, readErr := os.ReadFile(*p)
+			if readErr != nil {
+				fmt.Fprintf(os.Stderr, "unable to read %s: %s\n", *p, readErr)
+				return 1
+			}
+
+			files[key] = firmware.BlobFile{Data: contents, SHA256: *checksums[key]}
+		}
+
+		if len(files) == 0 {
+			fmt.Fprintln(os.Stderr, usage)
+			flags.PrintDefaults()
+			return 2
+		}
+
+		err = firmware.ImportBlobs(files)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to import blobs: %s\n", err)
+		return 1
+	}
+
+	fmt.Println("Blobs imported")
+
+	return printBlobStatus()
+}
+
+// Prints which blobs are installed. Returns a non-zero exit code if any are missing.
+func printBlobStatus() int {
+	code := 0
+
+	for _, status := range firmware.GetBlobStatus() {
+		if !status.Present {
+			fmt.Printf("%-24s missing\n", status.File)
+			code = 1
+			continue
+		}
+
+		fmt.Printf("%-24s %6d bytes  sha256 %s\n", status.File, status.Size, strings.ToLower(status.SHA256))
+	}
+
+	return code
+}
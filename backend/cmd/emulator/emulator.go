@@ -4,10 +4,12 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"math/rand"
 	"strings"
 	"time"
 
 	"github.com/ConfusedPolarBear/garden/internal/config"
+	"github.com/ConfusedPolarBear/garden/internal/fragment"
 	"github.com/ConfusedPolarBear/garden/internal/mqtt"
 	"github.com/ConfusedPolarBear/garden/internal/util"
 
@@ -22,6 +24,9 @@ var publishDelay float32 = 10
 // If all current system discovery messages should be removed.
 var flagClearSystems bool
 
+// Identifier of the coordinator to relay messages through. If set, this system emulates a mesh client.
+var flagCoordinator string
+
 func init() {
 	// Setup logging
 	logrus.SetFormatter(&logrus.TextFormatter{
@@ -33,6 +38,7 @@ func init() {
 	// Parse CLI flags
 	flag.BoolVar(&flagClearSystems, "c", false, "If all garden discovery messages should be cleared")
 	flag.StringVar(&id, "i", "1234567890AB", "Sets the 12 character identifier for this system. Only 0-9 and A-F are permitted.")
+	flag.StringVar(&flagCoordinator, "m", "", "Emulates a mesh client by sending all messages as fragmented packets through this coordinator")
 
 	flag.Parse()
 
@@ -40,6 +46,10 @@ func init() {
 		panic(fmt.Sprintf("provided identifier must match %s", &util.SystemIdentifierRegex))
 	}
 
+	if flagCoordinator != "" && !util.SystemIdentifierRegex.MatchString(flagCoordinator) {
+		panic(fmt.Sprintf("provided coordinator must match %s", &util.SystemIdentifierRegex))
+	}
+
 	baseTopic = "garden/module/" + id
 }
 
@@ -50,10 +60,14 @@ func main() {
 	mqtt.Subscribe("garden/module/discovery/+", parseDiscoveryMessage)
 	mqtt.Subscribe(baseTopic+"/cmnd/#", handleCommand)
 
-	discovery := `{"RR":"External System","CV":"0.0.0","SV":"2.2.2-dev(38a443e)",` +
-		`"IsEmulator":true,"Sensors":["temperature","humidity"]}`
+	discovery := fmt.Sprintf(`{"RR":"External System","CV":"0.0.0","SV":"2.2.2-dev(38a443e)","AV":"0.0.0",`+
+		`"IsEmulator":true,"ME":%t,"Sensors":["temperature","humidity"]}`, flagCoordinator != "")
 
-	mqtt.PublishAdvanced("garden/module/discovery/"+id, discovery, 0, true)
+	if flagCoordinator != "" {
+		publishMesh("garden/module/discovery/"+id, discovery)
+	} else {
+		mqtt.PublishAdvanced("garden/module/discovery/"+id, discovery, 0, true)
+	}
 
 	temp, humidity := -10, 0
 	for {
@@ -66,12 +80,32 @@ func main() {
 		}
 
 		payload := fmt.Sprintf(`{"Error":false,"Temperature":%d,"Humidity":%d}`, temp, humidity)
-		mqtt.Publish(baseTopic+"/tele/data", payload)
+		if flagCoordinator != "" {
+			publishMesh(baseTopic+"/tele/data", payload)
+		} else {
+			mqtt.Publish(baseTopic+"/tele/data", payload)
+		}
 
 		time.Sleep(time.Duration(publishDelay) * time.Second)
 	}
 }
 
+// Publishes a message the same way a mesh client does. The message is split into fragments which are published by
+// the coordinator as if they were received over ESP-NOW.
+func publishMesh(topic, payload string) {
+	fragments, err := fragment.Split(rand.Uint32(), topic, []byte(payload))
+	if err != nil {
+		logrus.Errorf("[mesh] unable to fragment message to %s: %s", topic, err)
+		return
+	}
+
+	for _, f := range fragments {
+		mqtt.Publish("garden/module/"+flagCoordinator+"/tele/packet", string(f.Encode()))
+	}
+
+	logrus.Debugf("[mesh] published message to %s in %d fragments", topic, len(fragments))
+}
+
 func parseDiscoveryMessage(c paho.Client, m paho.Message) {
 	if len(m.Payload()) == 0 {
 		return
@@ -0,0 +1,117 @@
+package alert
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/notify"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+	"github.com/ConfusedPolarBear/garden/internal/websocket"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Time that each rule & system pair started violating its rule. Only used for rules with a duration.
+var pending map[string]time.Time = map[string]time.Time{}
+
+// Serializes rule evaluation, including the lookup and creation of active alerts.
+var pendingLock sync.Mutex
+
+func pendingKey(rule util.AlertRule, system string) string {
+	return fmt.Sprintf("%d/%s", rule.ID, system)
+}
+
+// Evaluates every alert rule that applies to a system against a new reading, raising and clearing alerts as needed.
+func Evaluate(system string, reading util.Reading) {
+	// Readings with errors don't contain meaningful values.
+	if reading.Error {
+		return
+	}
+
+	now := time.Now()
+
+	for _, rule := range db.GetSystemAlertRules(system) {
+		evaluateRule(rule, system, reading, now)
+	}
+}
+
+func evaluateRule(rule util.AlertRule, system string, reading util.Reading, now time.Time) {
+	key := pendingKey(rule, system)
+
+	// The active alert must be looked up while holding the lock, otherwise concurrent readings could both raise it.
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+
+	active, isActive := db.GetActiveAlert(rule.ID, system)
+
+	if !rule.Matches(reading) {
+		delete(pending, key)
+
+		if isActive {
+			if err := db.ClearAlert(&active); err != nil {
+				logrus.Errorf("[alert] unable to clear alert %d: %s", active.ID, err)
+				return
+			}
+
+			logrus.Printf("[alert] cleared alert \"%s\" for %s", rule.Name, system)
+			websocket.BroadcastWebsocketMessage("alert", active)
+
+			notify.Send(notify.EventAlertCleared, system, rule.Name, "%s on %s is back to normal: %s is %.1f",
+				rule.Name, system, rule.Metric, rule.Value(reading))
+		}
+
+		return
+	}
+
+	if isActive {
+		return
+	}
+
+	// Only raise the alert once the condition has held for the entire duration of the rule.
+	since, ok := pending[key]
+	if !ok {
+		since = now
+		pending[key] = since
+	}
+
+	if now.Sub(since) < time.Duration(rule.Duration)*time.Second {
+		return
+	}
+
+	delete(pending, key)
+
+	alert := util.Alert{
+		AlertRuleID:    rule.ID,
+		GardenSystemID: system,
+		Value:          rule.Value(reading),
+		RaisedAt:       now,
+		Message: fmt.Sprintf("%s: %s is %.1f (%s %.1f)", rule.Name, rule.Metric, rule.Value(reading),
+			rule.Operator, rule.Threshold),
+	}
+
+	if err := db.CreateAlert(&alert); err != nil {
+		logrus.Errorf("[alert] unable to raise alert \"%s\" for %s: %s", rule.Name, system, err)
+		return
+	}
+
+	logrus.Warnf("[alert] raised alert for %s: %s", system, alert.Message)
+	websocket.BroadcastWebsocketMessage("alert", alert)
+
+	notify.Send(notify.EventAlertRaised, system, rule.Name, "%s on %s", alert.Message, system)
+}
+
+// Forgets the pending state of a deleted rule.
+func ForgetRule(id uint) {
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+
+	prefix := fmt.Sprintf("%d/", id)
+	for key := range pending {
+		if strings.HasPrefix(key, prefix) {
+			delete(pending, key)
+		}
+	}
+}
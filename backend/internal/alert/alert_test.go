@@ -0,0 +1,103 @@
+package alert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Creates an empty database with the provided rule.
+func setupRule(t *testing.T, rule util.AlertRule) util.AlertRule {
+	db.InitializeTestDatabase(t)
+
+	pending = map[string]time.Time{}
+
+	rule.Name = "too hot"
+	rule.Metric = "temperature"
+	rule.Operator = ">"
+	rule.Threshold = 30
+	rule.Enabled = true
+	require.NoError(t, db.CreateAlertRule(&rule))
+
+	return rule
+}
+
+func reading(temperature float32) util.Reading {
+	return util.Reading{Temperature: temperature, Humidity: 50}
+}
+
+func TestEvaluateThreshold(t *testing.T) {
+	rule := setupRule(t, util.AlertRule{})
+
+	// Readings at the threshold and readings with errors never raise an alert.
+	Evaluate("aaaaaaaaaaaa", reading(30))
+	Evaluate("aaaaaaaaaaaa", util.Reading{Temperature: 40, Error: true})
+	assert.Empty(t, db.GetAlerts("", false, 10))
+
+	Evaluate("aaaaaaaaaaaa", reading(35))
+
+	active, ok := db.GetActiveAlert(rule.ID, "aaaaaaaaaaaa")
+	require.True(t, ok)
+	assert.Equal(t, float32(35), active.Value)
+	assert.Equal(t, "too hot: temperature is 35.0 (> 30.0)", active.Message)
+
+	// Alerts are only raised once while the condition holds, and only for the system that violated the rule.
+	Evaluate("aaaaaaaaaaaa", reading(36))
+	assert.Len(t, db.GetAlerts("", false, 10), 1)
+
+	_, ok = db.GetActiveAlert(rule.ID, "bbbbbbbbbbbb")
+	assert.False(t, ok)
+}
+
+func TestEvaluateDuration(t *testing.T) {
+	rule := setupRule(t, util.AlertRule{Duration: 60})
+	now := time.Now()
+
+	evaluateRule(rule, "aaaaaaaaaaaa", reading(35), now)
+	evaluateRule(rule, "aaaaaaaaaaaa", reading(35), now.Add(30*time.Second))
+
+	_, ok := db.GetActiveAlert(rule.ID, "aaaaaaaaaaaa")
+	assert.False(t, ok)
+
+	// A reading that is back to normal resets the pending period.
+	evaluateRule(rule, "aaaaaaaaaaaa", reading(20), now.Add(40*time.Second))
+	evaluateRule(rule, "aaaaaaaaaaaa", reading(35), now.Add(50*time.Second))
+	evaluateRule(rule, "aaaaaaaaaaaa", reading(35), now.Add(70*time.Second))
+
+	_, ok = db.GetActiveAlert(rule.ID, "aaaaaaaaaaaa")
+	assert.False(t, ok)
+
+	evaluateRule(rule, "aaaaaaaaaaaa", reading(35), now.Add(110*time.Second))
+
+	_, ok = db.GetActiveAlert(rule.ID, "aaaaaaaaaaaa")
+	assert.True(t, ok)
+	assert.Empty(t, pending)
+}
+
+func TestEvaluateClear(t *testing.T) {
+	rule := setupRule(t, util.AlertRule{})
+
+	Evaluate("aaaaaaaaaaaa", reading(35))
+	raised, ok := db.GetActiveAlert(rule.ID, "aaaaaaaaaaaa")
+	require.True(t, ok)
+
+	Evaluate("aaaaaaaaaaaa", reading(25))
+
+	_, ok = db.GetActiveAlert(rule.ID, "aaaaaaaaaaaa")
+	assert.False(t, ok)
+
+	alerts := db.GetAlerts("aaaaaaaaaaaa", false, 10)
+	require.Len(t, alerts, 1)
+	assert.Equal(t, raised.ID, alerts[0].ID)
+	assert.False(t, alerts[0].Active())
+
+	// Violating the rule again raises a new alert.
+	Evaluate("aaaaaaaaaaaa", reading(35))
+	assert.Len(t, db.GetAlerts("aaaaaaaaaaaa", true, 10), 1)
+	assert.Len(t, db.GetAlerts("aaaaaaaaaaaa", false, 10), 2)
+}
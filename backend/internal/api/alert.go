@@ -0,0 +1,101 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/ConfusedPolarBear/garden/internal/alert"
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/notify"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Returns alert history, newest first. Supports the optional query parameters system, active and limit.
+func GetAlerts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	system := query.Get("system")
+	if system != "" && !util.SystemIdentifierRegex.MatchString(system) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	w.Write(util.Marshal(db.GetAlerts(system, query.Get("active") == "true", limit)))
+}
+
+func GetAlertRules(w http.ResponseWriter, r *http.Request) {
+	w.Write(util.Marshal(db.GetAlertRules()))
+}
+
+// Creates a new alert rule. Expects the form values name, metric, operator and threshold and optionally system
+// (defaults to all systems) and duration (in seconds, defaults to 0).
+func CreateAlertRule(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		logrus.Warnf("[server] unable to parse alert rule form: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	threshold, err := strconv.ParseFloat(r.Form.Get("threshold"), 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	duration := 0
+	if raw := r.Form.Get("duration"); raw != "" {
+		if duration, err = strconv.Atoi(raw); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	rule := util.AlertRule{
+		Name:           r.Form.Get("name"),
+		GardenSystemID: r.Form.Get("system"),
+		Metric:         r.Form.Get("metric"),
+		Operator:       r.Form.Get("operator"),
+		Threshold:      float32(threshold),
+		Duration:       duration,
+		Enabled:        true,
+	}
+
+	if err := db.CreateAlertRule(&rule); err != nil {
+		logrus.Warnf("[server] unable to create alert rule: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Write(util.Marshal(rule))
+}
+
+func DeleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := db.DeleteAlertRule(uint(id)); err != nil {
+		logrus.Warnf("[server] unable to delete alert rule %d: %s", id, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	alert.ForgetRule(uint(id))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Sends a test notification to every configured channel and returns the result of each delivery.
+func TestNotifications(w http.ResponseWriter, r *http.Request) {
+	w.Write(util.Marshal(notify.Test()))
+}
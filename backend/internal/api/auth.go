@@ -0,0 +1,387 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/config"
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Name of the cookie that session tokens are stored in.
+const sessionCookie = "garden_session"
+
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+// Routes that can be accessed without authenticating. Garden systems download firmware updates without credentials.
+// Provisioning routes are protected by their one-time token instead.
+var publicRoutes = map[string]bool{
+	"/ping":                             true,
+	"/auth/login":                       true,
+	"/firmware/manifest.json":           true,
+	"/firmware/{version}/manifest.json": true,
+	"/firmware/{board}/{file}":          true,
+	"/fw82":                             true,
+	"/fw32":                             true,
+	"/fw/{id}":                          true,
+
+	"/provision/{token}/manifest.json":        true,
+	"/provision/{token}/config":               true,
+	"/provision/{token}/filesystem/{chipset}": true,
+}
+
+// Minimum role required to access each route. Keys are either a path template, which applies to every method, or a
+// method followed by a path template. Authenticated routes that are not listed here only require the viewer role.
+// The roles of typed commands are added from the command registry.
+var routeRoles = map[string]util.Role{
+	"/system/delete/{id}":  util.RoleOperator,
+	"/system/command/{id}": util.RoleOperator,
+	"/system/update/{id}":  util.RoleOperator,
+
+	"POST /system/{id}/tags":            util.RoleOperator,
+	"/system/{id}/queue/{entry}":        util.RoleOperator,
+	"/system/{id}/queue/delete/{entry}": util.RoleOperator,
+
+	"POST /rollouts":        util.RoleOperator,
+	"/rollouts/{id}/pause":  util.RoleOperator,
+	"/rollouts/{id}/resume": util.RoleOperator,
+	"/rollouts/{id}/cancel": util.RoleOperator,
+
+	"POST /schedules":        util.RoleOperator,
+	"POST /schedules/{id}":   util.RoleOperator,
+	"/schedules/delete/{id}": util.RoleOperator,
+
+	"POST /alerts/rules":        util.RoleOperator,
+	"/alerts/rules/delete/{id}": util.RoleOperator,
+	"/notify/test":              util.RoleOperator,
+
+	"/firmware":                  util.RoleAdmin,
+	"/firmware/default/{id}":     util.RoleAdmin,
+	"/firmware/delete/{id}":      util.RoleAdmin,
+	"POST /firmware/esp32/blobs": util.RoleAdmin,
+
+	// Provisioning links hand out the raw mesh key.
+	"/provision":             util.RoleAdmin,
+	"/provision/delete/{id}": util.RoleAdmin,
+
+	"/mesh/rotations":     util.RoleAdmin,
+	"/mesh/rotate":        util.RoleAdmin,
+	"/mesh/rotate/cancel": util.RoleAdmin,
+
+	"/users":             util.RoleAdmin,
+	"/users/role/{id}":   util.RoleAdmin,
+	"/users/delete/{id}": util.RoleAdmin,
+}
+
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil && publicRoutes[tmpl] {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		raw := getRequestToken(r)
+		if raw == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		user, _, err := db.GetTokenUser(raw)
+		if err != nil {
+			logrus.Debugf("[server] rejecting request to %s: %s", r.URL.Path, err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Rejects requests from users whose role is insufficient for the requested route. Must run after authMiddleware.
+func roleMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tmpl, err := route.GetPathTemplate()
+		if err != nil || publicRoutes[tmpl] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		required, ok := routeRoles[r.Method+" "+tmpl]
+		if !ok {
+			required, ok = routeRoles[tmpl]
+		}
+
+		if !ok {
+			required = util.RoleViewer
+		}
+
+		if user := getUser(r); !user.Role.Includes(required) {
+			logrus.Warnf("[server] user %s (role %s) denied access to %s", user.Username, user.Role, r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Extracts the raw token from the Authorization header or the session cookie. Browsers can't set headers on
+// websocket connections, so the websocket endpoint also accepts the token as a query parameter.
+func getRequestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		return cookie.Value
+	}
+
+	if r.URL.Path == "/socket" {
+		return r.URL.Query().Get("token")
+	}
+
+	return ""
+}
+
+// Returns the authenticated user that made this request.
+func getUser(r *http.Request) util.User {
+	user, _ := r.Context().Value(userContextKey).(util.User)
+	return user
+}
+
+func LoginHandler(w http.ResponseWriter, r *http.Request) {
+	type loginResponse struct {
+		Token     string
+		ExpiresAt time.Time
+	}
+
+	if err := r.ParseForm(); err != nil {
+		logrus.Warnf("[server] unable to parse login form: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	username, password := r.Form.Get("username"), r.Form.Get("password")
+
+	user, err := db.AuthenticateUser(username, password)
+	if err != nil {
+		logrus.Warnf("[server] failed login attempt for user %s from %s", username, r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	lifetime := config.GetDuration("auth.session_lifetime", 7*24*time.Hour)
+
+	raw, token, err := db.CreateToken(user.ID, "session", lifetime)
+	if err != nil {
+		logrus.Errorf("[server] unable to create session for %s: %s", username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	logrus.Printf("[server] user %s logged in from %s", username, r.RemoteAddr)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    raw,
+		Path:     "/",
+		Expires:  token.ExpiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	w.Write(util.Marshal(loginResponse{Token: raw, ExpiresAt: token.ExpiresAt}))
+}
+
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUser(r)
+
+	if _, token, err := db.GetTokenUser(getRequestToken(r)); err == nil {
+		db.DeleteToken(user.ID, token.ID)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   sessionCookie,
+		Path:   "/",
+		MaxAge: -1,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func GetTokens(w http.ResponseWriter, r *http.Request) {
+	w.Write(util.Marshal(db.GetTokens(getUser(r).ID)))
+}
+
+// Creates a long lived API token for scripts and other non-interactive clients.
+func CreateToken(w http.ResponseWriter, r *http.Request) {
+	type tokenResponse struct {
+		Token string
+		Info  util.Token
+	}
+
+	if err := r.ParseForm(); err != nil {
+		logrus.Warnf("[server] unable to parse token form: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	name := r.Form.Get("name")
+	if name == "" || len(name) > 64 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	raw, token, err := db.CreateToken(getUser(r).ID, name, 0)
+	if err != nil {
+		logrus.Errorf("[server] unable to create api token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(util.Marshal(tokenResponse{Token: raw, Info: token}))
+}
+
+func DeleteToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := db.DeleteToken(getUser(r).ID, uint(id)); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func GetUsers(w http.ResponseWriter, r *http.Request) {
+	w.Write(util.Marshal(db.GetAllUsers()))
+}
+
+func GetCurrentUser(w http.ResponseWriter, r *http.Request) {
+	w.Write(util.Marshal(getUser(r)))
+}
+
+func CreateUser(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		logrus.Warnf("[server] unable to parse user form: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	role := util.Role(r.Form.Get("role"))
+	if role == "" {
+		role = util.RoleViewer
+	}
+
+	user, err := db.CreateUser(r.Form.Get("username"), r.Form.Get("password"), role)
+	if err != nil {
+		logrus.Warnf("[server] unable to create user: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	logrus.Printf("[server] user %s created user %s", getUser(r).Username, user.Username)
+
+	w.Write(util.Marshal(user))
+}
+
+func SetUserRole(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		logrus.Warnf("[server] unable to parse role form: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Prevent administrators from accidentally locking everyone out.
+	current := getUser(r)
+	if uint(id) == current.ID {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	role := util.Role(r.Form.Get("role"))
+	if err := db.SetUserRole(uint(id), role); err != nil {
+		logrus.Warnf("[server] unable to set role of user %d: %s", id, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	logrus.Printf("[server] user %s set role of user %d to %s", current.Username, id, role)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func DeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	current := getUser(r)
+	if uint(id) == current.ID {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	if err := db.DeleteUser(uint(id)); err != nil {
+		logrus.Warnf("[server] unable to delete user %d: %s", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	logrus.Printf("[server] user %s deleted user %d", current.Username, id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Changes the password of the current user. The current password must be provided.
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		logrus.Warnf("[server] unable to parse password form: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	user := getUser(r)
+	if !user.CheckPassword(r.Form.Get("current")) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if err := db.UpdatePassword(user.ID, r.Form.Get("password")); err != nil {
+		logrus.Warnf("[server] unable to change password for %s: %s", user.Username, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
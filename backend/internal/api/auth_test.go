@@ -0,0 +1,45 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreflightRequests(t *testing.T) {
+	handler := newHandler()
+
+	paths := []string{
+		"/users?username=x&password=y&role=admin",
+		"/system/command/aaaaaaaaaaaa?command=restart",
+		"/system/update/aaaaaaaaaaaa",
+		"/mesh/rotate",
+		"/firmware",
+		"/provision",
+		"/rollouts",
+		"/schedules",
+	}
+
+	for _, path := range paths {
+		// Preflight requests are answered without reaching authentication or the handler.
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, path, nil))
+
+		assert.Equal(t, http.StatusNoContent, w.Code, path)
+		assert.Empty(t, w.Body.String(), path)
+		assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"), path)
+
+		// The real request still requires a session.
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code, path)
+	}
+
+	// Routes that only accept GET requests are preflighted too, as the dashboard always sends an Authorization header.
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/systems", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
@@ -1,106 +1,379 @@
 package api
 
 import (
-	"bytes"
-	"crypto/rand"
-	"errors"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/ConfusedPolarBear/garden/internal/command"
 	"github.com/ConfusedPolarBear/garden/internal/db"
-	"github.com/ConfusedPolarBear/garden/internal/mqtt"
+	"github.com/ConfusedPolarBear/garden/internal/util"
 
+	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/chacha20poly1305"
 )
 
-func sendCommand(id, command string, encrypt bool) error {
-	if encrypt {
-		// Mesh messages are limited to 212 bytes in size. The nonce (12) + tag (16) drop that limit down to 184 bytes.
-		if len(command) > 184 {
-			return errors.New("encrypted commands cannot exceed 184 bytes")
+// Type of a command parameter.
+type parameterType string
+
+const (
+	parameterInteger parameterType = "integer"
+	parameterBoolean parameterType = "boolean"
+	parameterString  parameterType = "string"
+)
+
+// Describes a single parameter accepted by a typed command.
+type commandParameter struct {
+	// Name of the parameter in API requests.
+	Name        string
+	Type        parameterType
+	Description string
+	Required    bool
+
+	// Inclusive bounds of integer parameters.
+	Minimum int `json:",omitempty"`
+	Maximum int `json:",omitempty"`
+
+	// Maximum length of string parameters.
+	MaxLength int `json:",omitempty"`
+
+	// Secret parameters, like passwords, are never stored in a readable form.
+	Secret bool `json:",omitempty"`
+
+	// Name of the field the firmware expects the parameter in.
+	field string
+}
+
+// Describes a command that can be sent to systems through POST /system/{id}/{name}.
+type commandDefinition struct {
+	Name        string
+	Description string
+
+	// Minimum role required to send this command.
+	Role util.Role
+
+	Parameters []commandParameter
+
+	// Value of the firmware's Command field. Configuration commands don't set it.
+	command string
+
+	// Checks that the built command can be carried out by the target system, which may be the broadcast address.
+	// Optional.
+	checkTarget func(target string, fields map[string]interface{}) error
+}
+
+// Longest deep sleep, in seconds, that each chipset supports. The ESP8266's RTC timer overflows after about three and
+// a half hours, while the ESP32 can sleep for much longer than any schedule needs.
+var maxSleepPeriod = map[string]int{
+	"esp8266": 3 * 60 * 60,
+	"esp32":   24 * 60 * 60,
+}
+
+// Every command that can be sent through the typed command API. Update commands are sent with /system/update/{id}
+// instead, as the firmware image and URL are chosen by the server.
+var commandRegistry = map[string]commandDefinition{
+	"ping": {
+		Description: "Checks that the system is reachable.",
+		Role:        util.RoleOperator,
+		command:     "ping",
+	},
+	"scan": {
+		Description: "Scans for nearby Wi-Fi networks. Results are available from /system/{id}/networks.",
+		Role:        util.RoleOperator,
+		command:     "scan",
+	},
+	"listpeers": {
+		Description: "Publishes the system's list of mesh peers.",
+		Role:        util.RoleOperator,
+		command:     "listpeers",
+	},
+	"restart": {
+		Description: "Restarts the system.",
+		Role:        util.RoleOperator,
+		command:     "restart",
+	},
+	"sleep": {
+		Description: "Puts the system into deep sleep. Coordinators ignore this unless includeController is set.",
+		Role:        util.RoleOperator,
+		command:     "sleep",
+		Parameters: []commandParameter{
+			{
+				Name:        "period",
+				Type:        parameterInteger,
+				Description: "Number of seconds to sleep for. ESP8266 systems can sleep for at most 3 hours.",
+				Required:    true,
+				Minimum:     1,
+				Maximum:     24 * 60 * 60,
+				field:       "Period",
+			},
+			{
+				Name:        "includeController",
+				Type:        parameterBoolean,
+				Description: "If the coordinator should also go to sleep.",
+				field:       "IncludeController",
+			},
+		},
+		checkTarget: checkSleepPeriod,
+	},
+	"reset": {
+		Description: "Formats the system's filesystem, erasing all of its settings.",
+		Role:        util.RoleAdmin,
+		command:     "reset",
+	},
+	"wifi": {
+		Description: "Changes the Wi-Fi network the system connects to. Takes effect after the system restarts.",
+		Role:        util.RoleAdmin,
+		Parameters: []commandParameter{
+			{Name: "ssid", Type: parameterString, Required: true, MaxLength: 32, field: "WifiSSID"},
+			{Name: "password", Type: parameterString, MaxLength: 64, Secret: true, field: "WifiPassword"},
+		},
+	},
+	"mqtt": {
+		Description: "Changes the MQTT broker the system connects to. Takes effect after the system restarts.",
+		Role:        util.RoleAdmin,
+		Parameters: []commandParameter{
+			{Name: "host", Type: parameterString, Required: true, MaxLength: 64, field: "MQTTHost"},
+			{Name: "username", Type: parameterString, MaxLength: 32, field: "MQTTUsername"},
+			{Name: "password", Type: parameterString, MaxLength: 64, Secret: true, field: "MQTTPassword"},
+		},
+	},
+}
+
+func init() {
+	for name, definition := range commandRegistry {
+		definition.Name = name
+		commandRegistry[name] = definition
+
+		routeRoles["/system/{id}/"+name] = definition.Role
+	}
+}
+
+// Registers a route for every typed command.
+func registerCommands(r *mux.Router) {
+	for name := range commandRegistry {
+		r.HandleFunc("/system/{id}/"+name, SendTypedCommand).Methods("POST", "OPTIONS")
+	}
+}
+
+// Validates the provided parameters and builds the JSON command that the firmware expects.
+func (d commandDefinition) build(params map[string]json.RawMessage) (string, error) {
+	fields := map[string]interface{}{}
+	if d.command != "" {
+		fields["Command"] = d.command
+	}
+
+	known := map[string]bool{}
+
+	for _, p := range d.Parameters {
+		known[p.Name] = true
+
+		raw, ok := params[p.Name]
+		if !ok || string(raw) == "null" {
+			if p.Required {
+				return "", fmt.Errorf("%s is required", p.Name)
+			}
+
+			continue
 		}
 
-		config, err := db.GetConfiguration()
+		value, err := p.parse(raw)
 		if err != nil {
-			return err
+			return "", err
 		}
 
-		// Create the cipher.
-		// TODO: should be cached.
-		chacha, err := chacha20poly1305.New(config.ChaChaKey)
-		if err != nil {
-			return err
+		fields[p.field] = value
+	}
+
+	for name := range params {
+		if !known[name] {
+			return "", fmt.Errorf("unknown parameter %s", name)
 		}
+	}
 
-		// Create the nonce and seal the box.
-		// Ensure that nulls and carriage returns aren't present because the C++ firmware can't handle them correctly
-		// and it will fail to authenticate the ciphertext.
-		// TODO: *properly* fix this.
-		var nonce, raw []byte
-		forbidden := "\x00\x0d"
+	return string(util.Marshal(fields)), nil
+}
 
-		for {
-			nonce, raw = nil, nil
+// Validates the provided parameters like build and checks that the target system can carry out the command.
+func (d commandDefinition) buildFor(target string, params map[string]json.RawMessage) (string, error) {
+	raw, err := d.build(params)
+	if err != nil || d.checkTarget == nil {
+		return raw, err
+	}
 
-			nonce = make([]byte, chacha20poly1305.NonceSize)
-			if _, err := rand.Read(nonce); err != nil {
-				panic(err)
-			}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+		return "", err
+	}
 
-			raw = chacha.Seal(raw, nonce, []byte(command), nil)
+	return raw, d.checkTarget(target, fields)
+}
 
-			if !bytes.ContainsAny(nonce, forbidden) && !bytes.ContainsAny(raw, forbidden) {
-				break
-			}
+// Checks that every system that would receive a sleep command can sleep for the requested period.
+func checkSleepPeriod(target string, fields map[string]interface{}) error {
+	period, _ := fields["Period"].(float64)
+	includeController, _ := fields["IncludeController"].(bool)
+
+	var systems []util.GardenSystem
+	if strings.EqualFold(target, command.Broadcast) {
+		systems = db.GetAllSystems()
+	} else if system, err := db.GetSystem(target, false); err == nil {
+		systems = append(systems, system)
+	}
+
+	for _, system := range systems {
+		// Coordinators ignore sleep commands unless they're explicitly included.
+		if !system.Announcement.IsMesh && !includeController {
+			continue
 		}
 
-		// Garden systems expect nonce + tag + ciphertext, not nonce + ciphertext + tag. Swap the bytes to account for this.
-		start := len(raw) - 16
-		tag, ciphertext := raw[start:], raw[:start]
+		chipset := strings.ToLower(system.Announcement.Chipset)
+		if strings.HasPrefix(chipset, "esp32") {
+			chipset = "esp32"
+		}
+
+		// Systems that haven't announced a known chipset get the shortest limit.
+		limit, ok := maxSleepPeriod[chipset]
+		if !ok {
+			limit = maxSleepPeriod["esp8266"]
+		}
 
-		command = fmt.Sprintf("e%s%s%s", nonce, tag, ciphertext)
+		if int(period) > limit {
+			return fmt.Errorf("period must be at most %d for %s (%s)", limit, system.Identifier, system.Announcement.Chipset)
+		}
 	}
 
-	// Get the system
-	isMesh := false
-	if id != "FFFFFFFFFFFF" {
-		// If this is not a broadcast message, lookup the individual system to send the message to
-		system, err := db.GetSystem(id, false)
-		if err != nil {
-			return err
+	return nil
+}
+
+// Returns a copy of the parameters without any secret parameters.
+func (d commandDefinition) redact(params map[string]json.RawMessage) map[string]json.RawMessage {
+	redacted := map[string]json.RawMessage{}
+	for k, v := range params {
+		redacted[k] = v
+	}
+
+	for _, p := range d.Parameters {
+		if p.Secret {
+			delete(redacted, p.Name)
+		}
+	}
+
+	return redacted
+}
+
+func (p commandParameter) parse(raw json.RawMessage) (interface{}, error) {
+	switch p.Type {
+	case parameterInteger:
+		var value int
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, fmt.Errorf("%s must be an integer", p.Name)
+		} else if value < p.Minimum || value > p.Maximum {
+			return nil, fmt.Errorf("%s must be between %d and %d", p.Name, p.Minimum, p.Maximum)
+		}
+
+		return value, nil
+
+	case parameterBoolean:
+		var value bool
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, fmt.Errorf("%s must be a boolean", p.Name)
 		}
 
-		isMesh = system.Announcement.IsMesh
-	} else {
-		isMesh = true
+		return value, nil
+
+	case parameterString:
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, fmt.Errorf("%s must be a string", p.Name)
+		} else if len(value) > p.MaxLength {
+			return nil, fmt.Errorf("%s cannot be longer than %d bytes", p.Name, p.MaxLength)
+		}
+
+		return value, nil
+
+	default:
+		panic("unknown parameter type " + p.Type)
 	}
+}
 
-	logrus.Debugf("[server] sending command to %s: %s", id, command)
+// Sends a typed command to a system. Parameters are provided as a JSON object in the request body and the command is
+// always encrypted.
+func SendTypedCommand(w http.ResponseWriter, r *http.Request) {
+	id, err := getId(w, r)
+	if err != nil {
+		return
+	}
 
-	mqttDest := id
-	mqttPayload := command
+	tmpl, _ := mux.CurrentRoute(r).GetPathTemplate()
+	definition := commandRegistry[tmpl[len("/system/{id}/"):]]
 
-	// If this system is connected over MQTT, send the raw command
-	if isMesh {
-		// Mesh connected systems are controlled by sending a command (MQTT) to the coordinator who will rebroadcast it (ESP-NOW)
-		coordinator, err := db.GetCoordinator()
-		if err != nil {
-			return err
+	body, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	params := map[string]json.RawMessage{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &params); err != nil {
+			logrus.Warnf("[server] unable to parse %s command parameters: %s", definition.Name, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
+	}
 
-		mqttDest = coordinator.Identifier
+	raw, err := definition.buildFor(id, params)
+	if err != nil {
+		logrus.Warnf("[server] invalid %s command: %s", definition.Name, err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
-		// +12 bytes for the MAC address and +4 bytes for "dst-"
-		logrus.Debugf("[server] mesh payload will be %d bytes long", len(mqttPayload)+12+4)
+	entry, err := command.Send(id, raw, true)
+	if err != nil {
+		logrus.Warnf("[server] unable to send %s command to %s: %s", definition.Name, id, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	logrus.Printf("[server] user %s sent %s command to %s", getUser(r).Username, definition.Name, id)
 
-		// Construct the mesh payload
-		mqttPayload = fmt.Sprintf(`{"Command":"Publish","Payload":"h%x"}`, "dst-"+id+mqttPayload)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(util.Marshal(entry))
+}
+
+// Describes every typed command and its parameters.
+func GetCommandSchema(w http.ResponseWriter, r *http.Request) {
+	var definitions []commandDefinition
+	for _, definition := range commandRegistry {
+		definitions = append(definitions, definition)
 	}
 
-	logrus.Debugf("[server] commanding \"%s\"", mqttDest)
-	logrus.Debugf("[server] mqtt payload \"%s\"", mqttPayload)
+	sort.Slice(definitions, func(i, j int) bool {
+		return definitions[i].Name < definitions[j].Name
+	})
+
+	w.Write(util.Marshal(definitions))
+}
 
-	mqtt.Publish(fmt.Sprintf("garden/module/%s/cmnd", mqttDest), mqttPayload)
+// Returns the delivery status of a command.
+func GetCommand(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-	return nil
+	entry, err := db.GetCommandLog(uint(id))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Write(util.Marshal(entry))
 }
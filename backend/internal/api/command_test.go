@@ -0,0 +1,116 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildCommand(t *testing.T) {
+	tests := []struct {
+		command  string
+		params   string
+		expected string
+		err      string
+	}{
+		{command: "restart", params: `{}`, expected: `{"Command":"restart"}`},
+		{command: "sleep", params: `{"period":60}`, expected: `{"Command":"sleep","Period":60}`},
+		{
+			command:  "sleep",
+			params:   `{"period":60,"includeController":true}`,
+			expected: `{"Command":"sleep","IncludeController":true,"Period":60}`,
+		},
+		{command: "sleep", params: `{}`, err: "period is required"},
+		{command: "sleep", params: `{"period":0}`, err: "period must be between 1 and 86400"},
+		{command: "sleep", params: `{"period":1.5}`, err: "period must be an integer"},
+		{command: "sleep", params: `{"period":"60"}`, err: "period must be an integer"},
+		{command: "sleep", params: `{"period":60,"includeController":1}`, err: "includeController must be a boolean"},
+		{command: "restart", params: `{"force":true}`, err: "unknown parameter force"},
+		{command: "wifi", params: `{"ssid":"garden","password":null}`, expected: `{"WifiSSID":"garden"}`},
+		{command: "wifi", params: `{"ssid":"this ssid is much too long to be valid"}`, err: "ssid cannot be longer than 32 bytes"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.command+test.params, func(t *testing.T) {
+			var params map[string]json.RawMessage
+			require.NoError(t, json.Unmarshal([]byte(test.params), &params))
+
+			definition, ok := commandRegistry[test.command]
+			require.True(t, ok)
+
+			actual, err := definition.build(params)
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func TestCommandRegistry(t *testing.T) {
+	for name, definition := range commandRegistry {
+		assert.Equal(t, name, definition.Name)
+		assert.True(t, definition.Role.Valid(), name)
+		assert.Equal(t, definition.Role, routeRoles["/system/{id}/"+name], name)
+
+		for _, p := range definition.Parameters {
+			assert.NotEmpty(t, p.field, "%s.%s", name, p.Name)
+		}
+	}
+}
+
+func TestRedactParameters(t *testing.T) {
+	params := map[string]json.RawMessage{
+		"ssid":     json.RawMessage(`"garden"`),
+		"password": json.RawMessage(`"hunter2"`),
+	}
+
+	redacted := commandRegistry["wifi"].redact(params)
+	assert.Equal(t, map[string]json.RawMessage{"ssid": json.RawMessage(`"garden"`)}, redacted)
+	assert.Len(t, params, 2)
+}
+
+func TestSleepPeriod(t *testing.T) {
+	db.InitializeTestDatabase(t)
+
+	systems := []util.GardenSystemInfo{
+		{Chipset: "ESP8266"},
+		{Chipset: "ESP32", IsMesh: true},
+		{Chipset: "ESP32-S3", IsMesh: true},
+	}
+
+	for i, info := range systems {
+		id := []string{"aaaaaaaaaaaa", "bbbbbbbbbbbb", "cccccccccccc"}[i]
+		require.NoError(t, db.CreateSystem(util.GardenSystem{Identifier: id, Announcement: info}))
+	}
+
+	sleep := commandRegistry["sleep"]
+	night := map[string]json.RawMessage{"period": json.RawMessage("28800")}
+
+	_, err := sleep.buildFor("bbbbbbbbbbbb", night)
+	assert.NoError(t, err)
+
+	// Coordinators are only checked if they are also put to sleep.
+	_, err = sleep.buildFor("FFFFFFFFFFFF", night)
+	assert.NoError(t, err)
+
+	night["includeController"] = json.RawMessage("true")
+	for _, target := range []string{"aaaaaaaaaaaa", "FFFFFFFFFFFF"} {
+		_, err = sleep.buildFor(target, night)
+		assert.EqualError(t, err, "period must be at most 10800 for aaaaaaaaaaaa (ESP8266)")
+	}
+
+	_, err = sleep.buildFor("FFFFFFFFFFFF", map[string]json.RawMessage{
+		"period":            json.RawMessage("3600"),
+		"includeController": json.RawMessage("true"),
+	})
+	assert.NoError(t, err)
+}
@@ -1,13 +1,15 @@
 package api
 
 import (
-	_ "embed"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ConfusedPolarBear/garden/internal/db"
@@ -19,31 +21,26 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func ManifestHandler(w http.ResponseWriter, _ *http.Request) {
-	w.Write(firmware.ReadFirmwareManifest())
+// Serves the web flasher manifest for the default builds or the version in the route.
+func ManifestHandler(w http.ResponseWriter, r *http.Request) {
+	manifest, err := firmware.BuildManifest(mux.Vars(r)["version"])
+	if err != nil {
+		logrus.Warnf("[server] unable to build firmware manifest: %s", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(util.Marshal(manifest))
 }
 
 func DownloadFirmware(w http.ResponseWriter, r *http.Request) {
-	// If this is a garden system downloading this binary, broadcast the fact that it just started downloading.
-	id := r.Header.Get("System-ID")
-	if util.SystemIdentifierRegex.MatchString(id) {
-		system, err := db.GetSystem(id, false)
-		if err == nil {
-			system.UpdatedAt = time.Now()
-			system.UpdateStatus = util.OTAStatus{
-				Success: true,
-				Message: fmt.Sprintf("Backend: device %s started downloading update", id),
-			}
-			websocket.BroadcastWebsocketMessage("update", system)
-
-			// no need to call db.UpdateSystem() as UpdateStatus isn't stored persistently
-		}
-	}
+	broadcastDownload(r)
 
 	// Test if this is a short URL handler.
 	name := mux.CurrentRoute(r).GetName()
 	if name == "esp8266" || name == "esp32" {
-		sendFirmware(w, name, "firmware.bin")
+		sendFirmware(w, path.Join("data/firmware", name, "firmware.bin"))
 		return
 	}
 
@@ -64,13 +61,47 @@ func DownloadFirmware(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sendFirmware(w, board, file)
+	sendFirmware(w, path.Join("data/firmware", board, file))
 }
 
-func sendFirmware(w http.ResponseWriter, board, file string) {
-	// Open the firmware binary
-	p := path.Join("data/firmware", board, file)
+// Downloads a stored build. Used by systems that were asked to install a specific version.
+func DownloadFirmwareBuild(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	build, err := db.GetFirmwareBuild(uint(id))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	broadcastDownload(r)
+	sendFirmware(w, firmware.BuildPath(build))
+}
+
+// If this is a garden system downloading a binary, broadcast the fact that it just started downloading.
+func broadcastDownload(r *http.Request) {
+	id := r.Header.Get("System-ID")
+	if util.SystemIdentifierRegex.MatchString(id) {
+		system, err := db.GetSystem(id, false)
+		if err == nil {
+			system.UpdatedAt = time.Now()
+			system.UpdateStatus = util.OTAStatus{
+				Success: true,
+				Message: fmt.Sprintf("Backend: device %s started downloading update", id),
+			}
+			websocket.BroadcastWebsocketMessage("update", system)
 
+			// no need to call db.UpdateSystem() as UpdateStatus isn't stored persistently
+		}
+	}
+}
+
+func sendFirmware(w http.ResponseWriter, p string) {
+	// Open the firmware binary
 	f, err := os.Open(p)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
@@ -95,3 +126,178 @@ func sendFirmware(w http.ResponseWriter, board, file string) {
 		logrus.Warnf("[server] unable to send firmware: %s", err)
 	}
 }
+
+// Maximum size of an uploaded firmware image. The largest supported flash partition is 4 MB.
+const maxFirmwareSize = 8 << 20
+
+// Maximum size of an uploaded ESP32 blob or blob archive.
+const maxBlobUploadSize = 1 << 20
+
+func GetFirmwareBuilds(w http.ResponseWriter, r *http.Request) {
+	w.Write(util.Marshal(db.GetFirmwareBuilds(strings.ToLower(r.URL.Query().Get("chipset")))))
+}
+
+// Uploads a new firmware build as a multipart form. The image is sent in the firmware field.
+func UploadFirmware(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxFirmwareSize+(1<<20))
+
+	if err := r.ParseMultipartForm(maxFirmwareSize); err != nil {
+		logrus.Warnf("[server] unable to parse firmware upload: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	file, _, err := r.FormFile("firmware")
+	if err != nil {
+		logrus.Warnf("[server] firmware upload is missing the image: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	defer file.Close()
+
+	image, err := io.ReadAll(io.LimitReader(file, maxFirmwareSize+1))
+	if err != nil || len(image) > maxFirmwareSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	build, err := firmware.StoreBuild(firmware.Upload{
+		Chipset: r.FormValue("chipset"),
+		Version: r.FormValue("version"),
+		Notes:   r.FormValue("notes"),
+		SHA256:  r.FormValue("sha256"),
+		Default: r.FormValue("default") == "true",
+	}, image)
+
+	if err != nil {
+		logrus.Warnf("[server] unable to store firmware build: %s", err)
+
+		switch {
+		case errors.Is(err, firmware.ErrDuplicateVersion):
+			w.WriteHeader(http.StatusConflict)
+
+		case errors.Is(err, firmware.ErrUnknownChipset), errors.Is(err, firmware.ErrInvalidVersion), errors.Is(err, firmware.ErrInvalidImage),
+			errors.Is(err, firmware.ErrChipsetMismatch), errors.Is(err, firmware.ErrChecksumMismatch):
+			w.WriteHeader(http.StatusBadRequest)
+
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	logrus.Printf("[server] user %s uploaded %s firmware %s", getUser(r).Username, build.Chipset, build.Version)
+
+	w.Write(util.Marshal(build))
+}
+
+// Makes a build the default for its chipset. Setting an older build as the default rolls back the firmware served to
+// new systems and sent by updates that don't request a version.
+func SetDefaultFirmware(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	build, err := firmware.SetDefaultBuild(uint(id))
+	if err != nil {
+		logrus.Warnf("[server] unable to set default firmware to build %d: %s", id, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Write(util.Marshal(build))
+}
+
+func DeleteFirmware(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := firmware.DeleteBuild(uint(id)); err != nil {
+		logrus.Warnf("[server] unable to delete firmware build %d: %s", id, err)
+
+		if errors.Is(err, firmware.ErrDefaultBuild) {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Reports which ESP32 support files are installed.
+func GetEsp32Blobs(w http.ResponseWriter, r *http.Request) {
+	w.Write(util.Marshal(firmware.GetBlobStatus()))
+}
+
+// Imports ESP32 support files as a multipart form. Either upload a blob archive in the archive field (with an optional
+// sha256 field) or individual blobs in fields named after their short names, each with a <name>_sha256 field.
+func ImportEsp32Blobs(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 4*maxBlobUploadSize)
+
+	if err := r.ParseMultipartForm(maxBlobUploadSize); err != nil {
+		logrus.Warnf("[server] unable to parse blob upload: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var err error
+
+	if archive, ok := readFormFile(r, "archive"); ok {
+		err = firmware.ImportBlobArchive(archive, r.FormValue("sha256"))
+	} else {
+		files := make(map[string]firmware.BlobFile)
+		for _, key := range firmware.BlobKeys() {
+			if contents, ok := readFormFile(r, key); ok {
+				files[key] = firmware.BlobFile{Data: contents, SHA256: r.FormValue(key + "_sha256")}
+			}
+		}
+
+		if len(files) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err = firmware.ImportBlobs(files)
+	}
+
+	if err != nil {
+		logrus.Warnf("[server] unable to import ESP32 blobs: %s", err)
+
+		if errors.Is(err, firmware.ErrBlobChecksum) || errors.Is(err, firmware.ErrMissingBlob) ||
+			errors.Is(err, firmware.ErrInvalidBlob) || errors.Is(err, firmware.ErrUnknownBlob) {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	logrus.Printf("[server] user %s imported ESP32 blobs", getUser(r).Username)
+
+	w.Write(util.Marshal(firmware.GetBlobStatus()))
+}
+
+// Returns the contents of an uploaded file, if it was uploaded and is no larger than a blob archive.
+func readFormFile(r *http.Request, field string) ([]byte, bool) {
+	file, _, err := r.FormFile(field)
+	if err != nil {
+		return nil, false
+	}
+
+	defer file.Close()
+
+	contents, err := io.ReadAll(io.LimitReader(file, maxBlobUploadSize))
+
+	return contents, err == nil
+}
@@ -1,15 +1,16 @@
 package api
 
 import (
-	"encoding/hex"
-	"fmt"
-	"io"
+	"errors"
 	"net/http"
-	"os"
-	"path"
 	"strings"
+	"time"
 
+	"github.com/ConfusedPolarBear/garden/internal/command"
 	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/firmware"
+	"github.com/ConfusedPolarBear/garden/internal/rollout"
+	"github.com/ConfusedPolarBear/garden/internal/rotation"
 	"github.com/ConfusedPolarBear/garden/internal/util"
 	"github.com/ConfusedPolarBear/garden/internal/websocket"
 
@@ -20,41 +21,118 @@ import (
 func StartServer() {
 	bind := "0.0.0.0:8081"
 
+	logrus.Printf("[server] API server listening on http://%s", bind)
+	if err := http.ListenAndServe(bind, newHandler()); err != nil {
+		panic(err)
+	}
+}
+
+// Registers every route. CORS preflight requests are answered before routing, so they never reach the
+// authentication middleware or a handler.
+func newHandler() http.Handler {
 	r := mux.NewRouter()
-	r.Use(corsMiddleware)
+	r.Use(authMiddleware)
+	r.Use(roleMiddleware)
 
 	r.HandleFunc("/ping", PingHandler).Methods("GET")
 
+	r.HandleFunc("/auth/login", LoginHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/auth/logout", LogoutHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/auth/tokens", GetTokens).Methods("GET")
+	r.HandleFunc("/auth/tokens", CreateToken).Methods("POST", "OPTIONS")
+	r.HandleFunc("/auth/tokens/delete/{id}", DeleteToken).Methods("POST", "OPTIONS")
+
+	r.HandleFunc("/user", GetCurrentUser).Methods("GET")
+	r.HandleFunc("/user/password", ChangePassword).Methods("POST", "OPTIONS")
+	r.HandleFunc("/users", GetUsers).Methods("GET")
+	r.HandleFunc("/users", CreateUser).Methods("POST", "OPTIONS")
+	r.HandleFunc("/users/role/{id}", SetUserRole).Methods("POST", "OPTIONS")
+	r.HandleFunc("/users/delete/{id}", DeleteUser).Methods("POST", "OPTIONS")
+
 	r.HandleFunc("/systems", GetSystems).Methods("GET")
 	r.HandleFunc("/system/{id}", GetSystem).Methods("GET")
+	r.HandleFunc("/system/{id}/readings", GetReadings).Methods("GET")
+	r.HandleFunc("/system/{id}/status", GetStatusHistory).Methods("GET")
+	r.HandleFunc("/system/{id}/mesh/stats", GetMeshStatistics).Methods("GET")
+	r.HandleFunc("/system/{id}/networks", GetNetworkScans).Methods("GET")
+	r.HandleFunc("/system/{id}/tags", GetSystemTags).Methods("GET")
+	r.HandleFunc("/system/{id}/tags", SetSystemTags).Methods("POST", "OPTIONS")
+	r.HandleFunc("/system/{id}/queue", GetCommandQueue).Methods("GET")
+	r.HandleFunc("/system/{id}/queue/{entry}", SetQueuedCommandExpiry).Methods("POST", "OPTIONS")
+	r.HandleFunc("/system/{id}/queue/delete/{entry}", DeleteQueuedCommand).Methods("POST", "OPTIONS")
 	r.HandleFunc("/system/delete/{id}", DeleteSystem).Methods("POST")
 	r.HandleFunc("/system/command/{id}", SendCommandHandler).Methods("POST", "OPTIONS")
 	r.HandleFunc("/system/update/{id}", StartOTA).Methods("POST", "OPTIONS")
-
+	registerCommands(r)
+
+	// The schema must be registered first as it would otherwise be matched as a command ID.
+	r.HandleFunc("/commands/schema", GetCommandSchema).Methods("GET")
+	r.HandleFunc("/commands/{id}", GetCommand).Methods("GET")
+
+	r.HandleFunc("/rollouts", GetRollouts).Methods("GET")
+	r.HandleFunc("/rollouts", StartRollout).Methods("POST", "OPTIONS")
+	r.HandleFunc("/rollouts/{id}", GetRollout).Methods("GET")
+	r.HandleFunc("/rollouts/{id}/pause", PauseRollout).Methods("POST", "OPTIONS")
+	r.HandleFunc("/rollouts/{id}/resume", ResumeRollout).Methods("POST", "OPTIONS")
+	r.HandleFunc("/rollouts/{id}/cancel", CancelRollout).Methods("POST", "OPTIONS")
+
+	r.HandleFunc("/schedules", GetSchedules).Methods("GET")
+	r.HandleFunc("/schedules", CreateSchedule).Methods("POST", "OPTIONS")
+	r.HandleFunc("/schedules/{id}", GetSchedule).Methods("GET")
+	r.HandleFunc("/schedules/{id}", UpdateSchedule).Methods("POST", "OPTIONS")
+	r.HandleFunc("/schedules/{id}/runs", GetScheduleRuns).Methods("GET")
+	r.HandleFunc("/schedules/delete/{id}", DeleteSchedule).Methods("POST", "OPTIONS")
+
+	r.HandleFunc("/alerts", GetAlerts).Methods("GET")
+	r.HandleFunc("/alerts/rules", GetAlertRules).Methods("GET")
+	r.HandleFunc("/alerts/rules", CreateAlertRule).Methods("POST", "OPTIONS")
+	r.HandleFunc("/alerts/rules/delete/{id}", DeleteAlertRule).Methods("POST", "OPTIONS")
+	r.HandleFunc("/notify/test", TestNotifications).Methods("POST", "OPTIONS")
+
+	r.HandleFunc("/firmware", UploadFirmware).Methods("POST", "OPTIONS")
+	r.HandleFunc("/firmware/builds", GetFirmwareBuilds).Methods("GET")
+	r.HandleFunc("/firmware/default/{id}", SetDefaultFirmware).Methods("POST", "OPTIONS")
+	r.HandleFunc("/firmware/delete/{id}", DeleteFirmware).Methods("POST", "OPTIONS")
+	r.HandleFunc("/firmware/esp32/blobs", GetEsp32Blobs).Methods("GET")
+	r.HandleFunc("/firmware/esp32/blobs", ImportEsp32Blobs).Methods("POST", "OPTIONS")
 	r.HandleFunc("/firmware/manifest.json", ManifestHandler).Methods("GET")
+	r.HandleFunc("/firmware/{version}/manifest.json", ManifestHandler).Methods("GET")
 	r.HandleFunc("/firmware/{board}/{file}", DownloadFirmware).Methods("GET")
 
 	// Short URLs to download firmware from. Added to save space in marshalled update commands.
 	r.HandleFunc("/fw82", DownloadFirmware).Methods("GET").Name("esp8266")
 	r.HandleFunc("/fw32", DownloadFirmware).Methods("GET").Name("esp32")
+	r.HandleFunc("/fw/{id}", DownloadFirmwareBuild).Methods("GET")
+
+	r.HandleFunc("/provision", GetProvisioningLinks).Methods("GET")
+	r.HandleFunc("/provision", CreateProvisioningLink).Methods("POST", "OPTIONS")
+	r.HandleFunc("/provision/delete/{id}", DeleteProvisioningLink).Methods("POST", "OPTIONS")
+	r.HandleFunc("/provision/{token}/manifest.json", GetProvisioningManifest).Methods("GET")
+	r.HandleFunc("/provision/{token}/config", GetProvisioningConfig).Methods("GET")
+	r.HandleFunc("/provision/{token}/filesystem/{chipset}", DownloadProvisionedFilesystem).Methods("GET")
 
 	r.HandleFunc("/mesh/info", MeshInfoHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/mesh/packets", GetReassemblyStatistics).Methods("GET")
+	r.HandleFunc("/mesh/rotations", GetKeyRotations).Methods("GET")
+	r.HandleFunc("/mesh/rotate", StartKeyRotation).Methods("POST", "OPTIONS")
+	r.HandleFunc("/mesh/rotate/cancel", CancelKeyRotation).Methods("POST", "OPTIONS")
 
 	r.HandleFunc("/socket", websocket.WebSocketHandler)
 
-	logrus.Printf("[server] API server listening on http://%s", bind)
-	if err := http.ListenAndServe(bind, r); err != nil {
-		panic(err)
-	}
+	return corsMiddleware(r)
 }
 
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		// TODO: add authorization
-		// w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
 
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
@@ -83,6 +161,60 @@ func GetSystem(w http.ResponseWriter, r *http.Request) {
 	w.Write(util.Marshal(system))
 }
 
+// Returns aggregated readings for a system. All query parameters are optional: from and to are RFC 3339 timestamps
+// (defaulting to the last 24 hours), bucket is a duration like 5m and agg is one of avg, min or max.
+func GetReadings(w http.ResponseWriter, r *http.Request) {
+	id, err := getId(w, r)
+	if err != nil {
+		return
+	}
+
+	from, to, err := getTimeRange(w, r)
+	if err != nil {
+		return
+	}
+
+	query := r.URL.Query()
+
+	bucket := 5 * time.Minute
+	if raw := query.Get("bucket"); raw != "" {
+		if bucket, err = time.ParseDuration(raw); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	agg := db.Aggregation(query.Get("agg"))
+	if agg == "" {
+		agg = db.AggregateAverage
+	}
+
+	// Limit the number of buckets to keep responses to a reasonable size.
+	if !from.Before(to) || bucket < time.Minute || to.Sub(from)/bucket > 10_000 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	readings, err := db.GetReadings(id, from, to, bucket, agg)
+	if err != nil {
+		logrus.Warnf("[api] unable to get readings for %s: %s", id, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Write(util.Marshal(readings))
+}
+
+// Returns the most recent online/offline transitions of a system.
+func GetStatusHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := getId(w, r)
+	if err != nil {
+		return
+	}
+
+	w.Write(util.Marshal(db.GetStatusHistory(id, 100)))
+}
+
 func DeleteSystem(w http.ResponseWriter, r *http.Request) {
 	id, err := getId(w, r)
 	if err != nil {
@@ -95,9 +227,16 @@ func DeleteSystem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A deleted system can't acknowledge a new mesh key, so it may have been the last one a rotation was waiting on.
+	go rotation.CheckComplete()
+
+	// Likewise, a rollout may have been waiting for it to announce the new version.
+	go rollout.Check()
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// Sends a raw command to a system. New clients should use the typed commands described by /commands/schema instead.
 func SendCommandHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := getId(w, r)
 	if err != nil {
@@ -111,32 +250,28 @@ func SendCommandHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	command := r.Form.Get("command")
-	if command == "" || len(command) > 210 {
+	raw := r.Form.Get("command")
+	if raw == "" || len(raw) > 210 {
 		w.WriteHeader(http.StatusRequestEntityTooLarge)
 		return
 	}
 
 	encrypt := r.Form.Has("encrypt")
 
-	if err := sendCommand(id, command, encrypt); err != nil {
+	entry, err := command.Send(id, raw, encrypt)
+	if err != nil {
 		logrus.Warnf("[server] unable to send command: %s", err)
 		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
+
+	// The command was published but hasn't necessarily been received. Clients can poll /commands/{id} or listen for
+	// websocket messages to find out.
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(util.Marshal(entry))
 }
 
 func StartOTA(w http.ResponseWriter, r *http.Request) {
-	type otaCommand struct {
-		Command  string
-		SSID     string `json:"S"`
-		PSK      string `json:"P"`
-		URL      string `json:"U"`
-		Size     int64  `json:"L"`
-		Checksum string `json:"C"`
-	}
-
-	ota := otaCommand{Command: "Update"}
-
 	// Get the system that is going to be updated & validate its information
 	id, err := getId(w, r)
 	if err != nil {
@@ -150,13 +285,6 @@ func StartOTA(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	chipset := strings.ToLower(system.Announcement.Chipset)
-	if chipset != "esp8266" && chipset != "esp32" {
-		logrus.Warnf("[server] system %s has unknown chipset %s", id, chipset)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
 	// Get the Wi-Fi SSID & PSK
 	if err := r.ParseForm(); err != nil {
 		logrus.Warnf("[server] unable to parse ota form: %s", err)
@@ -164,115 +292,81 @@ func StartOTA(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ota.SSID, ota.PSK = r.Form.Get("ssid"), r.Form.Get("psk")
-
-	if ota.SSID == "" || len(ota.SSID) > 32 || ota.PSK == "" || len(ota.PSK) > 64 {
-		logrus.Warn("[server] ssid or psk are invalid")
-		w.WriteHeader(http.StatusBadRequest)
+	host, ok := getUpdateHost(w, r)
+	if !ok {
 		return
 	}
 
-	// Get the server (if specified), otherwise fall back to the host
-	host := r.Form.Get("host")
-	if host == "" {
-		host = r.Host
-		logrus.Warn("[server] no host specified for OTA, falling back to HTTP host.")
-
-		if strings.HasPrefix(host, "127.0.0.1") {
-			logrus.Warnf("[server] HTTP host is %s, which is inaccessible for systems to update from.", host)
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+	opts := firmware.UpdateOptions{
+		SSID:       r.Form.Get("ssid"),
+		PSK:        r.Form.Get("psk"),
+		Host:       host,
+		Version:    r.Form.Get("version"),
+		ForceError: r.Form.Get("error"),
 	}
 
-	forceError := r.Form.Get("error")
-	if forceError == "host" {
-		host = "127.0.0.1:6969"
+	// Reinstalling the running version must be explicitly requested.
+	if r.Form.Get("force") != "true" {
+		opts.CurrentVersion = system.Announcement.AppVersion
 	}
 
-	host = strings.TrimSuffix(host, "/")
-
-	// Read the latest firmware binary to get its length & checksum.
-	fw := path.Join("data/firmware/", chipset, "firmware.bin")
+	ota, err := firmware.BuildUpdate(system.Announcement.Chipset, opts)
 
-	f, err := os.Open(fw)
 	if err != nil {
-		logrus.Warnf("[server] unable to open firmware for %s (chipset %s) at %s: %s", id, chipset, fw, err)
-		w.WriteHeader(http.StatusNotFound)
+		logrus.Warnf("[server] unable to build update for %s: %s", id, err)
+		w.WriteHeader(updateErrorStatus(err))
 		return
 	}
 
-	defer f.Close()
-
-	if stat, err := f.Stat(); err != nil {
-		logrus.Warnf("[server] unable to stat firmware for %s (chipset %s) at %s: %s", id, chipset, fw, err)
-		w.WriteHeader(http.StatusNotFound)
-		return
-	} else {
-		ota.Size = stat.Size()
-	}
+	pw := ota.PSK
+	ota.PSK = "[redacted]"
+	logrus.Debugf("[server] constructed OTA payload %#v", ota)
+	ota.PSK = pw
 
-	// Calculate the checksum with MD5 (terrible, but it's the best algorithm natively supported).
-	contents, err := io.ReadAll(f)
+	entry, err := command.Send(id, string(util.Marshal(ota)), true)
 	if err != nil {
-		logrus.Warnf("[server] unable to read firmware for %s (chipset %s) at %s: %s", id, chipset, fw, err)
-		w.WriteHeader(http.StatusNotFound)
+		logrus.Warnf("[server] unable to initiate OTA for %s: %s", id, err)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	ota.Checksum = util.MD5(contents)
-
-	// Construct the short firmware download URL to use.
-	shortCode := "fw32"
-	if chipset == "esp8266" {
-		shortCode = "fw82"
-	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(util.Marshal(entry))
+}
 
-	if forceError == "url" {
-		shortCode = "dead"
+// Returns the host systems should download updates from. Uses the host form value if present, otherwise falls back to
+// the HTTP host.
+func getUpdateHost(w http.ResponseWriter, r *http.Request) (string, bool) {
+	host := r.Form.Get("host")
+	if host != "" {
+		return host, true
 	}
 
-	ota.URL = fmt.Sprintf("%s/%s", host, shortCode)
+	host = r.Host
+	logrus.Warn("[server] no host specified for OTA, falling back to HTTP host.")
 
-	// If a forced error was requested it, make it happen
-	if forceError != "" {
-		logrus.Errorf("[server] injecting %s error in update for %s!", forceError, id)
-
-		random := hex.EncodeToString(util.SecureRandom(16))
-
-		switch forceError {
-		case "ssid":
-			ota.SSID = random
-
-		case "psk":
-			ota.PSK = random
-
-		case "host", "url":
-			// handled above
-
-		case "size":
-			ota.Size /= 2
+	if strings.HasPrefix(host, "127.0.0.1") {
+		logrus.Warnf("[server] HTTP host is %s, which is inaccessible for systems to update from.", host)
+		w.WriteHeader(http.StatusBadRequest)
+		return "", false
+	}
 
-		case "checksum":
-			ota.Checksum = random
+	return host, true
+}
 
-		default:
-			logrus.Errorf("[server] error type %s is unknown", forceError)
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-	}
+// Returns the HTTP status code for an error building an update.
+func updateErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, firmware.ErrUnknownChipset):
+		return http.StatusInternalServerError
 
-	logrus.Debugf("[server] set OTA url to %s (used host %s)", ota.URL, host)
+	case errors.Is(err, firmware.ErrMissing):
+		return http.StatusNotFound
 
-	pw := ota.PSK
-	ota.PSK = "[redacted]"
-	logrus.Debugf("[server] constructed OTA payload %#v", ota)
-	ota.PSK = pw
+	case errors.Is(err, firmware.ErrSameVersion):
+		return http.StatusConflict
 
-	if err := sendCommand(id, string(util.Marshal(ota)), true); err != nil {
-		logrus.Warnf("[server] unable to initiate OTA for %s: %s", id, err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	default:
+		return http.StatusBadRequest
 	}
 }
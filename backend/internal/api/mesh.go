@@ -1,28 +1,27 @@
 package api
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/mqtt"
+	"github.com/ConfusedPolarBear/garden/internal/rotation"
 	"github.com/ConfusedPolarBear/garden/internal/util"
 
 	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
 )
 
+// Returns the settings new mesh systems need to join the mesh, except for the mesh key which is only handed out by
+// provisioning links.
 func MeshInfoHandler(w http.ResponseWriter, _ *http.Request) {
 	type meshInfo struct {
-		Key        string
 		Controller string
 		Channel    int
 	}
 
-	config, err := db.GetConfiguration()
-	if err != nil {
-		logrus.Errorf("[server] no configuration information found")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
 	// TODO: support multiple coordinators & allow the user to pick which one they want
 	coordinator, err := db.GetCoordinator()
 	if err != nil {
@@ -33,7 +32,79 @@ func MeshInfoHandler(w http.ResponseWriter, _ *http.Request) {
 
 	addr := util.IdentifierToAddress(coordinator.Identifier)
 
-	info := meshInfo{Key: config.MeshKey, Controller: addr, Channel: coordinator.Announcement.Channel}
+	info := meshInfo{Controller: addr, Channel: coordinator.Announcement.Channel}
 
 	w.Write(util.Marshal(info))
 }
+
+// Returns the mesh statistics reported by a system along with the hourly rates of each counter. Accepts the same from
+// and to query parameters as GetReadings.
+func GetMeshStatistics(w http.ResponseWriter, r *http.Request) {
+	type meshStatistics struct {
+		Samples []util.MeshStatistics
+		Rates   util.MeshRates
+	}
+
+	id, err := getId(w, r)
+	if err != nil {
+		return
+	}
+
+	from, to, err := getTimeRange(w, r)
+	if err != nil {
+		return
+	}
+
+	samples := db.GetMeshStatistics(id, from, to)
+
+	w.Write(util.Marshal(meshStatistics{Samples: samples, Rates: util.ComputeMeshRates(samples)}))
+}
+
+// Returns counters describing how well fragmented mesh messages are being reassembled.
+func GetReassemblyStatistics(w http.ResponseWriter, _ *http.Request) {
+	w.Write(util.Marshal(mqtt.ReassemblyStatistics()))
+}
+
+// Returns the most recent mesh key rotations and the progress of each system, newest first. Supports the optional limit
+// query parameter.
+func GetKeyRotations(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 10
+	}
+
+	w.Write(util.Marshal(db.GetKeyRotations(limit)))
+}
+
+// Generates a new mesh key and starts distributing it to every system.
+func StartKeyRotation(w http.ResponseWriter, r *http.Request) {
+	started, err := rotation.Start()
+	if errors.Is(err, db.ErrRotationInProgress) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		logrus.Warnf("[server] unable to start key rotation: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	logrus.Printf("[server] user %s started key rotation %d", getUser(r).Username, started.ID)
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(util.Marshal(started))
+}
+
+func CancelKeyRotation(w http.ResponseWriter, r *http.Request) {
+	if err := rotation.Cancel(); errors.Is(err, gorm.ErrRecordNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logrus.Warnf("[server] unable to cancel key rotation: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	logrus.Printf("[server] user %s cancelled the key rotation", getUser(r).Username)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,25 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+)
+
+// Returns the most recent Wi-Fi scans performed by a system, newest first. Supports the optional limit query
+// parameter.
+func GetNetworkScans(w http.ResponseWriter, r *http.Request) {
+	id, err := getId(w, r)
+	if err != nil {
+		return
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 10
+	}
+
+	w.Write(util.Marshal(db.GetNetworkScans(id, limit)))
+}
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/config"
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/firmware"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+var errNoCoordinator = errors.New("no coordinator to join")
+
+func GetProvisioningLinks(w http.ResponseWriter, r *http.Request) {
+	w.Write(util.Marshal(db.GetProvisioningLinks(50)))
+}
+
+// Creates a one-time link that provisions a single new system. New mesh systems join through the current coordinator,
+// controllers need Wi-Fi and MQTT settings.
+func CreateProvisioningLink(w http.ResponseWriter, r *http.Request) {
+	type linkResponse struct {
+		Token string
+
+		// Paths of the web flasher manifest and the settings used by the serial setup wizard.
+		Manifest string
+		Config   string
+
+		Info util.ProvisioningLink
+	}
+
+	if err := r.ParseForm(); err != nil {
+		logrus.Warnf("[server] unable to parse provisioning form: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	link := util.ProvisioningLink{
+		CreatedBy:    getUser(r).Username,
+		Name:         r.Form.Get("name"),
+		Controller:   r.Form.Get("controller") == "true",
+		WifiSSID:     r.Form.Get("ssid"),
+		WifiPassword: r.Form.Get("psk"),
+		MQTTHost:     r.Form.Get("mqtt_host"),
+		MQTTUsername: r.Form.Get("mqtt_username"),
+		MQTTPassword: r.Form.Get("mqtt_password"),
+	}
+
+	lifetime := config.GetDuration("provisioning.link_lifetime", time.Hour)
+	if raw := r.Form.Get("lifetime"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed <= 0 || parsed > 24*time.Hour {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		lifetime = parsed
+	}
+
+	link.ExpiresAt = time.Now().Add(lifetime)
+
+	switch {
+	case len(link.Name) > 32:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+
+	case link.Controller && (link.WifiSSID == "" || link.WifiPassword == "" || link.MQTTHost == ""):
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !link.Controller {
+		if _, err := db.GetCoordinator(); err != nil {
+			logrus.Warnf("[server] unable to create provisioning link: %s", errNoCoordinator)
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+	}
+
+	raw, err := db.CreateProvisioningLink(&link)
+	if err != nil {
+		logrus.Errorf("[server] unable to create provisioning link: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	logrus.Printf("[server] user %s created provisioning link %d", link.CreatedBy, link.ID)
+
+	w.Write(util.Marshal(linkResponse{
+		Token:    raw,
+		Manifest: fmt.Sprintf("/provision/%s/manifest.json", raw),
+		Config:   fmt.Sprintf("/provision/%s/config", raw),
+		Info:     link,
+	}))
+}
+
+func DeleteProvisioningLink(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := db.DeleteProvisioningLink(uint(id)); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Serves the web flasher manifest of a provisioning link. Doesn't use up the link.
+func GetProvisioningManifest(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+
+	if _, err := db.GetProvisioningLink(token); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	manifest, err := firmware.BuildProvisioningManifest(fmt.Sprintf("/provision/%s/filesystem/", token))
+	if err != nil {
+		logrus.Warnf("[server] unable to build provisioning manifest: %s", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(util.Marshal(manifest))
+}
+
+// Downloads the data partition image of a provisioning link and uses up the link.
+func DownloadProvisionedFilesystem(w http.ResponseWriter, r *http.Request) {
+	link, settings, ok := getProvisioningSettings(w, r)
+	if !ok {
+		return
+	}
+
+	image, err := firmware.BuildFilesystem(mux.Vars(r)["chipset"], settings)
+	if err != nil {
+		logrus.Warnf("[server] unable to build filesystem for provisioning link %d: %s", link.ID, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !useProvisioningLink(w, r, link) {
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(image)))
+	w.Write(image)
+}
+
+// Returns the settings of a provisioning link for the serial setup wizard and uses up the link.
+func GetProvisioningConfig(w http.ResponseWriter, r *http.Request) {
+	link, settings, ok := getProvisioningSettings(w, r)
+	if !ok || !useProvisioningLink(w, r, link) {
+		return
+	}
+
+	w.Write(util.Marshal(settings))
+}
+
+// Looks up the provisioning link in the route and builds the settings it grants.
+func getProvisioningSettings(w http.ResponseWriter, r *http.Request) (util.ProvisioningLink, firmware.Provisioning, bool) {
+	var settings firmware.Provisioning
+
+	link, err := db.GetProvisioningLink(mux.Vars(r)["token"])
+	if err != nil {
+		logrus.Warnf("[server] rejecting provisioning request from %s: %s", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusNotFound)
+		return link, settings, false
+	}
+
+	// The mesh key is read now instead of when the link was created in case it was rotated since.
+	meshConfig, err := db.GetConfiguration()
+	if err != nil {
+		logrus.Errorf("[server] no configuration information found")
+		w.WriteHeader(http.StatusInternalServerError)
+		return link, settings, false
+	}
+
+	settings = firmware.Provisioning{Name: link.Name, MeshKey: meshConfig.MeshKey}
+
+	if link.Controller {
+		settings.WifiSSID = link.WifiSSID
+		settings.WifiPassword = link.WifiPassword
+		settings.MQTTHost = link.MQTTHost
+		settings.MQTTUsername = link.MQTTUsername
+		settings.MQTTPassword = link.MQTTPassword
+
+		return link, settings, true
+	}
+
+	coordinator, err := db.GetCoordinator()
+	if err != nil {
+		logrus.Warnf("[server] unable to provision system with link %d: %s", link.ID, errNoCoordinator)
+		w.WriteHeader(http.StatusConflict)
+		return link, settings, false
+	}
+
+	settings.MeshController = util.IdentifierToAddress(coordinator.Identifier)
+	settings.MeshChannel = strconv.Itoa(coordinator.Announcement.Channel)
+
+	return link, settings, true
+}
+
+// Marks a provisioning link as used. Fails if another request used it first.
+func useProvisioningLink(w http.ResponseWriter, r *http.Request, link util.ProvisioningLink) bool {
+	if err := db.UseProvisioningLink(link.ID); err != nil {
+		logrus.Warnf("[server] unable to use provisioning link %d: %s", link.ID, err)
+		w.WriteHeader(http.StatusGone)
+		return false
+	}
+
+	logrus.Printf("[server] provisioning link %d used by %s", link.ID, r.RemoteAddr)
+
+	return true
+}
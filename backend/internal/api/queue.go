@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/command"
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Returns the commands waiting for a system to wake up.
+func GetCommandQueue(w http.ResponseWriter, r *http.Request) {
+	id, err := getId(w, r)
+	if err != nil {
+		return
+	}
+
+	w.Write(util.Marshal(db.GetQueuedCommands(id)))
+}
+
+// Changes when a queued command expires. The new expiry is provided as an RFC 3339 timestamp in the expires form field.
+func SetQueuedCommandExpiry(w http.ResponseWriter, r *http.Request) {
+	id, err := getId(w, r)
+	if err != nil {
+		return
+	}
+
+	entry, err := strconv.ParseUint(mux.Vars(r)["entry"], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		logrus.Warnf("[server] unable to parse queue form: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	expires, err := time.Parse(time.RFC3339, r.Form.Get("expires"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	queued, err := db.SetQueuedCommandExpiry(id, uint(entry), expires)
+	if err != nil {
+		logrus.Warnf("[server] unable to change expiry of queued command %d: %s", entry, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Write(util.Marshal(queued))
+}
+
+// Removes a command from a system's queue without sending it. Returns the command's log entry.
+func DeleteQueuedCommand(w http.ResponseWriter, r *http.Request) {
+	id, err := getId(w, r)
+	if err != nil {
+		return
+	}
+
+	entry, err := strconv.ParseUint(mux.Vars(r)["entry"], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	log, err := command.RemoveQueued(id, uint(entry))
+	if err != nil {
+		logrus.Warnf("[server] unable to remove queued command %d: %s", entry, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Write(util.Marshal(log))
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/rollout"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Returns the most recent rollouts, newest first.
+func GetRollouts(w http.ResponseWriter, r *http.Request) {
+	w.Write(util.Marshal(db.GetRollouts(20)))
+}
+
+func GetRollout(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	found, err := db.GetRollout(uint(id))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Write(util.Marshal(found))
+}
+
+// Starts a staged firmware rollout. Expects the form values version, ssid and psk, at least one of chipset and tag,
+// and optionally host and batch (the number of systems updated at once after the canary).
+func StartRollout(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		logrus.Warnf("[server] unable to parse rollout form: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	host, ok := getUpdateHost(w, r)
+	if !ok {
+		return
+	}
+
+	batch := 0
+	if raw := r.Form.Get("batch"); raw != "" {
+		var err error
+		if batch, err = strconv.Atoi(raw); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	started, err := rollout.Start(rollout.Options{
+		Chipset:       r.Form.Get("chipset"),
+		Tag:           r.Form.Get("tag"),
+		TargetVersion: r.Form.Get("version"),
+		BatchSize:     batch,
+		SSID:          r.Form.Get("ssid"),
+		PSK:           r.Form.Get("psk"),
+		Host:          host,
+	})
+
+	if errors.Is(err, db.ErrRolloutInProgress) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		logrus.Warnf("[server] unable to start rollout: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	logrus.Printf("[server] user %s started rollout %d", getUser(r).Username, started.ID)
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(util.Marshal(started))
+}
+
+func PauseRollout(w http.ResponseWriter, r *http.Request) {
+	changeRollout(w, r, "paused", rollout.Pause)
+}
+
+func ResumeRollout(w http.ResponseWriter, r *http.Request) {
+	changeRollout(w, r, "resumed", rollout.Resume)
+}
+
+func CancelRollout(w http.ResponseWriter, r *http.Request) {
+	changeRollout(w, r, "cancelled", rollout.Cancel)
+}
+
+func changeRollout(w http.ResponseWriter, r *http.Request, action string, change func(uint) (util.Rollout, error)) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	changed, err := change(uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logrus.Warnf("[server] unable to change rollout %d: %s", id, err)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	logrus.Printf("[server] user %s %s rollout %d", getUser(r).Username, action, id)
+
+	w.Write(util.Marshal(changed))
+}
+
+func GetSystemTags(w http.ResponseWriter, r *http.Request) {
+	id, err := getId(w, r)
+	if err != nil {
+		return
+	}
+
+	w.Write(util.Marshal(db.GetSystemTags(id)))
+}
+
+// Replaces the tags of a system with the comma separated list in the tags form value.
+func SetSystemTags(w http.ResponseWriter, r *http.Request) {
+	id, err := getId(w, r)
+	if err != nil {
+		return
+	}
+
+	if _, err := db.GetSystem(id, false); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		logrus.Warnf("[server] unable to parse tags form: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tags := []string{}
+	for _, tag := range strings.Split(r.Form.Get("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	if err := db.SetSystemTags(id, tags); err != nil {
+		logrus.Warnf("[server] unable to set tags of %s: %s", id, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Write(util.Marshal(db.GetSystemTags(id)))
+}
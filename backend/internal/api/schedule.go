@@ -0,0 +1,221 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/command"
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/scheduler"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+var errScheduleForbidden = errors.New("insufficient role to schedule this command")
+
+// Body of requests that create or update a schedule. Commands are the same typed commands accepted by
+// POST /system/{id}/{name}.
+type scheduleRequest struct {
+	Name       string
+	Expression string
+
+	// System to send the command to, or FFFFFFFFFFFF for every system.
+	Target string
+
+	Command    string
+	Parameters map[string]json.RawMessage
+
+	// Defaults to true.
+	Enabled *bool
+}
+
+func GetSchedules(w http.ResponseWriter, r *http.Request) {
+	w.Write(util.Marshal(db.GetSchedules()))
+}
+
+func GetSchedule(w http.ResponseWriter, r *http.Request) {
+	schedule, err := getSchedule(w, r)
+	if err != nil {
+		return
+	}
+
+	w.Write(util.Marshal(schedule))
+}
+
+// Returns the most recent runs of a schedule, newest first. Supports the optional query parameter limit.
+func GetScheduleRuns(w http.ResponseWriter, r *http.Request) {
+	schedule, err := getSchedule(w, r)
+	if err != nil {
+		return
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	w.Write(util.Marshal(db.GetScheduleRuns(schedule.ID, limit)))
+}
+
+func CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	var schedule util.Schedule
+	if !parseSchedule(w, r, &schedule) {
+		return
+	}
+
+	if err := db.CreateSchedule(&schedule); err != nil {
+		logrus.Errorf("[server] unable to create schedule: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	logrus.Printf("[server] user %s created schedule %d (%s)", getUser(r).Username, schedule.ID, schedule.Name)
+
+	w.Write(util.Marshal(schedule))
+}
+
+// Replaces every field of a schedule. Secret parameters must be provided again.
+func UpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	schedule, err := getSchedule(w, r)
+	if err != nil {
+		return
+	}
+
+	if !canSchedule(r, schedule.CommandName) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !parseSchedule(w, r, &schedule) {
+		return
+	}
+
+	if err := db.UpdateSchedule(&schedule); err != nil {
+		logrus.Errorf("[server] unable to update schedule %d: %s", schedule.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	logrus.Printf("[server] user %s updated schedule %d (%s)", getUser(r).Username, schedule.ID, schedule.Name)
+
+	w.Write(util.Marshal(schedule))
+}
+
+func DeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	schedule, err := getSchedule(w, r)
+	if err != nil {
+		return
+	}
+
+	if !canSchedule(r, schedule.CommandName) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if err := db.DeleteSchedule(schedule.ID); err != nil {
+		logrus.Warnf("[server] unable to delete schedule %d: %s", schedule.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	logrus.Printf("[server] user %s deleted schedule %d (%s)", getUser(r).Username, schedule.ID, schedule.Name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getSchedule(w http.ResponseWriter, r *http.Request) (util.Schedule, error) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return util.Schedule{}, err
+	}
+
+	schedule, err := db.GetSchedule(uint(id))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+	}
+
+	return schedule, err
+}
+
+// Returns true if the current user is allowed to send the provided typed command.
+func canSchedule(r *http.Request, name string) bool {
+	definition, ok := commandRegistry[name]
+	return !ok || getUser(r).Role.Includes(definition.Role)
+}
+
+// Validates a schedule request and copies it into the provided schedule. Writes an error response and returns false if
+// the request is invalid.
+func parseSchedule(w http.ResponseWriter, r *http.Request, schedule *util.Schedule) bool {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+
+	var req scheduleRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		logrus.Warnf("[server] unable to parse schedule: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+
+	if err := buildSchedule(r, req, schedule); err != nil {
+		logrus.Warnf("[server] invalid schedule: %s", err)
+
+		if errors.Is(err, errScheduleForbidden) {
+			w.WriteHeader(http.StatusForbidden)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+		}
+
+		return false
+	}
+
+	return true
+}
+
+func buildSchedule(r *http.Request, req scheduleRequest, schedule *util.Schedule) error {
+	if req.Name == "" || len(req.Name) > 64 {
+		return errors.New("name must be between 1 and 64 characters")
+	}
+
+	target := req.Target
+	if strings.EqualFold(target, command.Broadcast) {
+		target = command.Broadcast
+	} else if !util.SystemIdentifierRegex.MatchString(target) {
+		return errors.New("invalid target")
+	} else if _, err := db.GetSystem(target, false); err != nil {
+		return errors.New("unknown target system")
+	}
+
+	definition, ok := commandRegistry[req.Command]
+	if !ok {
+		return errors.New("unknown command")
+	} else if !canSchedule(r, req.Command) {
+		return errScheduleForbidden
+	}
+
+	raw, err := definition.buildFor(target, req.Parameters)
+	if err != nil {
+		return err
+	}
+
+	schedule.Name = req.Name
+	schedule.Expression = req.Expression
+	schedule.GardenSystemID = target
+	schedule.CommandName = definition.Name
+	schedule.Parameters = string(util.Marshal(definition.redact(req.Parameters)))
+	schedule.Command = raw
+	schedule.Enabled = req.Enabled == nil || *req.Enabled
+
+	return scheduler.Prepare(schedule, time.Now())
+}
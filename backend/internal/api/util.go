@@ -3,6 +3,7 @@ package api
 import (
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/ConfusedPolarBear/garden/internal/util"
 
@@ -19,3 +20,27 @@ func getId(w http.ResponseWriter, r *http.Request) (string, error) {
 
 	return id, nil
 }
+
+// Parses the optional from and to query parameters as RFC 3339 timestamps. Defaults to the last 24 hours.
+func getTimeRange(w http.ResponseWriter, r *http.Request) (time.Time, time.Time, error) {
+	var err error
+	query := r.URL.Query()
+
+	to := time.Now()
+	if raw := query.Get("to"); raw != "" {
+		if to, err = time.Parse(time.RFC3339, raw); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return to, to, err
+		}
+	}
+
+	from := to.Add(-24 * time.Hour)
+	if raw := query.Get("from"); raw != "" {
+		if from, err = time.Parse(time.RFC3339, raw); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return from, to, err
+		}
+	}
+
+	return from, to, nil
+}
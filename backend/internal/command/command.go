@@ -0,0 +1,235 @@
+// Package command sends commands to garden systems, encrypting them and routing them through the mesh coordinator as
+// required.
+package command
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/envelope"
+	"github.com/ConfusedPolarBear/garden/internal/fragment"
+	"github.com/ConfusedPolarBear/garden/internal/mqtt"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Identifier used to send a command to every system.
+const Broadcast = "FFFFFFFFFFFF"
+
+// Publishes MQTT messages. Replaced by tests, which have no MQTT broker to publish to.
+var mqttPublish = mqtt.Publish
+
+var sealerLock sync.Mutex
+var sealer *envelope.Sealer
+
+// Returns the sealer used to encrypt commands, creating it from the stored configuration on first use.
+func getSealer() (*envelope.Sealer, error) {
+	sealerLock.Lock()
+	defer sealerLock.Unlock()
+
+	if sealer != nil {
+		return sealer, nil
+	}
+
+	config, err := db.GetConfiguration()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := envelope.NewSealer(config.ChaChaKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealer = s
+
+	return sealer, nil
+}
+
+// Returns the envelope version to encrypt commands for the provided system with. Broadcasts use the oldest version
+// supported by any mesh system so that every system can decrypt them.
+func getEnvelopeVersion(id string) (int, error) {
+	if id != Broadcast {
+		system, err := db.GetSystem(id, false)
+		if err != nil {
+			return 0, err
+		}
+
+		return envelope.Negotiate(system.Announcement.EnvelopeVersion), nil
+	}
+
+	version := envelope.VersionLatest
+	for _, system := range db.GetAllSystems() {
+		if !system.Announcement.IsMesh {
+			continue
+		}
+
+		if v := envelope.Negotiate(system.Announcement.EnvelopeVersion); v < version {
+			version = v
+		}
+	}
+
+	return version, nil
+}
+
+// Returns the identifiers of every system that receives a command sent to the provided system.
+func getCommandTargets(id string) []string {
+	if id != Broadcast {
+		return []string{id}
+	}
+
+	var ids []string
+	for _, system := range db.GetAllSystems() {
+		ids = append(ids, system.Identifier)
+	}
+
+	return ids
+}
+
+// Forgets the cached sealer so that the next command is encrypted with the current mesh key.
+func ResetSealer() {
+	sealerLock.Lock()
+	defer sealerLock.Unlock()
+
+	sealer = nil
+}
+
+// Sends a command to the provided system, or to every system if id is Broadcast. Encrypted commands use the newest
+// envelope version supported by the destination. Every command is recorded in the command log and JSON commands are
+// tagged with the ID of their log entry so that replies can be matched to them. Commands for a system that is offline
+// or asleep are queued and delivered once the system sends its next message.
+func Send(id, command string, encrypt bool) (util.CommandLog, error) {
+	return send(id, command, encrypt, true)
+}
+
+// Sends a command immediately, even if the destination is offline or asleep. Used for commands that are already
+// retried whenever the system announces itself.
+func SendNow(id, command string, encrypt bool) (util.CommandLog, error) {
+	return send(id, command, encrypt, false)
+}
+
+func send(id, command string, encrypt, allowQueue bool) (util.CommandLog, error) {
+	entry := newLogEntry(id, command, encrypt)
+	deadline := entry.Deadline
+
+	queue := allowQueue && shouldQueue(id)
+	if queue {
+		// The command doesn't start waiting for a reply until it's delivered.
+		entry.Deadline = time.Time{}
+	}
+
+	if err := db.CreateCommandLog(&entry); err != nil {
+		return entry, err
+	}
+
+	broadcastStatus(entry)
+
+	if queue {
+		return enqueue(entry, command)
+	}
+
+	return deliver(entry, command, deadline)
+}
+
+// Publishes a logged command and records the result.
+func deliver(entry util.CommandLog, command string, deadline time.Time) (util.CommandLog, error) {
+	id := entry.GardenSystemID
+
+	sequence, err := publish(id, tagCommand(command, entry.ID), entry.Encrypted)
+	if err != nil {
+		logrus.Warnf("[command] unable to send command %d to %s: %s", entry.ID, id, err)
+	}
+
+	if updated, dbErr := db.SetCommandSent(entry.ID, sequence, deadline, err); dbErr != nil {
+		logrus.Errorf("[command] unable to update command %d: %s", entry.ID, dbErr)
+	} else {
+		entry = updated
+		broadcastStatus(entry)
+	}
+
+	return entry, err
+}
+
+// Encrypts and publishes a command, returning the sequence number it was sent with.
+func publish(id, command string, encrypt bool) (uint64, error) {
+	var sequence uint64
+
+	if encrypt {
+		s, err := getSealer()
+		if err != nil {
+			return 0, err
+		}
+
+		version, err := getEnvelopeVersion(id)
+		if err != nil {
+			return 0, err
+		}
+
+		msg := envelope.Message{Version: version, Command: []byte(command)}
+
+		if envelope.HasSequence(version) {
+			if msg.Sequence, err = db.NextCommandSequence(getCommandTargets(id), time.Now()); err != nil {
+				return 0, err
+			}
+
+			sequence = msg.Sequence
+			logrus.Debugf("[server] allocated sequence number %d for command to %s", msg.Sequence, id)
+		}
+
+		command, err = s.Seal(msg)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Get the system
+	isMesh := false
+	if id != Broadcast {
+		// If this is not a broadcast message, lookup the individual system to send the message to
+		system, err := db.GetSystem(id, false)
+		if err != nil {
+			return 0, err
+		}
+
+		isMesh = system.Announcement.IsMesh
+	} else {
+		isMesh = true
+	}
+
+	logrus.Debugf("[server] sending command to %s: %q", id, command)
+
+	mqttDest := id
+	mqttPayload := command
+
+	// If this system is connected over MQTT, send the raw command
+	if isMesh {
+		// Mesh connected systems are controlled by sending a command (MQTT) to the coordinator who will rebroadcast it (ESP-NOW)
+		coordinator, err := db.GetCoordinator()
+		if err != nil {
+			return 0, err
+		}
+
+		mqttDest = coordinator.Identifier
+
+		// Mesh clients don't reassemble fragments, so the command and its destination must fit in a single fragment.
+		meshPayload := "dst-" + id + mqttPayload
+		if len(meshPayload) > fragment.MaxDataSize {
+			return 0, fmt.Errorf("mesh commands cannot exceed %d bytes (got %d)", fragment.MaxDataSize, len(meshPayload))
+		}
+
+		logrus.Debugf("[server] mesh payload will be %d bytes long", len(meshPayload))
+
+		// Construct the mesh payload
+		mqttPayload = fmt.Sprintf(`{"Command":"Publish","Payload":"h%x"}`, meshPayload)
+	}
+
+	logrus.Debugf("[server] commanding \"%s\"", mqttDest)
+	logrus.Debugf("[server] mqtt payload \"%s\"", mqttPayload)
+
+	mqttPublish(fmt.Sprintf("garden/module/%s/cmnd", mqttDest), mqttPayload)
+
+	return sequence, nil
+}
@@ -0,0 +1,139 @@
+package command
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/mqtt"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTagCommand(t *testing.T) {
+	assert.Equal(t, `{"Command":"ping","ID":12}`, tagCommand(`{"Command":"ping"}`, 12))
+	assert.Equal(t, `{"Command":"sleep","ID":1,"Period":5}`, tagCommand(`{"Period":5,"Command":"sleep"}`, 1))
+
+	// Commands that aren't JSON objects can't be tagged.
+	for _, raw := range []string{"restart", `["Command"]`, "null", ""} {
+		assert.Equal(t, raw, tagCommand(raw, 1))
+	}
+}
+
+func TestNewLogEntry(t *testing.T) {
+	replyTimeout, updateTimeout = 30*time.Second, 15*time.Minute
+	defer func() { replyTimeout, updateTimeout = 0, 0 }()
+
+	tests := []struct {
+		command  string
+		id       string
+		name     string
+		reply    string
+		deadline time.Duration
+	}{
+		{command: `{"Command":"Ping"}`, id: "aaaaaaaaaaaa", name: "ping", reply: "ping", deadline: 30 * time.Second},
+		{command: `{"Command":"sleep","Period":60}`, id: "aaaaaaaaaaaa", name: "sleep", reply: "discovery", deadline: 90 * time.Second},
+		{command: `{"Command":"update","U":"/fw82"}`, id: "aaaaaaaaaaaa", name: "update", reply: "ota", deadline: 15*time.Minute + 30*time.Second},
+		{command: `{"Command":"reset"}`, id: "aaaaaaaaaaaa", name: "reset"},
+		{command: `{"Command":"ping"}`, id: Broadcast, name: "ping"},
+		{command: `not json`, id: "aaaaaaaaaaaa"},
+	}
+
+	for _, test := range tests {
+		start := time.Now()
+		entry := newLogEntry(test.id, test.command, true)
+
+		assert.Equal(t, test.name, entry.Name, test.command)
+		assert.Equal(t, test.reply, entry.Reply, test.command)
+		assert.True(t, entry.Encrypted)
+
+		if test.deadline == 0 {
+			assert.True(t, entry.Deadline.IsZero(), test.command)
+		} else {
+			assert.WithinDuration(t, start.Add(test.deadline), entry.Deadline, time.Second, test.command)
+		}
+	}
+}
+
+// Sends an update command to a system and returns its log entry.
+func sendTestUpdate(t *testing.T, id string) util.CommandLog {
+	entry := newLogEntry(id, `{"Command":"update"}`, true)
+	require.NoError(t, db.CreateCommandLog(&entry))
+
+	entry, err := db.SetCommandSent(entry.ID, 0, entry.Deadline, nil)
+	require.NoError(t, err)
+
+	return entry
+}
+
+func TestUpdateReplies(t *testing.T) {
+	db.InitializeTestDatabase(t)
+
+	replyTimeout, updateTimeout = 30*time.Second, 15*time.Minute
+	defer func() { replyTimeout, updateTimeout = 0, 0 }()
+
+	// Starting the download doesn't finish the update, so a later failure is still recorded.
+	failed := sendTestUpdate(t, "aaaaaaaaaaaa")
+	handleReply("aaaaaaaaaaaa", "ota", []byte(`{"Success":true,"Message":"attempting to download update"}`))
+
+	entry, err := db.GetCommandLog(failed.ID)
+	require.NoError(t, err)
+	assert.Equal(t, util.CommandSent, entry.Status)
+
+	handleReply("aaaaaaaaaaaa", "ota", []byte(`{"Success":false,"Message":"checksum mismatch"}`))
+
+	entry, err = db.GetCommandLog(failed.ID)
+	require.NoError(t, err)
+	assert.Equal(t, util.CommandFailed, entry.Status)
+	assert.Equal(t, "checksum mismatch", entry.Message)
+
+	// Updates succeed once the system restarts and announces itself.
+	updated := sendTestUpdate(t, "aaaaaaaaaaaa")
+	handleReply("aaaaaaaaaaaa", "ota", []byte(`{"Success":true,"Message":"attempting to download update"}`))
+	handleReply("aaaaaaaaaaaa", "discovery", []byte(`{"IP":"10.0.0.2"}`))
+
+	entry, err = db.GetCommandLog(updated.ID)
+	require.NoError(t, err)
+	assert.Equal(t, util.CommandAcked, entry.Status)
+
+	entry, err = db.GetCommandLog(failed.ID)
+	require.NoError(t, err)
+	assert.Equal(t, util.CommandFailed, entry.Status)
+}
+
+func TestDiscoveryWhileQueued(t *testing.T) {
+	db.InitializeTestDatabase(t)
+
+	replyTimeout, queueExpiry = 30*time.Second, time.Hour
+	defer func() { replyTimeout, queueExpiry = 0, 0 }()
+
+	var published []string
+	mqttPublish = func(topic, payload string) { published = append(published, topic) }
+	defer func() { mqttPublish = mqtt.Publish }()
+
+	require.NoError(t, db.CreateSystem(util.GardenSystem{Identifier: "aaaaaaaaaaaa"}))
+
+	// The system is offline, so the sleep command waits for it to send a message.
+	entry, err := Send("aaaaaaaaaaaa", `{"Command":"sleep","Period":60}`, false)
+	require.NoError(t, err)
+	assert.Equal(t, util.CommandQueued, entry.Status)
+	assert.Empty(t, published)
+
+	// The announcement that flushes the queue must not answer the command it is about to deliver.
+	handleReply("aaaaaaaaaaaa", "discovery", []byte(`{"IP":"10.0.0.2"}`))
+	flush("aaaaaaaaaaaa")
+
+	entry, err = db.GetCommandLog(entry.ID)
+	require.NoError(t, err)
+	assert.Equal(t, util.CommandSent, entry.Status)
+	assert.Equal(t, []string{"garden/module/aaaaaaaaaaaa/cmnd"}, published)
+	assert.True(t, db.IsSystemAsleep("aaaaaaaaaaaa"))
+
+	// Commands sent while the system is asleep are queued instead of delivered.
+	entry, err = Send("aaaaaaaaaaaa", `{"Command":"ping"}`, false)
+	require.NoError(t, err)
+	assert.Equal(t, util.CommandQueued, entry.Status)
+	assert.Len(t, published, 1)
+}
@@ -0,0 +1,210 @@
+package command
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/config"
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/mqtt"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+	"github.com/ConfusedPolarBear/garden/internal/websocket"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Telemetry topic that each command is answered on. A restarted system announces itself, as does a system that wakes
+// up from sleep. Commands that aren't listed here are never acknowledged unless the system sends an explicit
+// acknowledgement.
+//
+// Systems report on the ota topic when they start downloading an update and again if the update fails. Successful
+// updates restart the system, so an update is only acknowledged when the system announces itself afterwards.
+var replies = map[string]string{
+	"ping":      "ping",
+	"scan":      "networks",
+	"listpeers": "peers",
+	"restart":   "discovery",
+	"sleep":     "discovery",
+	"update":    "ota",
+	"rotate":    "key",
+}
+
+// How long to wait for a reply before a command times out.
+var replyTimeout time.Duration
+
+// How long a system has to download and install an update before the update command times out.
+var updateTimeout time.Duration
+
+// Starts tracking replies to commands and timing out commands that haven't been answered. Must be called before MQTT
+// is setup.
+func Start() {
+	replyTimeout = config.GetDuration("commands.timeout", 30*time.Second)
+	updateTimeout = config.GetDuration("commands.update_timeout", 15*time.Minute)
+
+	queueExpiry = config.GetDuration("commands.queue_expiry", 24*time.Hour)
+
+	// Replies must be handled first so that a system waking up from sleep is no longer considered asleep.
+	mqtt.OnMessage(handleReply)
+	mqtt.OnMessage(flushQueue)
+	mqtt.HandleTelemetry("ack", handleAck)
+
+	go func() {
+		for range time.Tick(time.Second) {
+			expired, err := db.ExpireCommands(time.Now())
+			if err != nil {
+				logrus.Errorf("[command] unable to expire commands: %s", err)
+			}
+
+			for _, entry := range expired {
+				logrus.Warnf("[command] %s did not reply to command %d (%s)", entry.GardenSystemID, entry.ID, entry.Name)
+				broadcastStatus(entry)
+			}
+
+			expired, err = db.ExpireQueuedCommands(time.Now())
+			if err != nil {
+				logrus.Errorf("[command] unable to expire queued commands: %s", err)
+			}
+
+			for _, entry := range expired {
+				logrus.Warnf("[command] %s did not wake up before queued command %d (%s) expired",
+					entry.GardenSystemID, entry.ID, entry.Name)
+				broadcastStatus(entry)
+			}
+		}
+	}()
+}
+
+// Creates the log entry for a command before it is sent.
+func newLogEntry(id, command string, encrypt bool) util.CommandLog {
+	entry := util.CommandLog{GardenSystemID: id, Encrypted: encrypt}
+
+	var parsed struct {
+		Command string
+		Period  int
+	}
+
+	if err := json.Unmarshal([]byte(command), &parsed); err != nil {
+		return entry
+	}
+
+	entry.Name = strings.ToLower(parsed.Command)
+
+	// Replies to broadcasts can't be matched to a single command.
+	reply, ok := replies[entry.Name]
+	if !ok || id == Broadcast || replyTimeout <= 0 {
+		return entry
+	}
+
+	entry.Reply = reply
+	entry.Deadline = time.Now().Add(replyTimeout)
+
+	// Sleeping systems only announce themselves once they wake up.
+	if entry.Name == "sleep" && parsed.Period > 0 {
+		entry.Deadline = entry.Deadline.Add(time.Duration(parsed.Period) * time.Second)
+	}
+
+	if entry.Name == "update" {
+		entry.Deadline = entry.Deadline.Add(updateTimeout)
+	}
+
+	return entry
+}
+
+// Adds the command's log ID to a JSON command. Other commands are returned unchanged.
+func tagCommand(command string, id uint) string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(command), &fields); err != nil || fields == nil {
+		return command
+	}
+
+	fields["ID"] = json.RawMessage(util.Marshal(id))
+
+	tagged, err := json.Marshal(fields)
+	if err != nil {
+		return command
+	}
+
+	return string(tagged)
+}
+
+// Acknowledges the oldest command that is waiting for this reply. Replies that are JSON objects with Success set to
+// false, like failed OTA updates, fail the command. Successful OTA replies only report progress and are ignored.
+func handleReply(id, name string, payload []byte) {
+	var result struct {
+		Success *bool
+		Message string
+	}
+
+	failure := ""
+	if err := json.Unmarshal(payload, &result); err == nil && result.Success != nil && !*result.Success {
+		failure = result.Message
+		if failure == "" {
+			failure = "system reported failure"
+		}
+	}
+
+	if name == "ota" && failure == "" {
+		logrus.Debugf("[command] %s reported update progress: %s", id, result.Message)
+		return
+	}
+
+	// A system that announces itself has restarted into the new firmware, which finishes a pending update.
+	if name == "discovery" {
+		if entry, err := db.AckCommandReply(id, "ota", ""); err == nil {
+			acknowledged(entry)
+		}
+	}
+
+	entry, err := db.AckCommandReply(id, name, failure)
+	if err != nil {
+		return
+	}
+
+	acknowledged(entry)
+}
+
+// Handles explicit acknowledgements published to garden/module/<id>/tele/ack.
+func handleAck(system *util.GardenSystem, payload []byte) {
+	var ack struct {
+		ID       uint
+		Success  bool
+		Message  string
+		Sequence uint64
+	}
+
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		logrus.Warnf("[command] unable to unmarshal acknowledgement from %s: %s", system.Identifier, err)
+		return
+	}
+
+	entry, err := db.AckCommand(system.Identifier, ack.ID, ack.Success, ack.Message)
+	if err != nil {
+		logrus.Warnf("[command] %s acknowledged unknown command %d", system.Identifier, ack.ID)
+		return
+	}
+
+	if ack.Sequence != 0 && ack.Sequence != entry.Sequence {
+		logrus.Warnf("[command] %s acknowledged command %d with sequence %d, expected %d",
+			system.Identifier, ack.ID, ack.Sequence, entry.Sequence)
+	}
+
+	acknowledged(entry)
+}
+
+func acknowledged(entry util.CommandLog) {
+	logrus.Debugf("[command] %s replied to command %d (%s): %s", entry.GardenSystemID, entry.ID, entry.Name, entry.Status)
+
+	// The system decrypted the command, so it must have accepted its sequence number.
+	if entry.Sequence != 0 {
+		if err := db.AcceptCommandSequence(entry.GardenSystemID, entry.Sequence); err != nil {
+			logrus.Warnf("[command] unable to record accepted sequence for %s: %s", entry.GardenSystemID, err)
+		}
+	}
+
+	broadcastStatus(entry)
+}
+
+func broadcastStatus(entry util.CommandLog) {
+	websocket.BroadcastWebsocketMessage("command", entry)
+}
@@ -0,0 +1,116 @@
+package command
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/sirupsen/logrus"
+)
+
+// How long queued commands wait for their system to wake up. Zero disables the queue.
+var queueExpiry time.Duration
+
+// Serializes queue flushes so that commands are delivered in the order they were queued.
+var flushLock sync.Mutex
+
+// Returns true if commands for the provided system should be queued instead of sent immediately.
+func shouldQueue(id string) bool {
+	if queueExpiry <= 0 || id == Broadcast {
+		return false
+	}
+
+	system, err := db.GetSystem(id, false)
+	if err != nil {
+		// Let publishing report the unknown system.
+		return false
+	}
+
+	return !system.Online || db.IsSystemAsleep(id)
+}
+
+// Queues a logged command until its system wakes up.
+func enqueue(entry util.CommandLog, command string) (util.CommandLog, error) {
+	queued := util.QueuedCommand{
+		GardenSystemID: entry.GardenSystemID,
+		CommandLogID:   entry.ID,
+		Name:           entry.Name,
+		Command:        command,
+		Encrypted:      entry.Encrypted,
+		ExpiresAt:      time.Now().Add(queueExpiry),
+	}
+
+	if err := db.QueueCommand(&queued); err != nil {
+		if updated, dbErr := db.SetCommandSent(entry.ID, 0, time.Time{}, err); dbErr == nil {
+			entry = updated
+			broadcastStatus(entry)
+		}
+
+		return entry, err
+	}
+
+	logrus.Debugf("[command] %s is offline or asleep, queued command %d until %s",
+		entry.GardenSystemID, entry.ID, queued.ExpiresAt.Format(time.RFC3339))
+
+	return entry, nil
+}
+
+// Delivers queued commands once a system sends a message. Runs inside the MQTT callback.
+func flushQueue(id, name string, payload []byte) {
+	go flush(id)
+}
+
+// Delivers every queued command for a system in the order they were queued. Flushing stops after a sleep command
+// since the system won't be able to receive anything else until it wakes up again.
+func flush(id string) {
+	flushLock.Lock()
+	defer flushLock.Unlock()
+
+	if db.IsSystemAsleep(id) {
+		return
+	}
+
+	now := time.Now()
+
+	for _, queued := range db.GetQueuedCommands(id) {
+		if now.After(queued.ExpiresAt) {
+			continue
+		}
+
+		// Another flush may have already delivered this command.
+		if err := db.DequeueCommand(queued.ID); err != nil {
+			continue
+		}
+
+		entry, err := db.GetCommandLog(queued.CommandLogID)
+		if err != nil {
+			logrus.Warnf("[command] unable to find log entry for queued command %d: %s", queued.ID, err)
+			continue
+		}
+
+		logrus.Debugf("[command] delivering queued command %d (%s) to %s", entry.ID, entry.Name, id)
+
+		// Replies are only expected from now on.
+		deadline := newLogEntry(id, queued.Command, queued.Encrypted).Deadline
+		deliver(entry, queued.Command, deadline)
+
+		if entry.Name == "sleep" {
+			return
+		}
+	}
+}
+
+// Removes a command from a system's queue without delivering it.
+func RemoveQueued(systemId string, id uint) (util.CommandLog, error) {
+	entry, err := db.DeleteQueuedCommand(systemId, id)
+	if err != nil {
+		return entry, err
+	}
+
+	logrus.Printf("[command] removed queued command %d (%s) for %s", entry.ID, entry.Name, systemId)
+	broadcastStatus(entry)
+
+	return entry, nil
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
@@ -21,3 +23,36 @@ func Load() {
 func GetString(key string) string {
 	return viper.GetString(key)
 }
+
+// Gets the configuration value with the provided key as a duration, or fallback if it is unset or malformed.
+func GetDuration(key string, fallback time.Duration) time.Duration {
+	if !viper.IsSet(key) {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(viper.GetString(key))
+	if err != nil {
+		logrus.Warnf("[app] configuration value %s is not a valid duration, using %s: %s", key, fallback, err)
+		return fallback
+	}
+
+	return d
+}
+
+// Gets the configuration value with the provided key as an integer, or fallback if it is unset.
+func GetInt(key string, fallback int) int {
+	if !viper.IsSet(key) {
+		return fallback
+	}
+
+	return viper.GetInt(key)
+}
+
+// Gets the configuration value with the provided key as a boolean, or fallback if it is unset.
+func GetBool(key string, fallback bool) bool {
+	if !viper.IsSet(key) {
+		return fallback
+	}
+
+	return viper.GetBool(key)
+}
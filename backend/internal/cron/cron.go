@@ -0,0 +1,239 @@
+// Package cron parses standard five field cron expressions and calculates when they next match.
+//
+// Fields are minute (0-59), hour (0-23), day of month (1-31), month (1-12 or JAN-DEC) and day of week (0-7 or
+// SUN-SAT, where both 0 and 7 are Sunday). Each field is a comma separated list of values, ranges (1-5), steps (*/15 or
+// 10-40/10) or *. The macros @yearly, @annually, @monthly, @weekly, @daily, @midnight and @hourly are also supported.
+//
+// As in Vixie cron, if both the day of month and day of week are restricted then a day matches if either field
+// matches.
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidExpression = errors.New("cron expressions must have five fields")
+
+// How far into the future Next searches before giving up on expressions like "0 0 31 2 *" that never match.
+const searchLimit = 5
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+type field struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day of month", min: 1, max: 31}
+
+	monthField = field{name: "month", min: 1, max: 12, names: []string{
+		"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC",
+	}}
+
+	// Sunday is accepted as both 0 and 7.
+	dowField = field{name: "day of week", min: 0, max: 7, names: []string{
+		"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT",
+	}}
+)
+
+// A parsed cron expression. Each field is a bitset of the values that match.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// If the day of month or day of week fields started with *. Used to decide how the day fields are combined.
+	domStar, dowStar bool
+}
+
+// Parses a cron expression.
+func Parse(expression string) (Schedule, error) {
+	var s Schedule
+
+	expression = strings.TrimSpace(expression)
+	if macro, ok := macros[strings.ToLower(expression)]; ok {
+		expression = macro
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return s, ErrInvalidExpression
+	}
+
+	var err error
+	parsers := []struct {
+		field *field
+		dst   *uint64
+	}{
+		{&minuteField, &s.minute},
+		{&hourField, &s.hour},
+		{&domField, &s.dom},
+		{&monthField, &s.month},
+		{&dowField, &s.dow},
+	}
+
+	for i, p := range parsers {
+		if *p.dst, err = p.field.parse(fields[i]); err != nil {
+			return s, err
+		}
+	}
+
+	// Fold Sunday as 7 into Sunday as 0.
+	if s.dow&(1<<7) != 0 {
+		s.dow = (s.dow | 1) &^ (1 << 7)
+	}
+
+	s.domStar = strings.HasPrefix(fields[2], "*")
+	s.dowStar = strings.HasPrefix(fields[4], "*")
+
+	return s, nil
+}
+
+// Parses a comma separated list of values, ranges and steps into a bitset.
+func (f field) parse(raw string) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(raw, ",") {
+		rng, step := part, 1
+
+		if i := strings.Index(part, "/"); i != -1 {
+			rng = part[:i]
+
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s field: %q", f.name, part)
+			}
+		}
+
+		var start, end int
+
+		switch {
+		case rng == "*":
+			start, end = f.min, f.max
+
+		case strings.Contains(rng, "-"):
+			bounds := strings.SplitN(rng, "-", 2)
+
+			var err error
+			if start, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+
+			if end, err = f.value(bounds[1]); err != nil {
+				return 0, err
+			}
+
+			if start > end {
+				return 0, fmt.Errorf("invalid range in %s field: %q", f.name, part)
+			}
+
+		default:
+			var err error
+			if start, err = f.value(rng); err != nil {
+				return 0, err
+			}
+
+			// A single value with a step, like 5/15, runs from that value to the end of the range.
+			end = start
+			if strings.Contains(part, "/") {
+				end = f.max
+			}
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// Parses a single number or name.
+func (f field) value(raw string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(raw, name) {
+			return i + f.min, nil
+		}
+	}
+
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid value in %s field: %q", f.name, raw)
+	}
+
+	return v, nil
+}
+
+// Returns the first time after the provided time that matches the schedule, in the same location. Returns the zero
+// time if the schedule never matches.
+func (s Schedule) Next(after time.Time) time.Time {
+	loc := after.Location()
+
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(searchLimit, 0, 0)
+
+	for t.Before(limit) {
+		if !has(s.month, int(t.Month())) {
+			t = advance(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc))
+			continue
+		}
+
+		if !s.dayMatches(t) {
+			t = advance(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc))
+			continue
+		}
+
+		if !has(s.hour, t.Hour()) {
+			t = advance(t, time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc))
+			continue
+		}
+
+		if !has(s.minute, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+// Returns next, or the following minute if next isn't after t. Local times that are skipped by a daylight saving
+// transition can normalize to a time before the transition, which would otherwise search forever.
+func advance(t, next time.Time) time.Time {
+	if next.After(t) {
+		return next
+	}
+
+	return t.Add(time.Minute)
+}
+
+func (s Schedule) dayMatches(t time.Time) bool {
+	dom := has(s.dom, t.Day())
+	dow := has(s.dow, int(t.Weekday()))
+
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+
+	return dom || dow
+}
+
+func has(bits uint64, v int) bool {
+	return bits&(1<<uint(v)) != 0
+}
@@ -0,0 +1,116 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseErrors(t *testing.T) {
+	invalid := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"* * * FOO *",
+		"@reboot",
+	}
+
+	for _, expression := range invalid {
+		_, err := Parse(expression)
+		assert.Error(t, err, expression)
+	}
+}
+
+func TestNext(t *testing.T) {
+	// Saturday, January 1st 2022.
+	start := time.Date(2022, time.January, 1, 10, 30, 15, 0, time.UTC)
+
+	tests := []struct {
+		expression string
+		expected   []time.Time
+	}{
+		{"* * * * *", []time.Time{
+			time.Date(2022, time.January, 1, 10, 31, 0, 0, time.UTC),
+			time.Date(2022, time.January, 1, 10, 32, 0, 0, time.UTC),
+		}},
+		{"@hourly", []time.Time{
+			time.Date(2022, time.January, 1, 11, 0, 0, 0, time.UTC),
+			time.Date(2022, time.January, 1, 12, 0, 0, 0, time.UTC),
+		}},
+		{"0 22 * * *", []time.Time{
+			time.Date(2022, time.January, 1, 22, 0, 0, 0, time.UTC),
+			time.Date(2022, time.January, 2, 22, 0, 0, 0, time.UTC),
+		}},
+		{"*/20 9-11 * * *", []time.Time{
+			time.Date(2022, time.January, 1, 10, 40, 0, 0, time.UTC),
+			time.Date(2022, time.January, 1, 11, 0, 0, 0, time.UTC),
+			time.Date(2022, time.January, 1, 11, 20, 0, 0, time.UTC),
+			time.Date(2022, time.January, 1, 11, 40, 0, 0, time.UTC),
+			time.Date(2022, time.January, 2, 9, 0, 0, 0, time.UTC),
+		}},
+		{"5/30 * * * *", []time.Time{
+			time.Date(2022, time.January, 1, 10, 35, 0, 0, time.UTC),
+			time.Date(2022, time.January, 1, 11, 5, 0, 0, time.UTC),
+		}},
+		// Sundays, given both as 7 and by name.
+		{"0 3 * * 7", []time.Time{
+			time.Date(2022, time.January, 2, 3, 0, 0, 0, time.UTC),
+			time.Date(2022, time.January, 9, 3, 0, 0, 0, time.UTC),
+		}},
+		{"0 3 * * sun", []time.Time{
+			time.Date(2022, time.January, 2, 3, 0, 0, 0, time.UTC),
+		}},
+		{"0 0 1 jan,jul *", []time.Time{
+			time.Date(2022, time.July, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC),
+		}},
+		// Restricting both day fields matches either of them.
+		{"0 12 15 * MON", []time.Time{
+			time.Date(2022, time.January, 1, 12, 0, 0, 0, time.UTC).AddDate(0, 0, 2),
+			time.Date(2022, time.January, 10, 12, 0, 0, 0, time.UTC),
+			time.Date(2022, time.January, 15, 12, 0, 0, 0, time.UTC),
+			time.Date(2022, time.January, 17, 12, 0, 0, 0, time.UTC),
+		}},
+		{"0 0 29 2 *", []time.Time{
+			time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC),
+		}},
+		{"0 0 31 2 *", []time.Time{{}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			schedule, err := Parse(test.expression)
+			require.NoError(t, err)
+
+			current := start
+			for _, expected := range test.expected {
+				current = schedule.Next(current)
+				assert.Equal(t, expected, current)
+			}
+		})
+	}
+}
+
+func TestNextDaylightSaving(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone database is unavailable")
+	}
+
+	schedule, err := Parse("30 2 * * *")
+	require.NoError(t, err)
+
+	// 2:30 doesn't exist on March 13th 2022, so the next run is the following day.
+	next := schedule.Next(time.Date(2022, time.March, 12, 12, 0, 0, 0, loc))
+	assert.Equal(t, time.Date(2022, time.March, 14, 2, 30, 0, 0, loc), next)
+}
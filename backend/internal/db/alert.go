@@ -0,0 +1,95 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/util"
+)
+
+func GetAlertRules() []util.AlertRule {
+	var rules []util.AlertRule
+	db.Order("id").Find(&rules)
+
+	return rules
+}
+
+// Returns all enabled rules that apply to the provided system, including global rules.
+func GetSystemAlertRules(id string) []util.AlertRule {
+	var rules []util.AlertRule
+
+	db.
+		Where("enabled = ? AND (garden_system_id = ? OR garden_system_id = ?)", true, id, "").
+		Order("id").
+		Find(&rules)
+
+	return rules
+}
+
+func CreateAlertRule(rule *util.AlertRule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+
+	return db.Create(rule).Error
+}
+
+// Deletes a rule and clears every active alert it raised.
+func DeleteAlertRule(id uint) error {
+	res := db.Delete(&util.AlertRule{}, id)
+	if res.Error != nil {
+		return res.Error
+	} else if res.RowsAffected == 0 {
+		return errors.New("rule not found")
+	}
+
+	return db.
+		Model(&util.Alert{}).
+		Where("alert_rule_id = ? AND cleared_at = ?", id, time.Time{}).
+		Update("cleared_at", time.Now()).
+		Error
+}
+
+// Returns the active alert raised by a rule for a system, if any.
+func GetActiveAlert(ruleId uint, systemId string) (util.Alert, bool) {
+	var alerts []util.Alert
+
+	db.
+		Where("alert_rule_id = ? AND garden_system_id = ? AND cleared_at = ?", ruleId, systemId, time.Time{}).
+		Limit(1).
+		Find(&alerts)
+
+	if len(alerts) == 0 {
+		return util.Alert{}, false
+	}
+
+	return alerts[0], true
+}
+
+func CreateAlert(alert *util.Alert) error {
+	return db.Create(alert).Error
+}
+
+func ClearAlert(alert *util.Alert) error {
+	alert.ClearedAt = time.Now()
+	return db.Save(alert).Error
+}
+
+// Returns the most recent alerts, newest first. If system is not empty, only alerts for that system are returned.
+func GetAlerts(system string, activeOnly bool, limit int) []util.Alert {
+	var alerts []util.Alert
+
+	q := db.Order("raised_at DESC").Limit(limit)
+
+	if system != "" {
+		q = q.Where("garden_system_id = ?", system)
+	}
+
+	if activeOnly {
+		q = q.Where("cleared_at = ?", time.Time{})
+	}
+
+	q.Find(&alerts)
+
+	return alerts
+}
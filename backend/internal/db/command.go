@@ -0,0 +1,194 @@
+package db
+
+import (
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"gorm.io/gorm"
+)
+
+// Allocates the sequence number for a command sent to the provided systems. The returned number is greater than any
+// number previously sent to those systems and is at least the current Unix time in milliseconds, so sequence numbers
+// keep increasing even if a system is deleted and rediscovered.
+func NextCommandSequence(ids []string, now time.Time) (uint64, error) {
+	next := uint64(now.UnixMilli())
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var current []util.CommandSequence
+		if err := tx.Where("garden_system_id IN ?", ids).Find(&current).Error; err != nil {
+			return err
+		}
+
+		for _, c := range current {
+			if c.LastSent >= next {
+				next = c.LastSent + 1
+			}
+		}
+
+		for _, id := range ids {
+			res := tx.
+				Model(&util.CommandSequence{}).
+				Where("garden_system_id = ?", id).
+				Update("last_sent", next)
+
+			if res.Error != nil {
+				return res.Error
+			} else if res.RowsAffected > 0 {
+				continue
+			}
+
+			if err := tx.Create(&util.CommandSequence{GardenSystemID: id, LastSent: next}).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return next, err
+}
+
+// Records that a system accepted the command with the provided sequence number. Acknowledgements that are older than
+// the last accepted sequence number are ignored.
+func AcceptCommandSequence(id string, sequence uint64) error {
+	return db.
+		Model(&util.CommandSequence{}).
+		Where("garden_system_id = ? AND last_accepted < ? AND last_sent >= ?", id, sequence, sequence).
+		Update("last_accepted", sequence).
+		Error
+}
+
+func GetCommandSequence(id string) util.CommandSequence {
+	sequence := util.CommandSequence{GardenSystemID: id}
+	db.Where("garden_system_id = ?", id).Limit(1).Find(&sequence)
+
+	return sequence
+}
+
+func CreateCommandLog(entry *util.CommandLog) error {
+	entry.Status = util.CommandQueued
+	return db.Create(entry).Error
+}
+
+func GetCommandLog(id uint) (util.CommandLog, error) {
+	var entry util.CommandLog
+	err := db.First(&entry, id).Error
+
+	return entry, err
+}
+
+// Records the result of publishing a command. A nil error marks the command as sent unless a reply already arrived.
+// The deadline replaces the one the command was logged with since queued commands only start waiting for a reply once
+// they are delivered.
+func SetCommandSent(id uint, sequence uint64, deadline time.Time, sendErr error) (util.CommandLog, error) {
+	updates := map[string]interface{}{
+		"status":   util.CommandSent,
+		"sequence": sequence,
+		"sent_at":  time.Now(),
+		"deadline": deadline,
+	}
+
+	if sendErr != nil {
+		updates["status"] = util.CommandFailed
+		updates["message"] = sendErr.Error()
+	}
+
+	err := db.
+		Model(&util.CommandLog{}).
+		Where("id = ? AND status = ?", id, util.CommandQueued).
+		Updates(updates).
+		Error
+
+	if err != nil {
+		return util.CommandLog{}, err
+	}
+
+	return GetCommandLog(id)
+}
+
+// Acknowledges the oldest command sent to a system that is answered by the provided telemetry topic. Queued commands
+// haven't been delivered yet, so they can't be answered. A non-empty failure marks the command as failed instead.
+// Returns gorm.ErrRecordNotFound if no command matches.
+func AckCommandReply(systemId, reply, failure string) (util.CommandLog, error) {
+	var entry util.CommandLog
+
+	err := db.
+		Where("garden_system_id = ? AND reply = ? AND status = ?", systemId, reply, util.CommandSent).
+		Order("id").
+		First(&entry).
+		Error
+
+	if err != nil {
+		return entry, err
+	}
+
+	return finishCommand(entry, failure == "", failure)
+}
+
+// Acknowledges a command by its ID. The command must have been sent to the provided system.
+func AckCommand(systemId string, id uint, success bool, message string) (util.CommandLog, error) {
+	var entry util.CommandLog
+
+	err := db.
+		Where("id = ? AND garden_system_id = ? AND status = ?", id, systemId, util.CommandSent).
+		First(&entry).
+		Error
+
+	if err != nil {
+		return entry, err
+	}
+
+	return finishCommand(entry, success, message)
+}
+
+// Marks every sent command whose deadline has passed as timed out and returns them. Queued commands expire with their
+// queue entry instead.
+func ExpireCommands(now time.Time) ([]util.CommandLog, error) {
+	var expired []util.CommandLog
+
+	err := db.
+		Where("status = ? AND deadline <> ? AND deadline < ?", util.CommandSent, time.Time{}, now).
+		Find(&expired).
+		Error
+
+	if err != nil || len(expired) == 0 {
+		return nil, err
+	}
+
+	var ids []uint
+	for i := range expired {
+		ids = append(ids, expired[i].ID)
+		expired[i].Status = util.CommandTimeout
+	}
+
+	err = db.
+		Model(&util.CommandLog{}).
+		Where("id IN ? AND status = ?", ids, util.CommandSent).
+		Update("status", util.CommandTimeout).
+		Error
+
+	return expired, err
+}
+
+func finishCommand(entry util.CommandLog, success bool, message string) (util.CommandLog, error) {
+	entry.Status = util.CommandAcked
+	if !success {
+		entry.Status = util.CommandFailed
+	}
+
+	entry.Message = message
+	entry.AckedAt = time.Now()
+
+	err := db.
+		Model(&util.CommandLog{}).
+		Where("id = ?", entry.ID).
+		Updates(map[string]interface{}{
+			"status":   entry.Status,
+			"message":  entry.Message,
+			"acked_at": entry.AckedAt,
+		}).
+		Error
+
+	return entry, err
+}
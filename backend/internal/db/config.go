@@ -1,8 +1,6 @@
 package db
 
 import (
-	"encoding/base64"
-
 	"github.com/ConfusedPolarBear/garden/internal/util"
 	"github.com/sirupsen/logrus"
 )
@@ -17,7 +15,7 @@ func initializeConfig() {
 
 	logrus.Print("[db] first run detected, initializing configuration")
 
-	config.MeshKey = base64.RawStdEncoding.EncodeToString(util.SecureRandom(48))
+	config.MeshKey = util.NewMeshKey()
 
 	UpdateConfiguration(config)
 }
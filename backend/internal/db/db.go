@@ -1,17 +1,16 @@
 package db
 
 import (
-	"encoding/csv"
 	"fmt"
-	"log"
 	"math/rand"
-	"os"
-	"strconv"
 	"time"
 
+	"github.com/ConfusedPolarBear/garden/internal/config"
 	"github.com/ConfusedPolarBear/garden/internal/util"
 
 	"github.com/sirupsen/logrus"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -19,33 +18,114 @@ import (
 var db *gorm.DB
 
 func InitializeDatabase() {
-	var err error
-
 	logrus.Trace("[db] initializing database connection")
 
-	if err := util.Mkdir("data"); err != nil {
-		logrus.Fatalf("[db] unable to create data directory: %s", err)
+	driver := config.GetString("db.driver")
+	dsn := config.GetString("db.dsn")
+
+	if driver == "" || driver == "sqlite" {
+		if err := util.Mkdir("data"); err != nil {
+			logrus.Fatalf("[db] unable to create data directory: %s", err)
+		}
 	}
 
-	// TODO: support other database backends other than sqlite
-	db, err = gorm.Open(sqlite.Open("data/garden.db"), &gorm.Config{})
+	dialector, err := openDialector(driver, dsn)
 	if err != nil {
+		logrus.Fatalf("[db] %s", err)
+	}
+
+	if err := setup(dialector); err != nil {
 		logrus.Fatalf("[db] unable to open database: %s", err)
 	}
+}
 
-	logrus.Debug("[db] connected to database")
+// Returns the gorm dialector for the provided driver. An empty driver defaults to sqlite and an empty sqlite DSN
+// defaults to data/garden.db.
+func openDialector(driver, dsn string) (gorm.Dialector, error) {
+	switch driver {
+	case "", "sqlite":
+		if dsn == "" {
+			dsn = "data/garden.db"
+		}
+
+		return sqlite.Open(dsn), nil
+
+	case "postgres":
+		return postgres.Open(dsn), nil
+
+	case "mysql":
+		return mysql.Open(dsn), nil
+	}
+
+	return nil, fmt.Errorf("unsupported database driver %s", driver)
+}
+
+// Connects to the database and runs all migrations.
+func setup(dialector gorm.Dialector) error {
+	var err error
+
+	db, err = gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		return err
+	}
+
+	logrus.Debugf("[db] connected to %s database", db.Dialector.Name())
 
 	if err := db.AutoMigrate(&util.GardenSystem{}, &util.GardenSystemInfo{}, &util.Reading{}, &util.Sensor{}); err != nil {
-		panic(err)
+		return err
+	}
+
+	if err := db.AutoMigrate(&util.SystemStatusChange{}, &util.MeshStatistics{}); err != nil {
+		return err
+	}
+
+	if err := db.AutoMigrate(&util.NetworkScan{}, &util.ScannedNetwork{}); err != nil {
+		return err
+	}
+
+	if err := db.AutoMigrate(&util.HourlyReading{}, &util.DailyReading{}); err != nil {
+		return err
+	}
+
+	if err := db.AutoMigrate(&util.AlertRule{}, &util.Alert{}); err != nil {
+		return err
+	}
+
+	if err := db.AutoMigrate(&util.CommandSequence{}, &util.CommandLog{}, &util.QueuedCommand{}); err != nil {
+		return err
+	}
+
+	if err := db.AutoMigrate(&util.KeyRotation{}, &util.KeyRotationProgress{}); err != nil {
+		return err
+	}
+
+	if err := db.AutoMigrate(&util.Schedule{}, &util.ScheduleRun{}); err != nil {
+		return err
+	}
+
+	if err := db.AutoMigrate(&util.SystemTag{}, &util.Rollout{}, &util.RolloutSystem{}); err != nil {
+		return err
+	}
+
+	if err := db.AutoMigrate(&util.FirmwareBuild{}, &util.ProvisioningLink{}); err != nil {
+		return err
 	}
 
 	if err := db.AutoMigrate(&util.Configuration{}); err != nil {
-		panic(err)
+		return err
 	} else {
 		initializeConfig()
 	}
 
+	if err := db.AutoMigrate(&util.User{}, &util.Token{}); err != nil {
+		return err
+	} else {
+		initializeUsers()
+	}
+
 	logrus.Debug("[db] migrations completed successfully")
+
+	return nil
 }
 
 func CreateReading(reading util.Reading) error {
@@ -60,6 +140,14 @@ func CreateSystem(system util.GardenSystem) error {
 	// Ideally, this would be done with one call to Delete() and it would delete all dependent data.
 	// However, that doesn't work since the data for sensors and system info is left dangling in the database.
 	err := db.Transaction(func(tx *gorm.DB) error {
+		// The online state is maintained by the offline monitor, so an existing system keeps it.
+		var previous []util.GardenSystem
+		if err := tx.Where("identifier = ?", system.Identifier).Limit(1).Find(&previous).Error; err != nil {
+			return err
+		} else if len(previous) > 0 {
+			system.Online, system.LastSeen = previous[0].Online, previous[0].LastSeen
+		}
+
 		// Delete the old system info and abort on error.
 		if err := tx.Delete(&util.GardenSystemInfo{}, "garden_system_id = ?", system.Identifier).Error; err != nil {
 			return err
@@ -126,28 +214,99 @@ func GetAllSystems() []util.GardenSystem {
 
 func GetCoordinator() (util.GardenSystem, error) {
 	// Coordinators are systems that report a channel and are not connected through the mesh.
-	var id string
+	var ids []string
 
 	db.
-		Raw("SELECT garden_system_id FROM garden_system_infos WHERE is_mesh = false AND channel >= 1 LIMIT 1").
-		Scan(&id)
+		Model(&util.GardenSystemInfo{}).
+		Where("is_mesh = ? AND channel >= ?", false, 1).
+		Limit(1).
+		Pluck("garden_system_id", &ids)
+
+	if len(ids) == 0 {
+		return util.GardenSystem{}, gorm.ErrRecordNotFound
+	}
 
-	return GetSystem(id, false)
+	return GetSystem(ids[0], false)
 }
 
+// Saves a system. The online state is maintained by MarkSystemSeen and MarkSystemOffline, so it's never written here.
 func UpdateSystem(system util.GardenSystem) error {
-	return db.Save(&system).Error
+	return db.Omit("online").Save(&system).Error
 }
 
 func DeleteSystem(id string) error {
-	// TODO: switch to using gorm's deletion methods instead calls to exec
-	err := db.
-		Exec(`DELETE FROM readings WHERE garden_system_id = ?`, id).
-		Exec(`DELETE FROM sensors WHERE garden_system_info_id = ?`, id).
-		Exec(`DELETE FROM garden_system_infos WHERE garden_system_id = ?`, id).
-		Exec(`DELETE FROM garden_systems WHERE identifier = ?`, id).Error
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("garden_system_id = ?", id).Delete(&util.Reading{}).Error; err != nil {
+			return err
+		}
 
-	return err
+		if err := deleteNetworkScans(tx, id); err != nil {
+			return err
+		}
+
+		if err := tx.Where("garden_system_id = ?", id).Delete(&util.MeshStatistics{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("garden_system_id = ?", id).Delete(&util.SystemStatusChange{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("garden_system_id = ?", id).Delete(&util.Alert{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("garden_system_id = ?", id).Delete(&util.AlertRule{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("garden_system_id = ?", id).Delete(&util.HourlyReading{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("garden_system_id = ?", id).Delete(&util.DailyReading{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("garden_system_id = ?", id).Delete(&util.CommandLog{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("garden_system_id = ?", id).Delete(&util.QueuedCommand{}).Error; err != nil {
+			return err
+		}
+
+		if err := deleteSchedules(tx, id); err != nil {
+			return err
+		}
+
+		if err := tx.Where("garden_system_id = ?", id).Delete(&util.SystemTag{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("garden_system_id = ?", id).Delete(&util.RolloutSystem{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("garden_system_id = ?", id).Delete(&util.KeyRotationProgress{}).Error; err != nil {
+			return err
+		}
+
+		// New sequence numbers are based on the current time, so rediscovered systems still reject old commands.
+		if err := tx.Where("garden_system_id = ?", id).Delete(&util.CommandSequence{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("garden_system_info_id = ?", id).Delete(&util.Sensor{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("garden_system_id = ?", id).Delete(&util.GardenSystemInfo{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("identifier = ?", id).Delete(&util.GardenSystem{}).Error
+	})
 }
 
 // Loads the latest reading for this system. This is done to avoid preloading the entire slice of Readings as that would
@@ -162,49 +321,6 @@ func loadLatestReading(system *util.GardenSystem) {
 		Find(&system.LastReading)
 }
 
-func ArchiveOldReadings() {
-	ticker := time.NewTicker(time.Hour * 24 * 7) // Can test this with smaller values like time.Second * 5
-
-	go func() {
-		for {
-			t := <-ticker.C
-			fmt.Println("Tick at", t)
-			var readings []util.Reading
-			db.Find(&readings)
-			file, _ := os.Create(strconv.Itoa(t.Day()) + "-" + t.Month().String() + ".csv")
-			writer := csv.NewWriter(file)
-
-			var data = [][]string{{"GardenSystemID", "Temperature", "Humidity", "CreatedAt"}}
-			for _, value := range data {
-				err := writer.Write(value)
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
-
-			for _, reading := range readings {
-				var data = [][]string{{
-					reading.GardenSystemID,
-					fmt.Sprintf("%f", reading.Temperature),
-					fmt.Sprintf("%f", reading.Humidity),
-					reading.CreatedAt.String(),
-				}}
-				for _, value := range data {
-					err := writer.Write(value)
-					if err != nil {
-						log.Fatal(err)
-					}
-				}
-				fmt.Println(reading.GardenSystemID, reading.Temperature, reading.Humidity, reading.CreatedAt)
-			}
-
-			writer.Flush()
-			file.Close()
-			db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&util.Reading{}) // This deletes all the readings
-		}
-	}()
-}
-
 func PopulateTestData() {
 	for i := 0; i < 10; i++ {
 		t := rand.Float32() * 100
@@ -0,0 +1,836 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// Returns every database backend that the test suite should be run against. PostgreSQL and MySQL are only tested
+// when a DSN is provided through the GARDEN_TEST_POSTGRES and GARDEN_TEST_MYSQL environment variables.
+func testBackends(t *testing.T) map[string]gorm.Dialector {
+	backends := map[string]gorm.Dialector{
+		"sqlite": sqlite.Open(path.Join(t.TempDir(), "garden.db")),
+
+		// Shared cache is required as every connection in the pool would otherwise get its own empty database.
+		"memory": sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())),
+	}
+
+	if dsn := os.Getenv("GARDEN_TEST_POSTGRES"); dsn != "" {
+		backends["postgres"] = postgres.Open(dsn)
+	}
+
+	if dsn := os.Getenv("GARDEN_TEST_MYSQL"); dsn != "" {
+		backends["mysql"] = mysql.Open(dsn)
+	}
+
+	return backends
+}
+
+// Runs the test function once against every available backend.
+func runSuite(t *testing.T, test func(t *testing.T)) {
+	for name, dialector := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, setup(dialector))
+
+			// Remove anything left over from a previous run against a persistent server.
+			for _, id := range []string{"aaaaaaaaaaaa", "bbbbbbbbbbbb"} {
+				require.NoError(t, DeleteSystem(id))
+			}
+
+			test(t)
+		})
+	}
+}
+
+func createTestSystem(t *testing.T, id string, coordinator bool) {
+	system := util.GardenSystem{
+		Identifier: id,
+		UpdatedAt:  time.Now(),
+		Announcement: util.GardenSystemInfo{
+			IsMesh:  !coordinator,
+			Channel: 6,
+			Chipset: "ESP32",
+			Sensors: []util.Sensor{{Name: "temperature"}, {Name: "humidity"}},
+		},
+	}
+
+	require.NoError(t, CreateSystem(system))
+}
+
+func TestSystems(t *testing.T) {
+	runSuite(t, func(t *testing.T) {
+		createTestSystem(t, "aaaaaaaaaaaa", true)
+		createTestSystem(t, "bbbbbbbbbbbb", false)
+
+		// Re-announcing a system must replace it instead of duplicating its sensors.
+		createTestSystem(t, "bbbbbbbbbbbb", false)
+
+		system, err := GetSystem("bbbbbbbbbbbb", false)
+		require.NoError(t, err)
+		assert.Equal(t, "ESP32", system.Announcement.Chipset)
+		assert.Len(t, system.Announcement.Sensors, 2)
+
+		coordinator, err := GetCoordinator()
+		require.NoError(t, err)
+		assert.Equal(t, "aaaaaaaaaaaa", coordinator.Identifier)
+
+		require.NoError(t, DeleteSystem("aaaaaaaaaaaa"))
+
+		_, err = GetSystem("aaaaaaaaaaaa", false)
+		assert.Error(t, err)
+
+		_, err = GetCoordinator()
+		assert.Error(t, err)
+	})
+}
+
+func TestReadings(t *testing.T) {
+	runSuite(t, func(t *testing.T) {
+		createTestSystem(t, "bbbbbbbbbbbb", false)
+
+		base := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour)
+		for i, temperature := range []float32{10, 20, 30, 99} {
+			reading := util.Reading{
+				CreatedAt:      base.Add(time.Duration(i) * time.Minute),
+				GardenSystemID: "bbbbbbbbbbbb",
+				Error:          temperature == 99,
+				Temperature:    temperature,
+				Humidity:       50,
+			}
+
+			require.NoError(t, db.Create(&reading).Error)
+		}
+
+		buckets, err := GetReadings("bbbbbbbbbbbb", base, base.Add(time.Hour), time.Hour, AggregateAverage)
+		require.NoError(t, err)
+		require.Len(t, buckets, 1)
+		assert.Equal(t, 3, buckets[0].Count)
+		assert.Equal(t, float32(20), buckets[0].Temperature)
+
+		system, err := GetSystem("bbbbbbbbbbbb", true)
+		require.NoError(t, err)
+		assert.Len(t, system.Readings, 4)
+		assert.Equal(t, float32(99), system.LastReading.Temperature)
+
+		require.NoError(t, DeleteSystem("bbbbbbbbbbbb"))
+
+		buckets, err = GetReadings("bbbbbbbbbbbb", base, base.Add(time.Hour), time.Hour, AggregateAverage)
+		require.NoError(t, err)
+		assert.Empty(t, buckets)
+	})
+}
+
+func TestUsers(t *testing.T) {
+	runSuite(t, func(t *testing.T) {
+		name := fmt.Sprintf("user%d", time.Now().UnixNano())
+
+		user, err := CreateUser(name, "hunter2hunter2", util.RoleViewer)
+		require.NoError(t, err)
+		defer DeleteUser(user.ID)
+
+		_, err = AuthenticateUser(name, "wrong password")
+		assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+		_, err = AuthenticateUser(name, "hunter2hunter2")
+		assert.NoError(t, err)
+
+		raw, _, err := CreateToken(user.ID, "test", time.Hour)
+		require.NoError(t, err)
+
+		owner, _, err := GetTokenUser(raw)
+		require.NoError(t, err)
+		assert.Equal(t, user.ID, owner.ID)
+
+		require.NoError(t, SetUserRole(user.ID, util.RoleOperator))
+		owner, _, _ = GetTokenUser(raw)
+		assert.Equal(t, util.RoleOperator, owner.Role)
+
+		_, _, err = GetTokenUser("not a token")
+		assert.Error(t, err)
+	})
+}
+
+func TestRetention(t *testing.T) {
+	runSuite(t, func(t *testing.T) {
+		createTestSystem(t, "bbbbbbbbbbbb", false)
+
+		now := time.Now()
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		old := today.AddDate(0, 0, -40).Add(6 * time.Hour)
+
+		for i, temperature := range []float32{10, 20, 30} {
+			reading := util.Reading{
+				CreatedAt:      old.Add(time.Duration(i) * 20 * time.Minute),
+				GardenSystemID: "bbbbbbbbbbbb",
+				Temperature:    temperature,
+				Humidity:       float32(i),
+			}
+
+			require.NoError(t, db.Create(&reading).Error)
+		}
+
+		recent := util.Reading{CreatedAt: now.Add(-time.Hour), GardenSystemID: "bbbbbbbbbbbb", Temperature: 15}
+		require.NoError(t, db.Create(&recent).Error)
+
+		policy := RetentionPolicy{RawDays: 30, Archive: true, ArchiveDirectory: t.TempDir()}
+		require.NoError(t, RunRetention(policy, now))
+
+		var remaining int64
+		db.Model(&util.Reading{}).Where("garden_system_id = ?", "bbbbbbbbbbbb").Count(&remaining)
+		assert.Equal(t, int64(1), remaining)
+
+		var daily []util.DailyReading
+		db.Where("garden_system_id = ?", "bbbbbbbbbbbb").Find(&daily)
+		require.Len(t, daily, 1)
+		assert.Equal(t, 3, daily[0].Count)
+		assert.Equal(t, float32(20), daily[0].AvgTemperature)
+		assert.Equal(t, float32(30), daily[0].MaxTemperature)
+
+		archives, err := os.ReadDir(policy.ArchiveDirectory)
+		require.NoError(t, err)
+		assert.Len(t, archives, 1)
+
+		// Rolled up readings must still be returned by range queries.
+		buckets, err := GetReadings("bbbbbbbbbbbb", old.Add(-time.Hour), now, 24*time.Hour, AggregateMinimum)
+		require.NoError(t, err)
+		require.Len(t, buckets, 2)
+		assert.Equal(t, float32(10), buckets[0].Temperature)
+		assert.Equal(t, 3, buckets[0].Count)
+
+		// Running the policy again must be a no-op.
+		require.NoError(t, RunRetention(policy, now))
+		db.Where("garden_system_id = ?", "bbbbbbbbbbbb").Find(&daily)
+		assert.Equal(t, 3, daily[0].Count)
+
+		require.NoError(t, DeleteSystem("bbbbbbbbbbbb"))
+	})
+}
+
+func TestRetentionAverage(t *testing.T) {
+	runSuite(t, func(t *testing.T) {
+		createTestSystem(t, "bbbbbbbbbbbb", false)
+
+		now := time.Now()
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		old := today.AddDate(0, 0, -40).Add(6 * time.Hour)
+
+		// One reading late on the previous day and three on the morning of the next.
+		readings := map[time.Time]float32{
+			old.Add(-8 * time.Hour):   40,
+			old:                       10,
+			old.Add(20 * time.Minute): 20,
+			old.Add(40 * time.Minute): 30,
+		}
+
+		for created, temperature := range readings {
+			reading := util.Reading{CreatedAt: created, GardenSystemID: "bbbbbbbbbbbb", Temperature: temperature}
+			require.NoError(t, db.Create(&reading).Error)
+		}
+
+		// Returns the number of readings and their average temperature in a span that crosses a day boundary.
+		average := func() (int, float32) {
+			buckets, err := GetReadings("bbbbbbbbbbbb", old.AddDate(0, 0, -2), today.AddDate(0, 0, -30), 24*time.Hour,
+				AggregateAverage)
+			require.NoError(t, err)
+
+			count, sum := 0, float32(0)
+			for _, b := range buckets {
+				count += b.Count
+				sum += b.Temperature * float32(b.Count)
+			}
+
+			return count, sum / float32(count)
+		}
+
+		// Every hourly rollup is still available.
+		require.NoError(t, RunRetention(RetentionPolicy{RawDays: 30}, now))
+
+		count, avg := average()
+		assert.Equal(t, 4, count)
+		assert.Equal(t, float32(25), avg)
+
+		// The previous day is only available as a daily rollup once its hourly rollups are pruned.
+		require.NoError(t, RunRetention(RetentionPolicy{RawDays: 30, HourlyDays: 40}, now))
+
+		var hourly int64
+		db.Model(&util.HourlyReading{}).Where("garden_system_id = ?", "bbbbbbbbbbbb").Count(&hourly)
+		require.Equal(t, int64(1), hourly)
+
+		count, avg = average()
+		assert.Equal(t, 4, count)
+		assert.Equal(t, float32(25), avg)
+
+		require.NoError(t, DeleteSystem("bbbbbbbbbbbb"))
+	})
+}
+
+func TestStatus(t *testing.T) {
+	runSuite(t, func(t *testing.T) {
+		createTestSystem(t, "bbbbbbbbbbbb", false)
+
+		db.Model(&util.GardenSystem{}).Where("identifier = ?", "bbbbbbbbbbbb").Updates(map[string]interface{}{
+			"online":    true,
+			"last_seen": time.Now().Add(-time.Hour),
+		})
+
+		assert.Empty(t, GetStaleSystems(time.Now().Add(-2*time.Hour)))
+		assert.Equal(t, []string{"bbbbbbbbbbbb"}, GetStaleSystems(time.Now().Add(-time.Minute)))
+
+		// Systems that were seen after they were found to be stale stay online.
+		_, err := MarkSystemOffline("bbbbbbbbbbbb", time.Now().Add(-2*time.Hour))
+		assert.ErrorIs(t, err, ErrStatusUnchanged)
+
+		_, err = MarkSystemOffline("bbbbbbbbbbbb", time.Now().Add(-time.Minute))
+		require.NoError(t, err)
+		assert.Empty(t, GetStaleSystems(time.Now()))
+
+		_, err = MarkSystemOffline("bbbbbbbbbbbb", time.Now())
+		assert.ErrorIs(t, err, ErrStatusUnchanged)
+
+		// Saving a system that was loaded while it was online must not bring it back online.
+		system, err := GetSystem("bbbbbbbbbbbb", false)
+		require.NoError(t, err)
+		system.Online = true
+		require.NoError(t, UpdateSystem(system))
+
+		system, err = GetSystem("bbbbbbbbbbbb", false)
+		require.NoError(t, err)
+		assert.False(t, system.Online)
+
+		now := time.Now()
+		_, err = MarkSystemSeen("bbbbbbbbbbbb", now)
+		require.NoError(t, err)
+
+		_, err = MarkSystemSeen("bbbbbbbbbbbb", now)
+		assert.ErrorIs(t, err, ErrStatusUnchanged)
+
+		// Re-announcing keeps the online state.
+		createTestSystem(t, "bbbbbbbbbbbb", false)
+		system, err = GetSystem("bbbbbbbbbbbb", false)
+		require.NoError(t, err)
+		assert.True(t, system.Online)
+		assert.WithinDuration(t, now, system.LastSeen, time.Second)
+
+		history := GetStatusHistory("bbbbbbbbbbbb", 10)
+		require.Len(t, history, 2)
+		assert.True(t, history[0].Online)
+		assert.False(t, history[1].Online)
+
+		require.NoError(t, DeleteSystem("bbbbbbbbbbbb"))
+		assert.Empty(t, GetStatusHistory("bbbbbbbbbbbb", 10))
+	})
+}
+
+func TestNetworkScans(t *testing.T) {
+	runSuite(t, func(t *testing.T) {
+		createTestSystem(t, "bbbbbbbbbbbb", false)
+
+		for i := 0; i < 2; i++ {
+			scan := util.NetworkScan{
+				GardenSystemID: "bbbbbbbbbbbb",
+				CreatedAt:      time.Now().Add(time.Duration(i) * time.Minute),
+				Networks: []util.ScannedNetwork{
+					{MAC: "84:cc:a8:00:00:01", RSSI: -80},
+					{MAC: "84:cc:a8:00:00:02", RSSI: -40 - i, Known: true},
+				},
+			}
+
+			require.NoError(t, CreateNetworkScan(&scan))
+		}
+
+		scans := GetNetworkScans("bbbbbbbbbbbb", 10)
+		require.Len(t, scans, 2)
+		require.Len(t, scans[0].Networks, 2)
+		assert.Equal(t, -41, scans[0].Networks[0].RSSI)
+		assert.True(t, scans[0].Networks[0].Known)
+
+		require.NoError(t, DeleteSystem("bbbbbbbbbbbb"))
+		assert.Empty(t, GetNetworkScans("bbbbbbbbbbbb", 10))
+
+		var orphans int64
+		db.Model(&util.ScannedNetwork{}).Count(&orphans)
+		assert.Zero(t, orphans)
+	})
+}
+
+func TestCommandSequence(t *testing.T) {
+	runSuite(t, func(t *testing.T) {
+		now := time.Now()
+		start := uint64(now.UnixMilli())
+
+		first, err := NextCommandSequence([]string{"aaaaaaaaaaaa"}, now)
+		require.NoError(t, err)
+		assert.Equal(t, start, first)
+
+		// Sequence numbers must increase even if the clock doesn't.
+		second, err := NextCommandSequence([]string{"aaaaaaaaaaaa"}, now)
+		require.NoError(t, err)
+		assert.Equal(t, start+1, second)
+
+		// Broadcasts must be newer than anything sent to any of their targets.
+		broadcast, err := NextCommandSequence([]string{"aaaaaaaaaaaa", "bbbbbbbbbbbb"}, now.Add(-time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, start+2, broadcast)
+		assert.Equal(t, broadcast, GetCommandSequence("bbbbbbbbbbbb").LastSent)
+
+		require.NoError(t, AcceptCommandSequence("aaaaaaaaaaaa", second))
+		assert.Equal(t, second, GetCommandSequence("aaaaaaaaaaaa").LastAccepted)
+
+		// Stale acknowledgements and acknowledgements of commands that were never sent are ignored.
+		require.NoError(t, AcceptCommandSequence("aaaaaaaaaaaa", first))
+		require.NoError(t, AcceptCommandSequence("aaaaaaaaaaaa", broadcast+1))
+		assert.Equal(t, second, GetCommandSequence("aaaaaaaaaaaa").LastAccepted)
+
+		require.NoError(t, DeleteSystem("aaaaaaaaaaaa"))
+		assert.Zero(t, GetCommandSequence("aaaaaaaaaaaa").LastSent)
+	})
+}
+
+func TestKeyRotation(t *testing.T) {
+	runSuite(t, func(t *testing.T) {
+		if active, err := GetActiveKeyRotation(); err == nil {
+			require.NoError(t, CancelKeyRotation(active.ID))
+		}
+
+		before, err := GetConfiguration()
+		require.NoError(t, err)
+
+		key := util.NewMeshKey()
+		rotation, err := StartKeyRotation(key, []string{"aaaaaaaaaaaa", "bbbbbbbbbbbb"})
+		require.NoError(t, err)
+
+		_, err = StartKeyRotation(util.NewMeshKey(), []string{"aaaaaaaaaaaa"})
+		assert.ErrorIs(t, err, ErrRotationInProgress)
+
+		config, err := GetConfiguration()
+		require.NoError(t, err)
+		assert.Equal(t, before.MeshKey, config.MeshKey)
+		assert.Equal(t, key, config.PendingMeshKey)
+
+		require.NoError(t, SetKeyRotationSent(rotation.ID, "aaaaaaaaaaaa", nil))
+		require.NoError(t, SetKeyRotationSent(rotation.ID, "bbbbbbbbbbbb", errors.New("offline")))
+
+		active, err := GetActiveKeyRotation()
+		require.NoError(t, err)
+		require.Len(t, active.Systems, 2)
+		assert.Equal(t, util.RotationSent, active.Systems[0].Status)
+		assert.Equal(t, util.RotationFailed, active.Systems[1].Status)
+		assert.Equal(t, "offline", active.Systems[1].Error)
+
+		remaining, err := AcknowledgeKeyRotation(rotation.ID, "aaaaaaaaaaaa")
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), remaining)
+
+		// Resending the key must not undo an acknowledgement.
+		require.NoError(t, SetKeyRotationSent(rotation.ID, "aaaaaaaaaaaa", nil))
+
+		remaining, err = AcknowledgeKeyRotation(rotation.ID, "bbbbbbbbbbbb")
+		require.NoError(t, err)
+		assert.Zero(t, remaining)
+
+		require.NoError(t, CompleteKeyRotation(rotation.ID))
+
+		config, err = GetConfiguration()
+		require.NoError(t, err)
+		assert.Equal(t, key, config.MeshKey)
+		assert.Empty(t, config.PendingMeshKey)
+
+		_, err = GetActiveKeyRotation()
+		assert.Error(t, err)
+
+		latest := GetKeyRotations(1)
+		require.Len(t, latest, 1)
+		assert.False(t, latest[0].Active())
+		assert.Equal(t, util.RotationAcknowledged, latest[0].Systems[0].Status)
+		assert.Equal(t, 1, latest[0].Systems[0].Attempts)
+	})
+}
+
+func TestCommandLog(t *testing.T) {
+	runSuite(t, func(t *testing.T) {
+		now := time.Now()
+
+		ping := util.CommandLog{GardenSystemID: "aaaaaaaaaaaa", Name: "ping", Reply: "ping", Deadline: now.Add(time.Minute)}
+		require.NoError(t, CreateCommandLog(&ping))
+		assert.Equal(t, util.CommandQueued, ping.Status)
+
+		ping, err := SetCommandSent(ping.ID, 5, ping.Deadline, nil)
+		require.NoError(t, err)
+		assert.Equal(t, util.CommandSent, ping.Status)
+		assert.Equal(t, uint64(5), ping.Sequence)
+
+		update := util.CommandLog{GardenSystemID: "aaaaaaaaaaaa", Name: "update", Reply: "ota", Deadline: now.Add(time.Minute)}
+		require.NoError(t, CreateCommandLog(&update))
+		_, err = SetCommandSent(update.ID, 0, update.Deadline, nil)
+		require.NoError(t, err)
+
+		failed := util.CommandLog{GardenSystemID: "aaaaaaaaaaaa", Name: "restart", Reply: "discovery"}
+		require.NoError(t, CreateCommandLog(&failed))
+		failed, err = SetCommandSent(failed.ID, 0, time.Time{}, errors.New("no coordinator"))
+		require.NoError(t, err)
+		assert.Equal(t, util.CommandFailed, failed.Status)
+		assert.Equal(t, "no coordinator", failed.Message)
+
+		// Queued commands haven't been delivered, so they can't be answered or time out.
+		queued := util.CommandLog{GardenSystemID: "aaaaaaaaaaaa", Name: "sleep", Reply: "discovery", Deadline: now}
+		require.NoError(t, CreateCommandLog(&queued))
+
+		// Replies must only match commands that are still waiting for them.
+		_, err = AckCommandReply("aaaaaaaaaaaa", "discovery", "")
+		assert.Error(t, err)
+
+		acked, err := AckCommandReply("aaaaaaaaaaaa", "ping", "")
+		require.NoError(t, err)
+		assert.Equal(t, ping.ID, acked.ID)
+		assert.Equal(t, util.CommandAcked, acked.Status)
+
+		_, err = AckCommandReply("aaaaaaaaaaaa", "ping", "")
+		assert.Error(t, err)
+
+		// Acknowledgements can't be sent on behalf of another system.
+		_, err = AckCommand("bbbbbbbbbbbb", update.ID, true, "")
+		assert.Error(t, err)
+
+		expired, err := ExpireCommands(now.Add(2 * time.Minute))
+		require.NoError(t, err)
+		require.Len(t, expired, 1)
+		assert.Equal(t, update.ID, expired[0].ID)
+
+		entry, err := GetCommandLog(update.ID)
+		require.NoError(t, err)
+		assert.Equal(t, util.CommandTimeout, entry.Status)
+		assert.True(t, entry.Finished())
+
+		entry, err = GetCommandLog(queued.ID)
+		require.NoError(t, err)
+		assert.Equal(t, util.CommandQueued, entry.Status)
+
+		require.NoError(t, DeleteSystem("aaaaaaaaaaaa"))
+		_, err = GetCommandLog(update.ID)
+		assert.Error(t, err)
+	})
+}
+
+func TestCommandQueue(t *testing.T) {
+	runSuite(t, func(t *testing.T) {
+		now := time.Now()
+
+		queue := func(name string, expires time.Time) util.QueuedCommand {
+			entry := util.CommandLog{GardenSystemID: "aaaaaaaaaaaa", Name: name, Encrypted: true}
+			require.NoError(t, CreateCommandLog(&entry))
+
+			queued := util.QueuedCommand{
+				GardenSystemID: "aaaaaaaaaaaa",
+				CommandLogID:   entry.ID,
+				Name:           name,
+				Command:        `{"Command":"` + name + `"}`,
+				Encrypted:      true,
+				ExpiresAt:      expires,
+			}
+
+			require.NoError(t, QueueCommand(&queued))
+			return queued
+		}
+
+		ping := queue("ping", now.Add(time.Hour))
+		restart := queue("restart", now.Add(time.Minute))
+		scan := queue("scan", now.Add(time.Hour))
+
+		queued := GetQueuedCommands("aaaaaaaaaaaa")
+		require.Len(t, queued, 3)
+		assert.Equal(t, ping.ID, queued[0].ID)
+		assert.Equal(t, `{"Command":"ping"}`, queued[0].Command)
+		assert.Empty(t, GetQueuedCommands("bbbbbbbbbbbb"))
+
+		// Commands can only be delivered once.
+		require.NoError(t, DequeueCommand(ping.ID))
+		assert.ErrorIs(t, DequeueCommand(ping.ID), gorm.ErrRecordNotFound)
+
+		_, err := SetQueuedCommandExpiry("aaaaaaaaaaaa", scan.ID, now.Add(-time.Minute))
+		assert.Error(t, err)
+		_, err = SetQueuedCommandExpiry("bbbbbbbbbbbb", scan.ID, now.Add(time.Hour))
+		assert.Error(t, err)
+
+		extended, err := SetQueuedCommandExpiry("aaaaaaaaaaaa", scan.ID, now.Add(2*time.Hour))
+		require.NoError(t, err)
+		assert.WithinDuration(t, now.Add(2*time.Hour), extended.ExpiresAt, time.Second)
+
+		expired, err := ExpireQueuedCommands(now.Add(90 * time.Minute))
+		require.NoError(t, err)
+		require.Len(t, expired, 1)
+		assert.Equal(t, restart.CommandLogID, expired[0].ID)
+		assert.Equal(t, util.CommandTimeout, expired[0].Status)
+
+		removed, err := DeleteQueuedCommand("aaaaaaaaaaaa", scan.ID)
+		require.NoError(t, err)
+		assert.Equal(t, scan.CommandLogID, removed.ID)
+		assert.Equal(t, util.CommandFailed, removed.Status)
+		assert.Empty(t, GetQueuedCommands("aaaaaaaaaaaa"))
+
+		// A system is asleep until it replies to a sleep command.
+		assert.False(t, IsSystemAsleep("aaaaaaaaaaaa"))
+
+		sleep := util.CommandLog{GardenSystemID: "aaaaaaaaaaaa", Name: "sleep", Reply: "discovery"}
+		require.NoError(t, CreateCommandLog(&sleep))
+		_, err = SetCommandSent(sleep.ID, 0, now.Add(time.Hour), nil)
+		require.NoError(t, err)
+		assert.True(t, IsSystemAsleep("aaaaaaaaaaaa"))
+
+		_, err = AckCommandReply("aaaaaaaaaaaa", "discovery", "")
+		require.NoError(t, err)
+		assert.False(t, IsSystemAsleep("aaaaaaaaaaaa"))
+
+		queue("ping", now.Add(time.Hour))
+		require.NoError(t, DeleteSystem("aaaaaaaaaaaa"))
+		assert.Empty(t, GetQueuedCommands("aaaaaaaaaaaa"))
+	})
+}
+
+func TestSchedules(t *testing.T) {
+	runSuite(t, func(t *testing.T) {
+		now := time.Now().Truncate(time.Second)
+
+		restart := util.Schedule{
+			Name:           "Weekly restart",
+			Expression:     "0 3 * * 0",
+			GardenSystemID: "aaaaaaaaaaaa",
+			CommandName:    "restart",
+			Parameters:     "{}",
+			Command:        `{"Command":"restart"}`,
+			Enabled:        true,
+			NextRun:        now.Add(-time.Second),
+		}
+		require.NoError(t, CreateSchedule(&restart))
+
+		scan := util.Schedule{
+			Name:           "Hourly scan",
+			Expression:     "@hourly",
+			GardenSystemID: "bbbbbbbbbbbb",
+			CommandName:    "scan",
+			Parameters:     "{}",
+			Command:        `{"Command":"scan"}`,
+			Enabled:        true,
+			NextRun:        now.Add(time.Hour),
+		}
+		require.NoError(t, CreateSchedule(&scan))
+
+		due := GetDueSchedules(now)
+		require.Len(t, due, 1)
+		assert.Equal(t, restart.ID, due[0].ID)
+		assert.Equal(t, `{"Command":"restart"}`, due[0].Command)
+		assert.JSONEq(t, "{}", due[0].Parameters)
+
+		next := now.Add(7 * 24 * time.Hour)
+		run := util.ScheduleRun{ScheduleID: restart.ID, CreatedAt: now, CommandLogID: 12}
+		require.NoError(t, RecordScheduleRun(&run, next))
+		assert.Empty(t, GetDueSchedules(now))
+
+		updated, err := GetSchedule(restart.ID)
+		require.NoError(t, err)
+		assert.WithinDuration(t, now, updated.LastRun, time.Second)
+		assert.WithinDuration(t, next, updated.NextRun, time.Second)
+
+		runs := GetScheduleRuns(restart.ID, 10)
+		require.Len(t, runs, 1)
+		assert.Equal(t, uint(12), runs[0].CommandLogID)
+
+		// Disabled schedules never run.
+		updated.Enabled = false
+		updated.NextRun = now
+		require.NoError(t, UpdateSchedule(&updated))
+		assert.Empty(t, GetDueSchedules(now.Add(30*time.Minute)))
+
+		updated, err = GetSchedule(restart.ID)
+		require.NoError(t, err)
+		assert.False(t, updated.Enabled)
+		assert.Equal(t, "Weekly restart", updated.Name)
+
+		require.NoError(t, DeleteSchedule(restart.ID))
+		assert.Error(t, DeleteSchedule(restart.ID))
+		assert.Empty(t, GetScheduleRuns(restart.ID, 10))
+
+		// Deleting a system deletes the schedules that target it.
+		require.NoError(t, DeleteSystem("bbbbbbbbbbbb"))
+		_, err = GetSchedule(scan.ID)
+		assert.Error(t, err)
+	})
+}
+
+func TestSystemTags(t *testing.T) {
+	runSuite(t, func(t *testing.T) {
+		require.NoError(t, SetSystemTags("aaaaaaaaaaaa", []string{"greenhouse", "beta", "greenhouse"}))
+		require.NoError(t, SetSystemTags("bbbbbbbbbbbb", []string{"greenhouse"}))
+
+		assert.Equal(t, []string{"beta", "greenhouse"}, GetSystemTags("aaaaaaaaaaaa"))
+		assert.Equal(t, []string{"aaaaaaaaaaaa", "bbbbbbbbbbbb"}, GetTaggedSystems("greenhouse"))
+
+		assert.Error(t, SetSystemTags("aaaaaaaaaaaa", []string{"not valid"}))
+		assert.Equal(t, []string{"beta", "greenhouse"}, GetSystemTags("aaaaaaaaaaaa"))
+
+		require.NoError(t, SetSystemTags("aaaaaaaaaaaa", nil))
+		assert.Empty(t, GetSystemTags("aaaaaaaaaaaa"))
+
+		require.NoError(t, DeleteSystem("bbbbbbbbbbbb"))
+		assert.Empty(t, GetTaggedSystems("greenhouse"))
+	})
+}
+
+func TestRollouts(t *testing.T) {
+	runSuite(t, func(t *testing.T) {
+		rollout := util.Rollout{
+			Chipset:       "esp8266",
+			TargetVersion: "3_0_2",
+			BatchSize:     1,
+			PSK:           "secret",
+			Status:        util.RolloutRunning,
+			Systems: []util.RolloutSystem{
+				{GardenSystemID: "bbbbbbbbbbbb", Position: 1, Status: util.RolloutSystemPending},
+				{GardenSystemID: "aaaaaaaaaaaa", Position: 0, Canary: true, Status: util.RolloutSystemPending},
+			},
+		}
+		require.NoError(t, CreateRollout(&rollout))
+
+		// Only one rollout can be active at a time.
+		second := util.Rollout{Tag: "greenhouse", Status: util.RolloutRunning}
+		assert.ErrorIs(t, CreateRollout(&second), ErrRolloutInProgress)
+
+		active, err := GetActiveRollout()
+		require.NoError(t, err)
+		assert.Equal(t, rollout.ID, active.ID)
+		assert.Equal(t, "secret", active.PSK)
+		require.Len(t, active.Systems, 2)
+		assert.True(t, active.Systems[0].Canary)
+		assert.Equal(t, util.RolloutStatusSummary{Pending: 2}, active.Summary())
+
+		canary := active.Systems[0]
+		canary.Status = util.RolloutSystemFailed
+		canary.Message = "download failed"
+		require.NoError(t, UpdateRolloutSystem(&canary))
+		require.NoError(t, SetRolloutStatus(rollout.ID, util.RolloutPaused, "update of aaaaaaaaaaaa failed"))
+
+		paused, err := GetActiveRollout()
+		require.NoError(t, err)
+		assert.Equal(t, util.RolloutPaused, paused.Status)
+		assert.Equal(t, "download failed", paused.Systems[0].Message)
+		assert.Equal(t, util.RolloutStatusSummary{Pending: 1, Failed: 1}, paused.Summary())
+
+		require.NoError(t, SetRolloutStatus(rollout.ID, util.RolloutCancelled, ""))
+		_, err = GetActiveRollout()
+		assert.Error(t, err)
+
+		cancelled, err := GetRollout(rollout.ID)
+		require.NoError(t, err)
+		assert.False(t, cancelled.Active())
+		assert.False(t, cancelled.CompletedAt.IsZero())
+
+		require.NoError(t, CreateRollout(&second))
+		assert.Equal(t, second.ID, GetRollouts(1)[0].ID)
+		require.NoError(t, SetRolloutStatus(second.ID, util.RolloutCancelled, ""))
+
+		require.NoError(t, DeleteSystem("aaaaaaaaaaaa"))
+		cancelled, err = GetRollout(rollout.ID)
+		require.NoError(t, err)
+		require.Len(t, cancelled.Systems, 1)
+		assert.Equal(t, "bbbbbbbbbbbb", cancelled.Systems[0].GardenSystemID)
+
+		assert.Error(t, SetRolloutStatus(9999, util.RolloutPaused, ""))
+	})
+}
+
+func TestFirmwareBuilds(t *testing.T) {
+	runSuite(t, func(t *testing.T) {
+		// Remove builds left over from a previous run against a persistent server.
+		for _, build := range GetFirmwareBuilds("testchip") {
+			require.NoError(t, DeleteFirmwareBuild(build.ID))
+		}
+
+		first := util.FirmwareBuild{Chipset: "testchip", Version: "1.0.0", Size: 10}
+		second := util.FirmwareBuild{Chipset: "testchip", Version: "1.1.0", Size: 20}
+		require.NoError(t, CreateFirmwareBuild(&first))
+		require.NoError(t, CreateFirmwareBuild(&second))
+
+		// Versions are unique per chipset.
+		assert.Error(t, CreateFirmwareBuild(&util.FirmwareBuild{Chipset: "testchip", Version: "1.0.0"}))
+
+		builds := GetFirmwareBuilds("testchip")
+		require.Len(t, builds, 2)
+		assert.Equal(t, "1.1.0", builds[0].Version)
+
+		_, err := GetDefaultFirmwareBuild("testchip")
+		assert.Error(t, err)
+
+		require.NoError(t, SetDefaultFirmwareBuild(second.ID))
+		require.NoError(t, SetDefaultFirmwareBuild(first.ID))
+
+		def, err := GetDefaultFirmwareBuild("testchip")
+		require.NoError(t, err)
+		assert.Equal(t, first.ID, def.ID)
+
+		found, err := GetFirmwareBuildByVersion("testchip", "1.1.0")
+		require.NoError(t, err)
+		assert.False(t, found.Default)
+
+		require.NoError(t, DeleteFirmwareBuild(second.ID))
+		assert.Error(t, DeleteFirmwareBuild(second.ID))
+		require.NoError(t, DeleteFirmwareBuild(first.ID))
+	})
+}
+
+func TestProvisioningLinks(t *testing.T) {
+	runSuite(t, func(t *testing.T) {
+		link := util.ProvisioningLink{
+			Name:         "greenhouse",
+			Controller:   true,
+			WifiSSID:     "garden",
+			WifiPassword: "secret",
+			ExpiresAt:    time.Now().Add(time.Hour),
+		}
+
+		raw, err := CreateProvisioningLink(&link)
+		require.NoError(t, err)
+		assert.NotEqual(t, raw, link.Hash)
+
+		found, err := GetProvisioningLink(raw)
+		require.NoError(t, err)
+		assert.Equal(t, "secret", found.WifiPassword)
+
+		_, err = GetProvisioningLink("bogus")
+		assert.Error(t, err)
+
+		// Links can only be used once and forget their secrets when used.
+		require.NoError(t, UseProvisioningLink(link.ID))
+		assert.ErrorIs(t, UseProvisioningLink(link.ID), ErrLinkUnusable)
+
+		_, err = GetProvisioningLink(raw)
+		assert.ErrorIs(t, err, ErrLinkUnusable)
+
+		used := GetProvisioningLinks(1)[0]
+		assert.Equal(t, link.ID, used.ID)
+		assert.Empty(t, used.WifiPassword)
+		assert.False(t, used.UsedAt.IsZero())
+
+		expired := util.ProvisioningLink{ExpiresAt: time.Now().Add(-time.Minute)}
+		raw, err = CreateProvisioningLink(&expired)
+		require.NoError(t, err)
+
+		_, err = GetProvisioningLink(raw)
+		assert.ErrorIs(t, err, ErrLinkUnusable)
+
+		require.NoError(t, DeleteProvisioningLink(link.ID))
+		require.NoError(t, DeleteProvisioningLink(expired.ID))
+		assert.Error(t, DeleteProvisioningLink(link.ID))
+	})
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"gorm.io/gorm"
+)
+
+func CreateFirmwareBuild(build *util.FirmwareBuild) error {
+	return db.Create(build).Error
+}
+
+// Returns every build for the provided chipset, newest first. An empty chipset returns builds for every chipset.
+func GetFirmwareBuilds(chipset string) []util.FirmwareBuild {
+	var builds []util.FirmwareBuild
+
+	query := db.Order("id DESC")
+	if chipset != "" {
+		query = query.Where("chipset = ?", chipset)
+	}
+
+	query.Find(&builds)
+
+	return builds
+}
+
+func GetFirmwareBuild(id uint) (util.FirmwareBuild, error) {
+	var build util.FirmwareBuild
+	err := db.First(&build, id).Error
+
+	return build, err
+}
+
+func GetFirmwareBuildByVersion(chipset, version string) (util.FirmwareBuild, error) {
+	var build util.FirmwareBuild
+	err := db.Where("chipset = ? AND version = ?", chipset, version).First(&build).Error
+
+	return build, err
+}
+
+func GetDefaultFirmwareBuild(chipset string) (util.FirmwareBuild, error) {
+	var build util.FirmwareBuild
+	err := db.Where("chipset = ? AND is_default = ?", chipset, true).First(&build).Error
+
+	return build, err
+}
+
+// Makes the provided build the default for its chipset.
+func SetDefaultFirmwareBuild(id uint) error {
+	build, err := GetFirmwareBuild(id)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.
+			Model(&util.FirmwareBuild{}).
+			Where("chipset = ? AND id <> ?", build.Chipset, id).
+			Update("is_default", false).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&util.FirmwareBuild{}).Where("id = ?", id).Update("is_default", true).Error
+	})
+}
+
+func DeleteFirmwareBuild(id uint) error {
+	res := db.Delete(&util.FirmwareBuild{}, id)
+	if res.Error == nil && res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return res.Error
+}
@@ -0,0 +1,23 @@
+package db
+
+import (
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/util"
+)
+
+func CreateMeshStatistics(stats *util.MeshStatistics) error {
+	return db.Create(stats).Error
+}
+
+// Returns the mesh statistics reported by a system between from and to, oldest first.
+func GetMeshStatistics(id string, from, to time.Time) []util.MeshStatistics {
+	var stats []util.MeshStatistics
+
+	db.
+		Where("garden_system_id = ? AND created_at >= ? AND created_at < ?", id, from.In(time.Local), to.In(time.Local)).
+		Order("created_at").
+		Find(&stats)
+
+	return stats
+}
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"gorm.io/gorm"
+)
+
+func CreateNetworkScan(scan *util.NetworkScan) error {
+	return db.Create(scan).Error
+}
+
+// Returns the most recent Wi-Fi scans performed by a system, newest first.
+func GetNetworkScans(id string, limit int) []util.NetworkScan {
+	var scans []util.NetworkScan
+
+	db.
+		Preload("Networks", func(db *gorm.DB) *gorm.DB {
+			return db.Order("rssi DESC")
+		}).
+		Where("garden_system_id = ?", id).
+		Order("created_at DESC").
+		Limit(limit).
+		Find(&scans)
+
+	return scans
+}
+
+func deleteNetworkScans(tx *gorm.DB, id string) error {
+	err := tx.
+		Where("network_scan_id IN (?)", tx.Model(&util.NetworkScan{}).Select("id").Where("garden_system_id = ?", id)).
+		Delete(&util.ScannedNetwork{}).
+		Error
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Where("garden_system_id = ?", id).Delete(&util.NetworkScan{}).Error
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"gorm.io/gorm"
+)
+
+var ErrLinkUnusable = errors.New("provisioning link has expired or was already used")
+
+// Stores a new provisioning link and returns its raw token.
+func CreateProvisioningLink(link *util.ProvisioningLink) (string, error) {
+	raw := hex.EncodeToString(util.SecureRandom(32))
+	link.Hash = util.SHA256([]byte(raw))
+
+	return raw, db.Create(link).Error
+}
+
+// Looks up a usable provisioning link by its raw token.
+func GetProvisioningLink(raw string) (util.ProvisioningLink, error) {
+	var link util.ProvisioningLink
+
+	if err := db.Where("hash = ?", util.SHA256([]byte(raw))).First(&link).Error; err != nil {
+		return link, err
+	}
+
+	if !link.Usable() {
+		return link, ErrLinkUnusable
+	}
+
+	return link, nil
+}
+
+// Returns the most recently created provisioning links, newest first.
+func GetProvisioningLinks(limit int) []util.ProvisioningLink {
+	var links []util.ProvisioningLink
+	db.Order("id DESC").Limit(limit).Find(&links)
+
+	return links
+}
+
+// Marks a link as used and forgets the secrets stored in it. Fails if the link was used concurrently.
+func UseProvisioningLink(id uint) error {
+	res := db.
+		Model(&util.ProvisioningLink{}).
+		Where("id = ? AND used_at = ?", id, time.Time{}).
+		Updates(map[string]interface{}{
+			"used_at":       time.Now(),
+			"wifi_password": "",
+			"mqtt_password": "",
+		})
+
+	if res.Error == nil && res.RowsAffected == 0 {
+		return ErrLinkUnusable
+	}
+
+	return res.Error
+}
+
+func DeleteProvisioningLink(id uint) error {
+	res := db.Delete(&util.ProvisioningLink{}, id)
+	if res.Error == nil && res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return res.Error
+}
@@ -0,0 +1,136 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"gorm.io/gorm"
+)
+
+// Adds a command to the queue of its system. The command's log entry must already exist.
+func QueueCommand(queued *util.QueuedCommand) error {
+	return db.Create(queued).Error
+}
+
+// Returns every command waiting to be delivered to a system, oldest first.
+func GetQueuedCommands(systemId string) []util.QueuedCommand {
+	var queued []util.QueuedCommand
+	db.Where("garden_system_id = ?", systemId).Order("id").Find(&queued)
+
+	return queued
+}
+
+func GetQueuedCommand(systemId string, id uint) (util.QueuedCommand, error) {
+	var queued util.QueuedCommand
+	err := db.Where("garden_system_id = ? AND id = ?", systemId, id).First(&queued).Error
+
+	return queued, err
+}
+
+// Removes a command from the queue so that it can be delivered. Returns gorm.ErrRecordNotFound if the command was
+// already removed, which prevents a command from being delivered twice when several messages arrive at once.
+func DequeueCommand(id uint) error {
+	res := db.Delete(&util.QueuedCommand{}, id)
+	if res.Error == nil && res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return res.Error
+}
+
+// Changes when a queued command expires. The new expiry must be in the future.
+func SetQueuedCommandExpiry(systemId string, id uint, expires time.Time) (util.QueuedCommand, error) {
+	if !expires.After(time.Now()) {
+		return util.QueuedCommand{}, errors.New("expiry must be in the future")
+	}
+
+	res := db.
+		Model(&util.QueuedCommand{}).
+		Where("garden_system_id = ? AND id = ?", systemId, id).
+		Update("expires_at", expires)
+
+	if res.Error != nil {
+		return util.QueuedCommand{}, res.Error
+	} else if res.RowsAffected == 0 {
+		return util.QueuedCommand{}, gorm.ErrRecordNotFound
+	}
+
+	return GetQueuedCommand(systemId, id)
+}
+
+// Removes a command from the queue without delivering it and marks its log entry as failed.
+func DeleteQueuedCommand(systemId string, id uint) (util.CommandLog, error) {
+	queued, err := GetQueuedCommand(systemId, id)
+	if err != nil {
+		return util.CommandLog{}, err
+	}
+
+	if err := DequeueCommand(queued.ID); err != nil {
+		return util.CommandLog{}, err
+	}
+
+	return failQueuedCommand(queued, util.CommandFailed, "removed from queue")
+}
+
+// Removes every queued command that expired before now and marks their log entries as timed out.
+func ExpireQueuedCommands(now time.Time) ([]util.CommandLog, error) {
+	var expired []util.QueuedCommand
+	if err := db.Where("expires_at < ?", now).Find(&expired).Error; err != nil {
+		return nil, err
+	}
+
+	var entries []util.CommandLog
+	for _, queued := range expired {
+		// Skip commands that were delivered after they were selected.
+		if err := DequeueCommand(queued.ID); errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		} else if err != nil {
+			return entries, err
+		}
+
+		entry, err := failQueuedCommand(queued, util.CommandTimeout, "expired before delivery")
+		if err != nil {
+			return entries, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Returns true if the system was told to sleep and hasn't announced that it woke up yet.
+func IsSystemAsleep(systemId string) bool {
+	var count int64
+
+	db.
+		Model(&util.CommandLog{}).
+		Where("garden_system_id = ? AND name = ? AND status = ?", systemId, "sleep", util.CommandSent).
+		Count(&count)
+
+	return count > 0
+}
+
+func failQueuedCommand(queued util.QueuedCommand, status util.CommandStatus, message string) (util.CommandLog, error) {
+	entry, err := GetCommandLog(queued.CommandLogID)
+	if err != nil {
+		return entry, err
+	}
+
+	if entry.Status != util.CommandQueued {
+		return entry, nil
+	}
+
+	entry.Status = status
+	entry.Message = message
+
+	err = db.
+		Model(&util.CommandLog{}).
+		Where("id = ?", entry.ID).
+		Updates(map[string]interface{}{"status": entry.Status, "message": entry.Message}).
+		Error
+
+	return entry, err
+}
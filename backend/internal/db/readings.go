@@ -0,0 +1,208 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/util"
+)
+
+// Function used to combine all readings in a time bucket into a single value.
+type Aggregation string
+
+const (
+	AggregateAverage Aggregation = "avg"
+	AggregateMinimum Aggregation = "min"
+	AggregateMaximum Aggregation = "max"
+)
+
+// Returns the readings for a system between from and to, combined into buckets of the provided size.
+// Readings that were reported with an error are skipped and empty buckets are omitted.
+func GetReadings(id string, from, to time.Time, bucket time.Duration, agg Aggregation) ([]util.ReadingBucket, error) {
+	if agg != AggregateAverage && agg != AggregateMinimum && agg != AggregateMaximum {
+		return nil, errors.New("unknown aggregation function")
+	}
+
+	if bucket <= 0 {
+		return nil, errors.New("bucket size must be positive")
+	}
+
+	// Timestamps are stored in local time and some drivers compare them as strings.
+	from, to = from.In(time.Local), to.In(time.Local)
+
+	a := newReadingAggregator(bucket, agg)
+
+	// Raw readings are only kept for a limited time. Older spans are served from hourly rollups and spans older than
+	// those are served from daily rollups.
+	rawStart := oldestStart(&util.Reading{}, "created_at", id, to)
+	hourlyStart := oldestStart(&util.HourlyReading{}, "start", id, rawStart)
+
+	// Daily and hourly rollups are made from the same readings. The day that hourly rollups start on is served from
+	// hourly rollups only, as its daily rollup would otherwise count the readings from hourlyStart on twice.
+	dayStart := startOfDay(hourlyStart)
+
+	if err := streamRollups(&util.DailyReading{}, id, from, minTime(to, dayStart), a); err != nil {
+		return nil, err
+	}
+
+	if err := streamRollups(&util.HourlyReading{}, id, maxTime(from, dayStart), minTime(to, rawStart), a); err != nil {
+		return nil, err
+	}
+
+	// Rows are streamed instead of loaded all at once since a long time span can contain a very large number of them.
+	rows, err := db.
+		Model(&util.Reading{}).
+		Where("garden_system_id = ? AND created_at >= ? AND created_at < ? AND error = ?", id, from, to, false).
+		Order("created_at").
+		Rows()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var reading util.Reading
+		if err := db.ScanRows(rows, &reading); err != nil {
+			return nil, err
+		}
+
+		a.add(reading)
+	}
+
+	return a.finish(), rows.Err()
+}
+
+// Returns the oldest value of the time column in the provided table for a system, or fallback if it has no rows
+// or the oldest row is newer than fallback.
+func oldestStart(model interface{}, column, id string, fallback time.Time) time.Time {
+	var oldest []time.Time
+
+	db.
+		Model(model).
+		Where("garden_system_id = ?", id).
+		Order(column).
+		Limit(1).
+		Pluck(column, &oldest)
+
+	if len(oldest) == 0 {
+		return fallback
+	}
+
+	return minTime(oldest[0], fallback)
+}
+
+// Adds all rollups from the provided table that start between from and to to the aggregator.
+func streamRollups(model interface{}, id string, from, to time.Time, a *readingAggregator) error {
+	if !from.Before(to) {
+		return nil
+	}
+
+	rows, err := db.
+		Model(model).
+		Where("garden_system_id = ? AND start >= ? AND start < ?", id, from, to).
+		Order("start").
+		Rows()
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var rollup util.ReadingRollup
+		if err := db.ScanRows(rows, &rollup); err != nil {
+			return err
+		}
+
+		a.addRollup(rollup)
+	}
+
+	return rows.Err()
+}
+
+// Returns midnight of the day containing t in local time, which is the start of its daily rollup.
+func startOfDay(t time.Time) time.Time {
+	t = t.In(time.Local)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
+
+// Combines readings and rollups sorted by time into buckets.
+type readingAggregator struct {
+	size time.Duration
+	agg  Aggregation
+
+	buckets []util.ReadingBucket
+	current *util.ReadingRollup
+}
+
+func newReadingAggregator(size time.Duration, agg Aggregation) *readingAggregator {
+	return &readingAggregator{size: size, agg: agg}
+}
+
+func (a *readingAggregator) add(reading util.Reading) {
+	a.addRollup(util.NewReadingRollup(reading))
+}
+
+func (a *readingAggregator) addRollup(rollup util.ReadingRollup) {
+	start := rollup.Start.Truncate(a.size)
+
+	if a.current == nil || !a.current.Start.Equal(start) {
+		a.flush()
+		a.current = &util.ReadingRollup{Start: start}
+	}
+
+	a.current.Merge(rollup)
+}
+
+func (a *readingAggregator) flush() {
+	if a.current == nil {
+		return
+	}
+
+	c := a.current
+	bucket := util.ReadingBucket{Start: c.Start, Count: c.Count}
+
+	switch a.agg {
+	case AggregateAverage:
+		bucket.Temperature, bucket.Humidity = c.AvgTemperature, c.AvgHumidity
+
+	case AggregateMinimum:
+		bucket.Temperature, bucket.Humidity = c.MinTemperature, c.MinHumidity
+
+	case AggregateMaximum:
+		bucket.Temperature, bucket.Humidity = c.MaxTemperature, c.MaxHumidity
+	}
+
+	a.buckets = append(a.buckets, bucket)
+	a.current = nil
+}
+
+// Flushes the last bucket and returns all buckets.
+func (a *readingAggregator) finish() []util.ReadingBucket {
+	a.flush()
+
+	if a.buckets == nil {
+		return []util.ReadingBucket{}
+	}
+
+	return a.buckets
+}
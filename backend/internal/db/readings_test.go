@@ -0,0 +1,53 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadingAggregation(t *testing.T) {
+	base := time.Date(2021, 12, 1, 12, 0, 0, 0, time.UTC)
+
+	readings := []util.Reading{
+		{CreatedAt: base, Temperature: 10, Humidity: 40},
+		{CreatedAt: base.Add(1 * time.Minute), Temperature: 20, Humidity: 50},
+		{CreatedAt: base.Add(4 * time.Minute), Temperature: 30, Humidity: 60},
+		{CreatedAt: base.Add(12 * time.Minute), Temperature: 5, Humidity: 10},
+	}
+
+	tests := []struct {
+		agg      Aggregation
+		expected []util.ReadingBucket
+	}{
+		{AggregateAverage, []util.ReadingBucket{
+			{Start: base, Count: 3, Temperature: 20, Humidity: 50},
+			{Start: base.Add(10 * time.Minute), Count: 1, Temperature: 5, Humidity: 10},
+		}},
+		{AggregateMinimum, []util.ReadingBucket{
+			{Start: base, Count: 3, Temperature: 10, Humidity: 40},
+			{Start: base.Add(10 * time.Minute), Count: 1, Temperature: 5, Humidity: 10},
+		}},
+		{AggregateMaximum, []util.ReadingBucket{
+			{Start: base, Count: 3, Temperature: 30, Humidity: 60},
+			{Start: base.Add(10 * time.Minute), Count: 1, Temperature: 5, Humidity: 10},
+		}},
+	}
+
+	for _, test := range tests {
+		a := newReadingAggregator(5*time.Minute, test.agg)
+		for _, r := range readings {
+			a.add(r)
+		}
+
+		assert.Equal(t, test.expected, a.finish(), "aggregation %s", test.agg)
+	}
+}
+
+func TestReadingAggregationEmpty(t *testing.T) {
+	a := newReadingAggregator(time.Hour, AggregateAverage)
+	assert.Empty(t, a.finish())
+}
@@ -0,0 +1,322 @@
+package db
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/config"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Controls how long readings are kept for. Configured in the [retention] section of garden.ini.
+type RetentionPolicy struct {
+	// Number of days raw readings and mesh statistics are kept before they are rolled up and deleted.
+	// Zero keeps them forever.
+	RawDays int
+
+	// Number of days hourly rollups are kept. Zero keeps them forever. Daily rollups are always kept.
+	HourlyDays int
+
+	// If raw readings should be written to a compressed CSV file before they are deleted.
+	Archive bool
+
+	// Directory that archives are written to.
+	ArchiveDirectory string
+}
+
+func loadRetentionPolicy() RetentionPolicy {
+	dir := config.GetString("retention.archive_directory")
+	if dir == "" {
+		dir = "data/archive"
+	}
+
+	return RetentionPolicy{
+		RawDays:          config.GetInt("retention.raw_days", 30),
+		HourlyDays:       config.GetInt("retention.hourly_days", 365),
+		Archive:          config.GetBool("retention.archive", true),
+		ArchiveDirectory: dir,
+	}
+}
+
+// Periodically applies the configured retention policy in the background.
+func StartRetention() {
+	policy := loadRetentionPolicy()
+	interval := config.GetDuration("retention.interval", time.Hour)
+	if interval <= 0 {
+		logrus.Warnf("[db] retention interval must be positive, using 1h instead of %s", interval)
+		interval = time.Hour
+	}
+
+	logrus.Debugf("[db] starting retention engine with policy %+v, running every %s", policy, interval)
+
+	go func() {
+		for {
+			if err := RunRetention(policy, time.Now()); err != nil {
+				logrus.Errorf("[db] unable to apply retention policy: %s", err)
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Rolls up, archives and deletes raw readings from before the start of the day RawDays ago. Readings are only deleted
+// once their rollups have been saved and, if enabled, their archive has been written.
+func RunRetention(policy RetentionPolicy, now time.Time) error {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	if policy.RawDays > 0 {
+		cutoff := today.AddDate(0, 0, -policy.RawDays)
+
+		// Systems can report readings with old timestamps at any time. Archiving, rolling up and deleting in one
+		// serializable transaction ensures that every step sees the same readings, so none are deleted without being
+		// archived. If the transaction fails after the archive was written, the readings are archived again next time.
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if policy.Archive {
+				if err := archiveReadings(tx, policy.ArchiveDirectory, cutoff, now); err != nil {
+					return fmt.Errorf("unable to archive readings: %w", err)
+				}
+			}
+
+			if err := rollupReadings(tx, cutoff); err != nil {
+				return fmt.Errorf("unable to roll up readings: %w", err)
+			}
+
+			return nil
+		}, &sql.TxOptions{Isolation: sql.LevelSerializable})
+
+		if err != nil {
+			return err
+		}
+
+		// Mesh statistics are only useful for diagnosing recent problems and are not rolled up.
+		if err := db.Where("created_at < ?", cutoff).Delete(&util.MeshStatistics{}).Error; err != nil {
+			return fmt.Errorf("unable to delete mesh statistics: %w", err)
+		}
+	}
+
+	if policy.HourlyDays > 0 {
+		cutoff := today.AddDate(0, 0, -policy.HourlyDays)
+
+		res := db.Where("start < ?", cutoff).Delete(&util.HourlyReading{})
+		if res.Error != nil {
+			return fmt.Errorf("unable to delete hourly rollups: %w", res.Error)
+		}
+
+		if res.RowsAffected > 0 {
+			logrus.Debugf("[db] deleted %d hourly rollups from before %s", res.RowsAffected, cutoff)
+		}
+	}
+
+	return nil
+}
+
+// Writes all readings from before cutoff to a gzip compressed CSV file. The file is written to a temporary location
+// and renamed once complete so that a partially written archive is never left behind.
+func archiveReadings(tx *gorm.DB, dir string, cutoff, now time.Time) error {
+	var count int64
+	if err := tx.Model(&util.Reading{}).Where("created_at < ?", cutoff).Count(&count).Error; err != nil {
+		return err
+	} else if count == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	dst := path.Join(dir, fmt.Sprintf("readings-%s.csv.gz", now.Format("20060102-150405")))
+	tmp := dst + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	// Removing the temporary file after a successful rename fails harmlessly.
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	writer := csv.NewWriter(gz)
+
+	if err := writer.Write([]string{"GardenSystemID", "CreatedAt", "Error", "Temperature", "Humidity"}); err != nil {
+		return err
+	}
+
+	rows, err := tx.Model(&util.Reading{}).Where("created_at < ?", cutoff).Order("created_at").Rows()
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var reading util.Reading
+		if err := tx.ScanRows(rows, &reading); err != nil {
+			return err
+		}
+
+		err := writer.Write([]string{
+			reading.GardenSystemID,
+			reading.CreatedAt.Format(time.RFC3339Nano),
+			strconv.FormatBool(reading.Error),
+			strconv.FormatFloat(float64(reading.Temperature), 'f', -1, 32),
+			strconv.FormatFloat(float64(reading.Humidity), 'f', -1, 32),
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+
+	logrus.Printf("[db] archived %d readings from before %s to %s", count, cutoff, dst)
+
+	return nil
+}
+
+// Summarizes all readings from before cutoff into hourly and daily rollups and deletes them. Readings that were
+// reported with an error are deleted without being summarized. Must be called inside a transaction.
+func rollupReadings(tx *gorm.DB, cutoff time.Time) error {
+	hourly := map[string]*util.ReadingRollup{}
+	daily := map[string]*util.ReadingRollup{}
+
+	add := func(rollups map[string]*util.ReadingRollup, reading util.Reading, start time.Time) {
+		key := reading.GardenSystemID + start.String()
+
+		r, ok := rollups[key]
+		if !ok {
+			r = &util.ReadingRollup{GardenSystemID: reading.GardenSystemID, Start: start}
+			rollups[key] = r
+		}
+
+		r.Merge(util.NewReadingRollup(reading))
+	}
+
+	rows, err := tx.
+		Model(&util.Reading{}).
+		Where("created_at < ? AND error = ?", cutoff, false).
+		Rows()
+
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var reading util.Reading
+		if err := tx.ScanRows(rows, &reading); err != nil {
+			rows.Close()
+			return err
+		}
+
+		t := reading.CreatedAt.In(cutoff.Location())
+		add(hourly, reading, t.Truncate(time.Hour))
+		add(daily, reading, time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()))
+	}
+
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range hourly {
+		if err := saveRollup(tx, &util.HourlyReading{ReadingRollup: *r}); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range daily {
+		if err := saveRollup(tx, &util.DailyReading{ReadingRollup: *r}); err != nil {
+			return err
+		}
+	}
+
+	res := tx.Where("created_at < ?", cutoff).Delete(&util.Reading{})
+	if res.RowsAffected > 0 {
+		logrus.Debugf("[db] rolled up %d readings from before %s", res.RowsAffected, cutoff)
+	}
+
+	return res.Error
+}
+
+// Saves a rollup, merging it with any existing rollup for the same system and start time. Rollups can already exist
+// when a system reports a reading with a timestamp that was already rolled up.
+func saveRollup(tx *gorm.DB, rollup interface{}) error {
+	var current *util.ReadingRollup
+	var existing []util.ReadingRollup
+
+	switch r := rollup.(type) {
+	case *util.HourlyReading:
+		current = &r.ReadingRollup
+	case *util.DailyReading:
+		current = &r.ReadingRollup
+	default:
+		panic("unknown rollup type")
+	}
+
+	err := tx.
+		Model(rollup).
+		Where("garden_system_id = ? AND start = ?", current.GardenSystemID, current.Start).
+		Find(&existing).
+		Error
+
+	if err != nil {
+		return err
+	}
+
+	if len(existing) == 0 {
+		return tx.Create(rollup).Error
+	}
+
+	merged := existing[0]
+	merged.Merge(*current)
+	merged.Start = current.Start
+
+	return tx.
+		Model(rollup).
+		Where("garden_system_id = ? AND start = ?", current.GardenSystemID, current.Start).
+		Updates(map[string]interface{}{
+			"count":           merged.Count,
+			"min_temperature": merged.MinTemperature,
+			"max_temperature": merged.MaxTemperature,
+			"avg_temperature": merged.AvgTemperature,
+			"min_humidity":    merged.MinHumidity,
+			"max_humidity":    merged.MaxHumidity,
+			"avg_humidity":    merged.AvgHumidity,
+		}).
+		Error
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"gorm.io/gorm"
+)
+
+var ErrRolloutInProgress = errors.New("a rollout is already in progress")
+
+var activeRolloutStatuses = []util.RolloutStatus{util.RolloutRunning, util.RolloutPaused}
+
+// Creates a rollout and the progress of each of its systems. Only one rollout can be active at a time.
+func CreateRollout(rollout *util.Rollout) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var active int64
+		if err := tx.Model(&util.Rollout{}).Where("status IN ?", activeRolloutStatuses).Count(&active).Error; err != nil {
+			return err
+		} else if active > 0 {
+			return ErrRolloutInProgress
+		}
+
+		return tx.Create(rollout).Error
+	})
+}
+
+// Returns the rollout that is running or paused.
+func GetActiveRollout() (util.Rollout, error) {
+	var rollout util.Rollout
+
+	err := preloadRolloutSystems().
+		Where("status IN ?", activeRolloutStatuses).
+		First(&rollout).
+		Error
+
+	return rollout, err
+}
+
+func GetRollout(id uint) (util.Rollout, error) {
+	var rollout util.Rollout
+	err := preloadRolloutSystems().First(&rollout, id).Error
+
+	return rollout, err
+}
+
+// Returns the most recent rollouts, newest first.
+func GetRollouts(limit int) []util.Rollout {
+	var rollouts []util.Rollout
+	preloadRolloutSystems().Order("id DESC").Limit(limit).Find(&rollouts)
+
+	return rollouts
+}
+
+// Changes the status of a rollout. Completing or cancelling a rollout also records when it finished.
+func SetRolloutStatus(id uint, status util.RolloutStatus, message string) error {
+	updates := map[string]interface{}{"status": status, "message": message}
+	if status == util.RolloutCompleted || status == util.RolloutCancelled {
+		updates["completed_at"] = time.Now()
+	}
+
+	res := db.Model(&util.Rollout{}).Where("id = ?", id).Updates(updates)
+	if res.Error == nil && res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return res.Error
+}
+
+// Saves the progress of a system in a rollout.
+func UpdateRolloutSystem(system *util.RolloutSystem) error {
+	return db.Save(system).Error
+}
+
+func preloadRolloutSystems() *gorm.DB {
+	return db.Preload("Systems", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position")
+	})
+}
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"gorm.io/gorm"
+)
+
+var ErrRotationInProgress = errors.New("a key rotation is already in progress")
+
+// Creates a key rotation that distributes the provided key to the provided systems. Only one rotation can be active
+// at a time.
+func StartKeyRotation(key string, ids []string) (util.KeyRotation, error) {
+	rotation := util.KeyRotation{}
+
+	for _, id := range ids {
+		rotation.Systems = append(rotation.Systems, util.KeyRotationProgress{
+			GardenSystemID: id,
+			Status:         util.RotationPending,
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var active int64
+		err := tx.
+			Model(&util.KeyRotation{}).
+			Where("completed_at = ? AND cancelled_at = ?", time.Time{}, time.Time{}).
+			Count(&active).
+			Error
+
+		if err != nil {
+			return err
+		} else if active > 0 {
+			return ErrRotationInProgress
+		}
+
+		if err := tx.Create(&rotation).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&util.Configuration{}).Where("1 = 1").Update("pending_mesh_key", key).Error
+	})
+
+	return rotation, err
+}
+
+// Returns the rotation that is currently in progress.
+func GetActiveKeyRotation() (util.KeyRotation, error) {
+	var rotation util.KeyRotation
+
+	err := db.
+		Preload("Systems", func(db *gorm.DB) *gorm.DB {
+			return db.Order("garden_system_id")
+		}).
+		Where("completed_at = ? AND cancelled_at = ?", time.Time{}, time.Time{}).
+		First(&rotation).
+		Error
+
+	return rotation, err
+}
+
+// Returns the most recent key rotations, newest first.
+func GetKeyRotations(limit int) []util.KeyRotation {
+	var rotations []util.KeyRotation
+
+	db.
+		Preload("Systems", func(db *gorm.DB) *gorm.DB {
+			return db.Order("garden_system_id")
+		}).
+		Order("id DESC").
+		Limit(limit).
+		Find(&rotations)
+
+	return rotations
+}
+
+// Adds a system to a rotation if it isn't already part of it. Used for systems discovered after the rotation started.
+func AddKeyRotationSystem(rotationId uint, id string) (util.KeyRotationProgress, error) {
+	progress := util.KeyRotationProgress{
+		KeyRotationID:  rotationId,
+		GardenSystemID: id,
+		Status:         util.RotationPending,
+	}
+
+	err := db.
+		Where("key_rotation_id = ? AND garden_system_id = ?", rotationId, id).
+		FirstOrCreate(&progress).
+		Error
+
+	return progress, err
+}
+
+// Records an attempt to send the new key to a system. A nil error marks the key as sent.
+func SetKeyRotationSent(rotationId uint, id string, sendErr error) error {
+	updates := map[string]interface{}{
+		"status":   util.RotationSent,
+		"attempts": gorm.Expr("attempts + 1"),
+		"sent_at":  time.Now(),
+		"error":    "",
+	}
+
+	if sendErr != nil {
+		updates["status"] = util.RotationFailed
+		updates["error"] = sendErr.Error()
+	}
+
+	return db.
+		Model(&util.KeyRotationProgress{}).
+		Where("key_rotation_id = ? AND garden_system_id = ? AND status <> ?", rotationId, id, util.RotationAcknowledged).
+		Updates(updates).
+		Error
+}
+
+// Marks a system as having acknowledged the new key and returns the number of systems that still haven't.
+func AcknowledgeKeyRotation(rotationId uint, id string) (int64, error) {
+	var remaining int64
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.
+			Model(&util.KeyRotationProgress{}).
+			Where("key_rotation_id = ? AND garden_system_id = ?", rotationId, id).
+			Updates(map[string]interface{}{
+				"status":          util.RotationAcknowledged,
+				"acknowledged_at": time.Now(),
+				"error":           "",
+			}).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		return tx.
+			Model(&util.KeyRotationProgress{}).
+			Where("key_rotation_id = ? AND status <> ?", rotationId, util.RotationAcknowledged).
+			Count(&remaining).
+			Error
+	})
+
+	return remaining, err
+}
+
+// Replaces the mesh key with the pending key and marks the rotation as completed.
+func CompleteKeyRotation(rotationId uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var config util.Configuration
+		if err := tx.First(&config).Error; err != nil {
+			return err
+		}
+
+		if config.PendingMeshKey == "" {
+			return errors.New("no pending mesh key")
+		}
+
+		config.MeshKey, config.PendingMeshKey = config.PendingMeshKey, ""
+		if err := tx.Save(&config).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&util.KeyRotation{}).Where("id = ?", rotationId).Update("completed_at", time.Now()).Error
+	})
+}
+
+// Discards the pending key and marks the rotation as cancelled.
+func CancelKeyRotation(rotationId uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&util.Configuration{}).Where("1 = 1").Update("pending_mesh_key", "").Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&util.KeyRotation{}).Where("id = ?", rotationId).Update("cancelled_at", time.Now()).Error
+	})
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"gorm.io/gorm"
+)
+
+func CreateSchedule(schedule *util.Schedule) error {
+	return db.Create(schedule).Error
+}
+
+// Saves every field of an existing schedule.
+func UpdateSchedule(schedule *util.Schedule) error {
+	res := db.
+		Model(&util.Schedule{}).
+		Where("id = ?", schedule.ID).
+		Select("*").
+		Omit("id", "created_at").
+		Updates(schedule)
+
+	if res.Error == nil && res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return res.Error
+}
+
+func GetSchedules() []util.Schedule {
+	var schedules []util.Schedule
+	db.Order("id").Find(&schedules)
+
+	return schedules
+}
+
+func GetSchedule(id uint) (util.Schedule, error) {
+	var schedule util.Schedule
+	err := db.First(&schedule, id).Error
+
+	return schedule, err
+}
+
+// Returns every enabled schedule whose next run is at or before now.
+func GetDueSchedules(now time.Time) []util.Schedule {
+	var schedules []util.Schedule
+
+	db.
+		Where("enabled = ? AND next_run <> ? AND next_run <= ?", true, time.Time{}, now).
+		Order("next_run").
+		Find(&schedules)
+
+	return schedules
+}
+
+// Records a run of a schedule and when it runs next.
+func RecordScheduleRun(run *util.ScheduleRun, next time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(run).Error; err != nil {
+			return err
+		}
+
+		return tx.
+			Model(&util.Schedule{}).
+			Where("id = ?", run.ScheduleID).
+			Updates(map[string]interface{}{"last_run": run.CreatedAt, "next_run": next}).
+			Error
+	})
+}
+
+// Returns the most recent runs of a schedule, newest first.
+func GetScheduleRuns(id uint, limit int) []util.ScheduleRun {
+	var runs []util.ScheduleRun
+	db.Where("schedule_id = ?", id).Order("id desc").Limit(limit).Find(&runs)
+
+	return runs
+}
+
+// Deletes a schedule and its run history.
+func DeleteSchedule(id uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("schedule_id = ?", id).Delete(&util.ScheduleRun{}).Error; err != nil {
+			return err
+		}
+
+		res := tx.Delete(&util.Schedule{}, id)
+		if res.Error == nil && res.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		return res.Error
+	})
+}
+
+// Deletes every schedule that targets the provided system.
+func deleteSchedules(tx *gorm.DB, systemId string) error {
+	var ids []uint
+	if err := tx.Model(&util.Schedule{}).Where("garden_system_id = ?", systemId).Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if err := tx.Where("schedule_id IN ?", ids).Delete(&util.ScheduleRun{}).Error; err != nil {
+		return err
+	}
+
+	return tx.Where("id IN ?", ids).Delete(&util.Schedule{}).Error
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"gorm.io/gorm"
+)
+
+// Returns the identifiers of all online systems that haven't been seen since the provided time.
+func GetStaleSystems(since time.Time) []string {
+	var ids []string
+
+	db.
+		Model(&util.GardenSystem{}).
+		Where("online = ? AND last_seen < ?", true, since).
+		Pluck("identifier", &ids)
+
+	return ids
+}
+
+// Returned when a system is already in the requested state, so there is no transition to record.
+var ErrStatusUnchanged = errors.New("system status is unchanged")
+
+// Records that a system was seen and marks it as online if it was offline. Returns ErrStatusUnchanged if the system
+// was already online.
+func MarkSystemSeen(id string, now time.Time) (util.SystemStatusChange, error) {
+	err := db.
+		Model(&util.GardenSystem{}).
+		Where("identifier = ?", id).
+		Update("last_seen", now).
+		Error
+
+	if err != nil {
+		return util.SystemStatusChange{}, err
+	}
+
+	return setSystemOnline(db.Where("identifier = ? AND online = ?", id, false), id, true)
+}
+
+// Marks a system as offline if it is online and still hasn't been seen since the provided time. Returns
+// ErrStatusUnchanged if the system is already offline or sent a message in the meantime.
+func MarkSystemOffline(id string, since time.Time) (util.SystemStatusChange, error) {
+	return setSystemOnline(db.Where("identifier = ? AND online = ? AND last_seen < ?", id, true, since), id, false)
+}
+
+// Updates the online column of the system matched by the query and records the transition in its status history.
+// Only the online column is written, so concurrent saves of the rest of the system can't undo a transition.
+func setSystemOnline(query *gorm.DB, id string, online bool) (util.SystemStatusChange, error) {
+	change := util.SystemStatusChange{GardenSystemID: id, Online: online}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		res := tx.
+			Model(&util.GardenSystem{}).
+			Where(query).
+			Update("online", online)
+
+		if res.Error != nil {
+			return res.Error
+		} else if res.RowsAffected == 0 {
+			return ErrStatusUnchanged
+		}
+
+		return tx.Create(&change).Error
+	})
+
+	return change, err
+}
+
+// Returns the most recent status changes of a system, newest first.
+func GetStatusHistory(id string, limit int) []util.SystemStatusChange {
+	var changes []util.SystemStatusChange
+
+	db.
+		Where("garden_system_id = ?", id).
+		Order("created_at DESC").
+		Limit(limit).
+		Find(&changes)
+
+	return changes
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"gorm.io/gorm"
+)
+
+// Replaces the tags of a system.
+func SetSystemTags(id string, tags []string) error {
+	for _, tag := range tags {
+		if !util.TagRegex.MatchString(tag) {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("garden_system_id = ?", id).Delete(&util.SystemTag{}).Error; err != nil {
+			return err
+		}
+
+		seen := map[string]bool{}
+		for _, tag := range tags {
+			if seen[tag] {
+				continue
+			}
+
+			seen[tag] = true
+
+			if err := tx.Create(&util.SystemTag{GardenSystemID: id, Tag: tag}).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Returns the tags of a system in alphabetical order.
+func GetSystemTags(id string) []string {
+	tags := []string{}
+	db.Model(&util.SystemTag{}).Where("garden_system_id = ?", id).Order("tag").Pluck("tag", &tags)
+
+	return tags
+}
+
+// Returns the identifiers of every system with the provided tag.
+func GetTaggedSystems(tag string) []string {
+	var ids []string
+	db.Model(&util.SystemTag{}).Where("tag = ?", tag).Order("garden_system_id").Pluck("garden_system_id", &ids)
+
+	return ids
+}
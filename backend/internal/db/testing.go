@@ -0,0 +1,25 @@
+package db
+
+import (
+	"os"
+	"testing"
+)
+
+// Creates an empty database in a new temporary working directory for the duration of a test. Used by the tests of
+// packages that depend on the database.
+func InitializeTestDatabase(t testing.TB) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	InitializeDatabase()
+}
@@ -0,0 +1,226 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/config"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+var usernameRegex = regexp.MustCompile("^[a-zA-Z0-9_.-]{1,32}$")
+
+// Creates the initial administrator account if no users exist. The password is read from the [auth] section of the
+// configuration or randomly generated and logged once.
+func initializeUsers() {
+	var count int64
+	db.Model(&util.User{}).Count(&count)
+
+	if count > 0 {
+		ensureAdmin()
+		return
+	}
+
+	username := config.GetString("auth.username")
+	if username == "" {
+		username = "admin"
+	}
+
+	password := config.GetString("auth.password")
+	generated := password == ""
+	if generated {
+		password = base64.RawURLEncoding.EncodeToString(util.SecureRandom(18))
+	}
+
+	if _, err := CreateUser(username, password, util.RoleAdmin); err != nil {
+		logrus.Fatalf("[db] unable to create initial user: %s", err)
+	}
+
+	if generated {
+		logrus.Warnf("[db] created initial user %s with password %s. Change it after logging in.", username, password)
+	} else {
+		logrus.Printf("[db] created initial user %s", username)
+	}
+}
+
+// Accounts created before roles existed have no role assigned. Promote the oldest account to an administrator if
+// nobody else is one so that the server can still be managed.
+func ensureAdmin() {
+	var count int64
+	db.Model(&util.User{}).Where("role = ?", util.RoleAdmin).Count(&count)
+
+	if count > 0 {
+		return
+	}
+
+	var user util.User
+	if err := db.Order("id").First(&user).Error; err != nil {
+		return
+	}
+
+	logrus.Warnf("[db] no administrators found, promoting user %s", user.Username)
+
+	if err := SetUserRole(user.ID, util.RoleAdmin); err != nil {
+		logrus.Errorf("[db] unable to promote %s: %s", user.Username, err)
+	}
+}
+
+// Creates a new user with the provided password and role.
+func CreateUser(username, password string, role util.Role) (util.User, error) {
+	user := util.User{Username: username, Role: role}
+
+	if !usernameRegex.MatchString(username) {
+		return user, errors.New("invalid username")
+	}
+
+	if !role.Valid() {
+		return user, errors.New("invalid role")
+	}
+
+	if err := user.SetPassword(password); err != nil {
+		return user, err
+	}
+
+	err := db.Create(&user).Error
+
+	return user, err
+}
+
+func GetAllUsers() []util.User {
+	var users []util.User
+	db.Order("id").Find(&users)
+
+	return users
+}
+
+func GetUser(id uint) (util.User, error) {
+	var user util.User
+	err := db.First(&user, id).Error
+
+	return user, err
+}
+
+// Changes the password of the provided user.
+func UpdatePassword(id uint, password string) error {
+	user, err := GetUser(id)
+	if err != nil {
+		return err
+	}
+
+	if err := user.SetPassword(password); err != nil {
+		return err
+	}
+
+	return db.Save(&user).Error
+}
+
+// Changes the role assigned to the provided user.
+func SetUserRole(id uint, role util.Role) error {
+	if !role.Valid() {
+		return errors.New("invalid role")
+	}
+
+	res := db.Model(&util.User{}).Where("id = ?", id).Update("role", role)
+	if res.Error == nil && res.RowsAffected == 0 {
+		return errors.New("user not found")
+	}
+
+	return res.Error
+}
+
+// Deletes the provided user and all of their tokens.
+func DeleteUser(id uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", id).Delete(&util.Token{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Delete(&util.User{}, id).Error
+	})
+}
+
+// Checks the provided credentials and returns the matching user.
+func AuthenticateUser(username, password string) (util.User, error) {
+	var user util.User
+
+	db.Where("username = ?", username).Limit(1).Find(&user)
+
+	if user.ID == 0 {
+		// Compare against a dummy hash anyway so that valid usernames can't be discovered through timing.
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return user, ErrInvalidCredentials
+	}
+
+	if !user.CheckPassword(password) {
+		return user, ErrInvalidCredentials
+	}
+
+	return user, nil
+}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("garden"), bcrypt.DefaultCost)
+
+// Issues a new token for the provided user. A lifetime of zero creates a token that never expires.
+// Returns the raw token, which is not stored anywhere and cannot be retrieved later.
+func CreateToken(userId uint, name string, lifetime time.Duration) (string, util.Token, error) {
+	raw := hex.EncodeToString(util.SecureRandom(32))
+
+	token := util.Token{
+		UserID: userId,
+		Name:   name,
+		Hash:   util.SHA256([]byte(raw)),
+	}
+
+	if lifetime > 0 {
+		token.ExpiresAt = time.Now().Add(lifetime)
+	}
+
+	err := db.Create(&token).Error
+
+	return raw, token, err
+}
+
+// Looks up the user that owns the provided raw token. Expired tokens are deleted.
+func GetTokenUser(raw string) (util.User, util.Token, error) {
+	var user util.User
+	var token util.Token
+
+	if err := db.Where("hash = ?", util.SHA256([]byte(raw))).First(&token).Error; err != nil {
+		return user, token, err
+	}
+
+	if token.Expired() {
+		db.Delete(&token)
+		return user, token, errors.New("token expired")
+	}
+
+	user, err := GetUser(token.UserID)
+
+	return user, token, err
+}
+
+func GetTokens(userId uint) []util.Token {
+	var tokens []util.Token
+	db.Where("user_id = ?", userId).Order("id").Find(&tokens)
+
+	return tokens
+}
+
+// Deletes the token with the provided ID if it is owned by the provided user.
+func DeleteToken(userId, id uint) error {
+	res := db.Where("user_id = ? AND id = ?", userId, id).Delete(&util.Token{})
+	if res.Error == nil && res.RowsAffected == 0 {
+		return errors.New("token not found")
+	}
+
+	return res.Error
+}
@@ -0,0 +1,246 @@
+// Package envelope implements the framing used to send encrypted commands to garden systems.
+//
+// Commands are encrypted with ChaCha20-Poly1305. Two envelope versions exist:
+//
+// Version 1 is "e" || NONCE || TAG || CIPHERTEXT, where "||" denotes concatenation. The firmware handles commands as
+// C strings, so the nonce and ciphertext can't contain NUL or carriage return bytes. Sealing is retried with a new
+// nonce until neither byte is present, which gets less likely to succeed as commands get longer. It is only used for
+// systems that don't announce support for a newer version.
+//
+// Version 2 is "E" || BASE64(VERSION || NONCE || TAG || CIPHERTEXT), using standard base64 without padding. The version
+// byte is authenticated as additional data. The envelope only contains printable characters, so no retries are needed.
+//
+// Version 3 uses the same framing as version 2 with a version byte of 3. The first 8 bytes of the plaintext are a big
+// endian sequence number followed by the command, which prevents captured envelopes from being replayed.
+//
+// Systems announce the newest envelope version they support with the "EV" field of their discovery message.
+//
+// # Replay protection
+//
+// Sequence numbers are allocated by the backend and are strictly increasing for every system, including across
+// backend restarts. They start at the current Unix time in milliseconds, so a system that was deleted and rediscovered
+// keeps working without being reset. Broadcasts share the same sequence space, so a broadcast's sequence number is
+// greater than the last number sent to any system.
+//
+// Firmware that announces version 3 or later must:
+//   - Reject version 1 and 2 envelopes, as they don't carry a sequence number.
+//   - Only decrypt envelopes with a valid tag and reject any envelope whose sequence number is less than or equal to
+//     the last sequence number it accepted.
+//   - Persist the last accepted sequence number to flash before executing the command, so that rebooting doesn't allow
+//     an envelope to be replayed.
+//   - Include the sequence number when acknowledging a command so that the backend can match the acknowledgement.
+//
+// Versions 1 and 2 are not protected against replay attacks.
+package envelope
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// Raw envelope prefixed with "e".
+	VersionLegacy = 1
+
+	// Base64 encoded envelope prefixed with "E".
+	VersionBase64 = 2
+
+	// Base64 encoded envelope with a sequence number in the plaintext.
+	VersionSequenced = 3
+
+	// Newest envelope version supported by the backend.
+	VersionLatest = VersionSequenced
+
+	// Size of the sequence number in version 3 envelopes.
+	sequenceSize = 8
+
+	// Number of times a legacy envelope is resealed with a new nonce before giving up.
+	legacyAttempts = 128
+)
+
+var (
+	ErrUnknownVersion = errors.New("unknown envelope version")
+	ErrMalformed      = errors.New("malformed envelope")
+	ErrLegacyFailed   = errors.New("unable to seal legacy envelope without forbidden bytes")
+)
+
+var encoding = base64.RawStdEncoding
+
+// Bytes that legacy envelopes can't contain.
+const legacyForbidden = "\x00\x0d"
+
+// A command and the metadata carried alongside it in an envelope.
+type Message struct {
+	Version int
+
+	// Sequence number of the command. Only sent in version 3 and later envelopes.
+	Sequence uint64
+
+	Command []byte
+}
+
+// Returns true if envelopes of this version carry a sequence number.
+func HasSequence(version int) bool {
+	return version >= VersionSequenced
+}
+
+// Seals and opens envelopes with a single key. Safe for concurrent use.
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+func NewSealer(key []byte) (*Sealer, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sealer{aead: aead}, nil
+}
+
+// Returns the version that should be used to send a command to a system that announced the provided version.
+// Systems that don't announce a version only support legacy envelopes.
+func Negotiate(announced int) int {
+	if announced < VersionLegacy {
+		return VersionLegacy
+	} else if announced > VersionLatest {
+		return VersionLatest
+	}
+
+	return announced
+}
+
+// Encrypts the message's command and frames it using the message's envelope version.
+func (s *Sealer) Seal(msg Message) (string, error) {
+	plaintext := msg.Command
+
+	switch msg.Version {
+	case VersionLegacy:
+		return s.sealLegacy(plaintext)
+
+	case VersionSequenced:
+		plaintext = make([]byte, sequenceSize, sequenceSize+len(msg.Command))
+		binary.BigEndian.PutUint64(plaintext, msg.Sequence)
+		plaintext = append(plaintext, msg.Command...)
+
+		fallthrough
+
+	case VersionBase64:
+		header := []byte{byte(msg.Version)}
+		nonce := s.nonce()
+
+		raw := s.aead.Seal(nil, nonce, plaintext, header)
+
+		frame := make([]byte, 0, len(header)+len(raw)+len(nonce))
+		frame = append(frame, header...)
+		frame = append(frame, nonce...)
+		frame = append(frame, swapTag(raw, s.aead.Overhead())...)
+
+		return "E" + encoding.EncodeToString(frame), nil
+
+	default:
+		return "", ErrUnknownVersion
+	}
+}
+
+func (s *Sealer) sealLegacy(plaintext []byte) (string, error) {
+	for i := 0; i < legacyAttempts; i++ {
+		nonce := s.nonce()
+		raw := s.aead.Seal(nil, nonce, plaintext, nil)
+
+		if bytes.ContainsAny(nonce, legacyForbidden) || bytes.ContainsAny(raw, legacyForbidden) {
+			continue
+		}
+
+		return "e" + string(nonce) + string(swapTag(raw, s.aead.Overhead())), nil
+	}
+
+	return "", ErrLegacyFailed
+}
+
+// Decrypts an envelope of any version.
+func (s *Sealer) Open(envelope string) (Message, error) {
+	var msg Message
+
+	if envelope == "" {
+		return msg, ErrMalformed
+	}
+
+	var header, frame []byte
+
+	switch envelope[0] {
+	case 'e':
+		msg.Version, frame = VersionLegacy, []byte(envelope[1:])
+
+	case 'E':
+		decoded, err := encoding.DecodeString(envelope[1:])
+		if err != nil || len(decoded) == 0 {
+			return msg, ErrMalformed
+		}
+
+		if decoded[0] != VersionBase64 && decoded[0] != VersionSequenced {
+			return msg, ErrUnknownVersion
+		}
+
+		msg.Version, header, frame = int(decoded[0]), decoded[:1], decoded[1:]
+
+	default:
+		return msg, ErrUnknownVersion
+	}
+
+	overhead := s.aead.NonceSize() + s.aead.Overhead()
+	if len(frame) < overhead {
+		return msg, ErrMalformed
+	}
+
+	nonce := frame[:s.aead.NonceSize()]
+	tag := frame[s.aead.NonceSize():overhead]
+	ciphertext := frame[overhead:]
+
+	raw := make([]byte, 0, len(ciphertext)+len(tag))
+	raw = append(raw, ciphertext...)
+	raw = append(raw, tag...)
+
+	plaintext, err := s.aead.Open(nil, nonce, raw, header)
+	if err != nil {
+		return msg, err
+	}
+
+	if HasSequence(msg.Version) {
+		if len(plaintext) < sequenceSize {
+			return msg, ErrMalformed
+		}
+
+		msg.Sequence = binary.BigEndian.Uint64(plaintext)
+		plaintext = plaintext[sequenceSize:]
+	}
+
+	msg.Command = plaintext
+
+	return msg, nil
+}
+
+func (s *Sealer) nonce() []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+
+	return nonce
+}
+
+// Go appends the tag to the ciphertext but garden systems expect the tag before the ciphertext.
+func swapTag(raw []byte, size int) []byte {
+	start := len(raw) - size
+	tag, ciphertext := raw[start:], raw[:start]
+
+	swapped := make([]byte, 0, len(raw))
+	swapped = append(swapped, tag...)
+	return append(swapped, ciphertext...)
+}
@@ -0,0 +1,120 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, 32)
+
+func newTestSealer(t testing.TB) *Sealer {
+	s, err := NewSealer(testKey)
+	require.NoError(t, err)
+
+	return s
+}
+
+func TestRoundTrip(t *testing.T) {
+	s := newTestSealer(t)
+	command := []byte(`{"Command":"scan"}`)
+
+	for _, version := range []int{VersionLegacy, VersionBase64, VersionSequenced} {
+		for i := 0; i < 50; i++ {
+			msg := Message{Version: version, Sequence: 1638316800000 + uint64(i), Command: command}
+
+			sealed, err := s.Seal(msg)
+			require.NoError(t, err)
+
+			if version == VersionLegacy {
+				assert.True(t, strings.HasPrefix(sealed, "e"))
+				assert.False(t, strings.ContainsAny(sealed, legacyForbidden))
+				assert.Len(t, sealed, 1+12+16+len(command))
+			} else {
+				assert.True(t, strings.HasPrefix(sealed, "E"))
+				for _, c := range sealed {
+					assert.True(t, c > 0x20 && c < 0x7f, "envelope contains unprintable character %q", c)
+				}
+			}
+
+			// Only newer envelopes carry the sequence number.
+			if !HasSequence(version) {
+				msg.Sequence = 0
+			}
+
+			actual, err := s.Open(sealed)
+			require.NoError(t, err)
+			assert.Equal(t, msg, actual)
+		}
+	}
+}
+
+func TestBinaryPlaintext(t *testing.T) {
+	s := newTestSealer(t)
+
+	plaintext := []byte{0x00, 0x0d, 0x01, 0xff}
+
+	sealed, err := s.Seal(Message{Version: VersionSequenced, Sequence: 0x0d00, Command: plaintext})
+	require.NoError(t, err)
+
+	actual, err := s.Open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, actual.Command)
+	assert.Equal(t, uint64(0x0d00), actual.Sequence)
+}
+
+func TestOpenErrors(t *testing.T) {
+	s := newTestSealer(t)
+
+	sealed, err := s.Seal(Message{Version: VersionSequenced, Sequence: 5, Command: []byte("command")})
+	require.NoError(t, err)
+
+	frame, err := base64.RawStdEncoding.DecodeString(sealed[1:])
+	require.NoError(t, err)
+
+	// Downgrading an envelope to a version without a sequence number must fail authentication.
+	frame[0] = VersionBase64
+	_, err = s.Open("E" + base64.RawStdEncoding.EncodeToString(frame))
+	assert.Error(t, err)
+
+	frame[0] = 4
+	_, err = s.Open("E" + base64.RawStdEncoding.EncodeToString(frame))
+	assert.ErrorIs(t, err, ErrUnknownVersion)
+
+	other, err := NewSealer(bytes.Repeat([]byte{0x43}, 32))
+	require.NoError(t, err)
+
+	_, err = other.Open(sealed)
+	assert.Error(t, err)
+
+	for _, envelope := range []string{"", "x", "e", "E", "E!!!!", "eshort", "E" + strings.Repeat("A", 10)} {
+		_, err := s.Open(envelope)
+		assert.Error(t, err, "envelope %q", envelope)
+	}
+
+	_, err = s.Seal(Message{Command: []byte("command")})
+	assert.ErrorIs(t, err, ErrUnknownVersion)
+}
+
+func TestNegotiate(t *testing.T) {
+	for announced, expected := range map[int]int{0: VersionLegacy, 1: VersionLegacy, 2: VersionBase64, 3: VersionSequenced, 99: VersionLatest} {
+		assert.Equal(t, expected, Negotiate(announced), "announced %d", announced)
+	}
+}
+
+func FuzzOpen(f *testing.F) {
+	s := newTestSealer(f)
+
+	sealed, _ := s.Seal(Message{Version: VersionSequenced, Sequence: 1, Command: []byte("command")})
+	f.Add(sealed)
+	f.Add("e" + strings.Repeat("a", 40))
+
+	// Malformed envelopes must be rejected without panicking.
+	f.Fuzz(func(t *testing.T, envelope string) {
+		s.Open(envelope)
+	})
+}
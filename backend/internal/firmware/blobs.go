@@ -0,0 +1,264 @@
+package firmware
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/ConfusedPolarBear/garden/internal/config"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrBlobChecksum = errors.New("blob checksum mismatch")
+	ErrMissingBlob  = errors.New("missing blob")
+	ErrInvalidBlob  = errors.New("invalid blob")
+	ErrUnknownBlob  = errors.New("unknown blob")
+)
+
+// Directory the ESP32 blobs are extracted to.
+const blobDirectory = "data/firmware/esp32"
+
+// Largest blob archive that will be downloaded or imported.
+const maxArchiveSize = 1024 * 1024
+
+// A support file that the ESP32 needs to boot.
+type blob struct {
+	// Short name used by the import API and CLI.
+	Key  string
+	File string
+}
+
+// Known blobs in the order they are moved into place. The partition table is last as its presence means that the
+// blobs were extracted.
+var blobs = []blob{
+	{Key: "bootloader", File: "bootloader_dio_40m.bin"},
+	{Key: "boot_app0", File: "boot_app0.bin"},
+	{Key: "partitions", File: "partitions.bin"},
+}
+
+// Serializes blob imports.
+var blobLock sync.Mutex
+
+// A blob and the SHA256 checksum it must match.
+type BlobFile struct {
+	Data   []byte
+	SHA256 string
+}
+
+// Reports if a blob is installed.
+type BlobStatus struct {
+	Key     string
+	File    string
+	Present bool
+	Size    int64
+	SHA256  string
+}
+
+// Returns the short names of all blobs.
+func BlobKeys() []string {
+	keys := make([]string, len(blobs))
+	for i, b := range blobs {
+		keys[i] = b.Key
+	}
+
+	return keys
+}
+
+// Reports which ESP32 blobs are installed.
+func GetBlobStatus() []BlobStatus {
+	status := make([]BlobStatus, len(blobs))
+
+	for i, b := range blobs {
+		status[i] = BlobStatus{Key: b.Key, File: b.File}
+
+		contents, err := os.ReadFile(path.Join(blobDirectory, b.File))
+		if err != nil {
+			continue
+		}
+
+		status[i].Present = true
+		status[i].Size = int64(len(contents))
+		status[i].SHA256 = util.SHA256(contents)
+	}
+
+	return status
+}
+
+// Verifies and extracts a blob archive. If no checksum is provided, the archive must match the checksum configured in
+// esp32.hash or the checksum of the official archive. Nothing is extracted unless the archive contains every blob.
+func ImportBlobArchive(archive []byte, expected string) error {
+	if err := verifyArchive(archive, expected); err != nil {
+		return err
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidBlob, err)
+	}
+
+	files := make(map[string][]byte)
+
+	for _, compressed := range r.File {
+		// Only the base name is used to prevent directory traversal attacks
+		name := path.Base(compressed.Name)
+		if findBlob(name) == nil {
+			logrus.Tracef("[firmware] ignoring %s in blob archive", compressed.Name)
+			continue
+		}
+
+		f, err := compressed.Open()
+		if err != nil {
+			return fmt.Errorf("unable to open %s from archive: %w", name, err)
+		}
+
+		contents, err := io.ReadAll(io.LimitReader(f, maxArchiveSize))
+		f.Close()
+
+		if err != nil {
+			return fmt.Errorf("unable to extract %s: %w", name, err)
+		}
+
+		files[name] = contents
+	}
+
+	var missing []string
+	for _, b := range blobs {
+		if _, ok := files[b.File]; !ok {
+			missing = append(missing, b.File)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: archive does not contain %s", ErrMissingBlob, strings.Join(missing, ", "))
+	}
+
+	return installBlobs(files)
+}
+
+// Verifies and installs individual blobs keyed by their short name. Every blob must have a checksum.
+func ImportBlobs(files map[string]BlobFile) error {
+	verified := make(map[string][]byte)
+
+	for key, file := range files {
+		b := findBlob(key)
+		if b == nil {
+			return fmt.Errorf("%w %s", ErrUnknownBlob, key)
+		}
+
+		if file.SHA256 == "" {
+			return fmt.Errorf("%w: no checksum provided for %s", ErrBlobChecksum, key)
+		}
+
+		if actual := util.SHA256(file.Data); !strings.EqualFold(actual, file.SHA256) {
+			return fmt.Errorf("%w: expected %s for %s, actual %s", ErrBlobChecksum, file.SHA256, key, actual)
+		}
+
+		verified[b.File] = file.Data
+	}
+
+	return installBlobs(verified)
+}
+
+// Checks an archive against the provided checksum, falling back to the configured or official checksum.
+func verifyArchive(archive []byte, expected string) error {
+	if expected == "" {
+		expected = config.GetString("esp32.hash")
+	}
+
+	if expected == "" {
+		expected = defaultBlobChecksum
+	}
+
+	if actual := util.SHA256(archive); !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("%w: expected %s, actual %s", ErrBlobChecksum, expected, actual)
+	}
+
+	return nil
+}
+
+// Returns the blob with the provided short name or file name.
+func findBlob(name string) *blob {
+	for i, b := range blobs {
+		if b.Key == name || b.File == name {
+			return &blobs[i]
+		}
+	}
+
+	return nil
+}
+
+// Performs basic sanity checks on a blob's contents.
+func validateBlob(file string, contents []byte) error {
+	switch {
+	case len(contents) == 0:
+		return fmt.Errorf("%w: %s is empty", ErrInvalidBlob, file)
+
+	case file == "bootloader_dio_40m.bin" && contents[0] != imageMagic:
+		return fmt.Errorf("%w: %s is not an ESP32 image", ErrInvalidBlob, file)
+
+	// Every partition table entry starts with the magic bytes 0xAA 0x50.
+	case file == "partitions.bin" && (len(contents) < 2 || contents[0] != 0xAA || contents[1] != 0x50):
+		return fmt.Errorf("%w: %s is not a partition table", ErrInvalidBlob, file)
+	}
+
+	return nil
+}
+
+// Writes blobs keyed by file name. Every blob is written and synced to a staging directory before any of them are
+// moved into place, so a failed write never touches the installed blobs. Each rename is atomic, but the renames as a
+// whole are not: a crash part way through can leave a mix of old and new blobs.
+func installBlobs(files map[string][]byte) error {
+	for file, contents := range files {
+		if err := validateBlob(file, contents); err != nil {
+			return err
+		}
+	}
+
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	if err := os.MkdirAll(blobDirectory, 0700); err != nil {
+		return err
+	}
+
+	staging := blobDirectory + ".staging"
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(staging)
+
+	var staged []blob
+
+	for _, b := range blobs {
+		contents, ok := files[b.File]
+		if !ok {
+			continue
+		}
+
+		if err := writeAtomic(path.Join(staging, b.File), contents); err != nil {
+			return err
+		}
+
+		staged = append(staged, b)
+	}
+
+	for _, b := range staged {
+		if err := os.Rename(path.Join(staging, b.File), path.Join(blobDirectory, b.File)); err != nil {
+			return err
+		}
+
+		logrus.Debugf("[firmware] installed ESP32 blob %s", b.File)
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package firmware
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Creates a blob archive containing the provided files.
+func testArchive(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+
+	for name, contents := range files {
+		f, err := w.Create(name)
+		require.NoError(t, err)
+
+		_, err = f.Write(contents)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, w.Close())
+
+	return buf.Bytes()
+}
+
+func TestImportBlobArchive(t *testing.T) {
+	official, err := os.ReadFile("../../../esp32/esp32.zip")
+	require.NoError(t, err)
+
+	db.InitializeTestDatabase(t)
+
+	for _, status := range GetBlobStatus() {
+		assert.False(t, status.Present)
+	}
+
+	// An archive that is missing a blob must not install any of them.
+	partial := testArchive(t, map[string][]byte{
+		"bootloader_dio_40m.bin": {imageMagic, 1, 2, 3},
+		"boot_app0.bin":          {0, 0, 0, 0},
+	})
+
+	assert.ErrorIs(t, ImportBlobArchive(partial, ""), ErrBlobChecksum)
+	assert.ErrorIs(t, ImportBlobArchive(partial, util.SHA256(partial)), ErrMissingBlob)
+
+	invalid := testArchive(t, map[string][]byte{
+		"esp32/bootloader_dio_40m.bin": {imageMagic, 1, 2, 3},
+		"esp32/boot_app0.bin":          {0, 0, 0, 0},
+		"esp32/partitions.bin":         {0xff, 0xff},
+	})
+
+	assert.ErrorIs(t, ImportBlobArchive(invalid, util.SHA256(invalid)), ErrInvalidBlob)
+
+	entries, err := os.ReadDir(blobDirectory)
+	if err == nil {
+		assert.Empty(t, entries)
+	}
+
+	// The official archive is accepted without an explicit checksum.
+	require.NoError(t, ImportBlobArchive(official, ""))
+
+	for _, status := range GetBlobStatus() {
+		assert.True(t, status.Present, status.File)
+		assert.NotZero(t, status.Size)
+	}
+
+	entries, err = os.ReadDir(blobDirectory)
+	require.NoError(t, err)
+	assert.Len(t, entries, len(blobs))
+}
+
+func TestImportBlobs(t *testing.T) {
+	db.InitializeTestDatabase(t)
+
+	bootloader := []byte{imageMagic, 1, 2, 3}
+	partitions := []byte{0xAA, 0x50, 1, 2}
+
+	err := ImportBlobs(map[string]BlobFile{"bootloader": {Data: bootloader}})
+	assert.ErrorIs(t, err, ErrBlobChecksum)
+
+	err = ImportBlobs(map[string]BlobFile{"bootloader": {Data: bootloader, SHA256: util.SHA256(partitions)}})
+	assert.ErrorIs(t, err, ErrBlobChecksum)
+
+	err = ImportBlobs(map[string]BlobFile{"firmware": {Data: bootloader, SHA256: util.SHA256(bootloader)}})
+	assert.ErrorIs(t, err, ErrUnknownBlob)
+
+	err = ImportBlobs(map[string]BlobFile{"partitions": {Data: bootloader, SHA256: util.SHA256(bootloader)}})
+	assert.ErrorIs(t, err, ErrInvalidBlob)
+
+	err = ImportBlobs(map[string]BlobFile{
+		"bootloader": {Data: bootloader, SHA256: util.SHA256(bootloader)},
+		"partitions": {Data: partitions, SHA256: util.SHA256(partitions)},
+	})
+	require.NoError(t, err)
+
+	status := GetBlobStatus()
+	require.Len(t, status, 3)
+
+	for _, s := range status {
+		assert.Equal(t, s.Key != "boot_app0", s.Present, s.Key)
+	}
+
+	contents, err := os.ReadFile(path.Join(blobDirectory, "partitions.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, partitions, contents)
+}
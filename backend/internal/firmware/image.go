@@ -0,0 +1,176 @@
+package firmware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidImage    = errors.New("invalid firmware image")
+	ErrChipsetMismatch = errors.New("firmware image is for a different chipset")
+)
+
+const (
+	// First byte of every ESP8266 and ESP32 application image.
+	imageMagic = 0xE9
+
+	// Magic word at the start of the ESP32 app descriptor (esp_app_desc_t).
+	appDescriptorMagic = 0xABCD5432
+
+	// The ESP8266 image header is 8 bytes long. The ESP32 adds a 16 byte extended header.
+	esp8266HeaderSize = 8
+	esp32HeaderSize   = 24
+
+	// Size of the load address and length that precede the data of every segment.
+	segmentHeaderSize = 8
+
+	// The bootloader refuses to load images with more than 16 segments.
+	maxSegments = 16
+
+	// Prefix of the version string that the garden firmware embeds (see getAppVersion in the firmware).
+	versionMarker = "garden-version:"
+
+	// Longest version that is read from a version marker.
+	maxMarkerLength = 64
+)
+
+// Chip IDs stored in the extended header of ESP32 family images.
+var chipIds = map[uint16]string{
+	0x0000: "esp32",
+	0x0002: "esp32-s2",
+	0x0005: "esp32-c3",
+	0x0009: "esp32-s3",
+	0x000C: "esp32-c2",
+	0x000D: "esp32-c6",
+	0x0010: "esp32-h2",
+}
+
+// Information parsed from the header of a firmware image.
+type ImageInfo struct {
+	// Lowercase chipset the image was built for.
+	Chipset  string
+	Segments int
+
+	// Version that the firmware announces, read from its version marker. Falls back to the version in the app
+	// descriptor of ESP32 images that don't embed a marker.
+	Version string
+
+	// Project name from the app descriptor. Only present in ESP32 images.
+	Project string
+}
+
+// Parses and validates the header of an ESP8266 or ESP32 application image.
+func ParseImage(image []byte) (ImageInfo, error) {
+	var info ImageInfo
+
+	if len(image) < esp32HeaderSize+segmentHeaderSize {
+		return info, fmt.Errorf("%w: image is only %d bytes long", ErrInvalidImage, len(image))
+	}
+
+	if image[0] != imageMagic {
+		return info, fmt.Errorf("%w: magic byte is 0x%02X instead of 0x%02X", ErrInvalidImage, image[0], imageMagic)
+	}
+
+	info.Segments = int(image[1])
+	if info.Segments == 0 || info.Segments > maxSegments {
+		return info, fmt.Errorf("%w: image has %d segments", ErrInvalidImage, info.Segments)
+	}
+
+	// The ESP32 app descriptor is always at the start of the first segment. ESP8266 images don't have one, but their
+	// first segment is loaded into the ESP8266's RAM where the ESP32 extended header would be.
+	headerSize := esp8266HeaderSize
+
+	if len(image) >= esp32HeaderSize+segmentHeaderSize+256 &&
+		binary.LittleEndian.Uint32(image[esp32HeaderSize+segmentHeaderSize:]) == appDescriptorMagic {
+
+		id := binary.LittleEndian.Uint16(image[12:])
+		chipset, ok := chipIds[id]
+		if !ok {
+			return info, fmt.Errorf("%w: unknown chip id 0x%04X", ErrInvalidImage, id)
+		}
+
+		headerSize = esp32HeaderSize
+		info.Chipset = chipset
+
+		desc := image[esp32HeaderSize+segmentHeaderSize:]
+		info.Version = cString(desc[16:48])
+		info.Project = cString(desc[48:80])
+
+	} else if addr := binary.LittleEndian.Uint32(image[esp8266HeaderSize:]); addr >= 0x3FFE8000 && addr < 0x40300000 {
+		info.Chipset = "esp8266"
+
+	} else {
+		return info, fmt.Errorf("%w: image has no app descriptor", ErrInvalidImage)
+	}
+
+	// Every segment must fit in the image.
+	offset := headerSize
+	for i := 0; i < info.Segments; i++ {
+		if offset+segmentHeaderSize > len(image) {
+			return info, fmt.Errorf("%w: segment %d starts past the end of the image", ErrInvalidImage, i)
+		}
+
+		offset += segmentHeaderSize + int(binary.LittleEndian.Uint32(image[offset+4:]))
+		if offset > len(image) {
+			return info, fmt.Errorf("%w: segment %d ends past the end of the image", ErrInvalidImage, i)
+		}
+	}
+
+	if version := findVersionMarker(image); version != "" {
+		info.Version = version
+	}
+
+	return info, nil
+}
+
+// Returns the version following the first version marker in an image, or an empty string if there is none.
+func findVersionMarker(image []byte) string {
+	i := bytes.Index(image, []byte(versionMarker))
+	if i < 0 {
+		return ""
+	}
+
+	raw := image[i+len(versionMarker):]
+	if len(raw) > maxMarkerLength {
+		raw = raw[:maxMarkerLength]
+	}
+
+	// The version is NUL terminated and printable. A marker that isn't was found by accident.
+	end := bytes.IndexByte(raw, 0)
+	if end < 0 {
+		return ""
+	}
+
+	for _, c := range raw[:end] {
+		if c < 0x20 || c > 0x7E {
+			return ""
+		}
+	}
+
+	return string(raw[:end])
+}
+
+// Parses an image and verifies that it was built for the provided chipset.
+func validateImage(chipset string, image []byte) (ImageInfo, error) {
+	info, err := ParseImage(image)
+	if err != nil {
+		return info, err
+	}
+
+	if info.Chipset != chipset {
+		return info, fmt.Errorf("%w: expected %s, image is for %s", ErrChipsetMismatch, chipset, info.Chipset)
+	}
+
+	return info, nil
+}
+
+// Returns the contents of a fixed size, NUL padded string.
+func cString(raw []byte) string {
+	if i := bytes.IndexByte(raw, 0); i >= 0 {
+		raw = raw[:i]
+	}
+
+	return string(raw)
+}
@@ -0,0 +1,71 @@
+package firmware
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseImage(t *testing.T) {
+	info, err := ParseImage(BuildTestImage("esp32", "1.2.3"))
+	require.NoError(t, err)
+	assert.Equal(t, ImageInfo{Chipset: "esp32", Segments: 1, Version: "1.2.3", Project: "garden"}, info)
+
+	info, err = ParseImage(BuildTestImage("esp32-s3", "1.2.3"))
+	require.NoError(t, err)
+	assert.Equal(t, "esp32-s3", info.Chipset)
+
+	info, err = ParseImage(BuildTestImage("esp8266", ""))
+	require.NoError(t, err)
+	assert.Equal(t, ImageInfo{Chipset: "esp8266", Segments: 1}, info)
+
+	info, err = ParseImage(BuildTestImage("esp8266", "1.2.3"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3", info.Version)
+
+	// The version marker takes precedence over the app descriptor, which Arduino builds don't fill in.
+	image := BuildTestImage("esp32", "1.2.3")
+	copy(image[len(image)-32:], versionMarker+"2.0.0")
+	info, err = ParseImage(image)
+	require.NoError(t, err)
+	assert.Equal(t, "2.0.0", info.Version)
+
+	image = BuildTestImage("esp32", "1.2.3")
+	image[0] = 0xE8
+	_, err = ParseImage(image)
+	assert.ErrorIs(t, err, ErrInvalidImage)
+
+	image = BuildTestImage("esp32", "1.2.3")
+	image[1] = 0
+	_, err = ParseImage(image)
+	assert.ErrorIs(t, err, ErrInvalidImage)
+
+	// The image claims to have more segments than it contains.
+	image = BuildTestImage("esp8266", "")
+	image[1] = 2
+	_, err = ParseImage(image)
+	assert.ErrorIs(t, err, ErrInvalidImage)
+
+	image = BuildTestImage("esp32", "1.2.3")
+	binary.LittleEndian.PutUint16(image[12:], 0x1234)
+	_, err = ParseImage(image)
+	assert.ErrorIs(t, err, ErrInvalidImage)
+
+	_, err = ParseImage([]byte("firmware image"))
+	assert.ErrorIs(t, err, ErrInvalidImage)
+
+	_, err = validateImage("esp8266", BuildTestImage("esp32", "1.2.3"))
+	assert.ErrorIs(t, err, ErrChipsetMismatch)
+
+	_, err = validateImage("esp32", BuildTestImage("esp32-c3", "1.2.3"))
+	assert.ErrorIs(t, err, ErrChipsetMismatch)
+}
+
+func TestFindVersionMarker(t *testing.T) {
+	assert.Equal(t, "1.0", findVersionMarker([]byte("\x00garden-version:1.0\x00garden-version:2.0\x00")))
+	assert.Empty(t, findVersionMarker([]byte("garden-version:1.0")))
+	assert.Empty(t, findVersionMarker([]byte("garden-version:\x01\x02\x00")))
+	assert.Empty(t, findVersionMarker([]byte("no marker")))
+}
@@ -0,0 +1,118 @@
+package firmware
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Web flasher manifest in the format expected by ESP Web Tools.
+type Manifest struct {
+	Name                string          `json:"name"`
+	Version             string          `json:"version"`
+	NewInstallSkipErase bool            `json:"new_install_skip_erase"`
+	Builds              []ManifestBuild `json:"builds"`
+}
+
+type ManifestBuild struct {
+	ChipFamily string         `json:"chipFamily"`
+	Parts      []ManifestPart `json:"parts"`
+}
+
+// A file that is flashed at the provided offset.
+type ManifestPart struct {
+	Path   string `json:"path"`
+	Offset int    `json:"offset"`
+}
+
+// Support files that the ESP32 needs to boot and the offsets they are flashed to.
+var esp32Blobs = []ManifestPart{
+	{Path: "bootloader_dio_40m.bin", Offset: 0x1000},
+	{Path: "partitions.bin", Offset: 0x8000},
+	{Path: "boot_app0.bin", Offset: 0xE000},
+}
+
+// Offsets that the application image of each chipset is flashed to.
+var appOffsets = map[string]int{
+	"esp32":   0x10000,
+	"esp8266": 0,
+}
+
+// Generates the web flasher manifest for a stored build version. An empty version uses the default build of every
+// chipset. Chipsets without an image or with missing support files are left out. Manifests are public, so files are
+// only checked for existence: images are validated when they're uploaded and support files when they're imported.
+func BuildManifest(version string) (Manifest, error) {
+	manifest := Manifest{Name: "Garden"}
+	var versions []string
+	seen := make(map[string]bool)
+
+	for _, chipset := range []string{"esp32", "esp8266"} {
+		build, buildVersion, err := buildManifestEntry(chipset, version)
+		if err != nil {
+			logrus.Debugf("[firmware] leaving %s out of manifest: %s", chipset, err)
+			continue
+		}
+
+		manifest.Builds = append(manifest.Builds, build)
+
+		if !seen[buildVersion] {
+			seen[buildVersion] = true
+			versions = append(versions, buildVersion)
+		}
+	}
+
+	if len(manifest.Builds) == 0 {
+		return manifest, fmt.Errorf("%w: no flashable firmware for version %q", ErrMissing, version)
+	}
+
+	manifest.Version = strings.Join(versions, ", ")
+
+	return manifest, nil
+}
+
+// Returns the manifest entry and version of a chipset's build.
+func buildManifestEntry(chipset, version string) (ManifestBuild, string, error) {
+	build := ManifestBuild{ChipFamily: strings.ToUpper(chipset)}
+
+	image := defaultImagePath(chipset)
+	url := "/firmware/" + chipset + "/firmware.bin"
+	name := ""
+
+	if version != "" {
+		stored, err := GetBuild(chipset, version)
+		if err != nil {
+			return build, "", fmt.Errorf("%w: %s", ErrMissing, err)
+		}
+
+		image, url, name = BuildPath(stored), fmt.Sprintf("/fw/%d", stored.ID), stored.AppVersion()
+
+	} else if stored, err := GetBuild(chipset, ""); err == nil {
+		name = stored.AppVersion()
+	}
+
+	if _, err := os.Stat(image); err != nil {
+		return build, "", fmt.Errorf("%w: %s", ErrMissing, err)
+	}
+
+	// Default images that were copied into place by hand don't have a stored build.
+	if name == "" {
+		name = "unknown"
+	}
+
+	if chipset == "esp32" {
+		for _, blob := range esp32Blobs {
+			if _, err := os.Stat(path.Join(blobDirectory, blob.Path)); err != nil {
+				return build, "", fmt.Errorf("%w: %s", ErrMissing, err)
+			}
+
+			build.Parts = append(build.Parts, ManifestPart{Path: "/firmware/esp32/" + blob.Path, Offset: blob.Offset})
+		}
+	}
+
+	build.Parts = append(build.Parts, ManifestPart{Path: url, Offset: appOffsets[chipset]})
+
+	return build, name, nil
+}
@@ -0,0 +1,71 @@
+package firmware
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ConfusedPolarBear/garden/internal/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildManifest(t *testing.T) {
+	db.InitializeTestDatabase(t)
+
+	// Manifests are public, so building one must not create directories or download the ESP32 support files.
+	_, err := BuildManifest("")
+	assert.ErrorIs(t, err, ErrMissing)
+
+	_, err = os.Stat("data/firmware")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, os.MkdirAll("data/firmware/esp32", 0700))
+
+	_, err = StoreBuild(Upload{Chipset: "esp8266", Version: "1.0"}, BuildTestImage("esp8266", ""))
+	require.NoError(t, err)
+
+	esp32, err := StoreBuild(Upload{Chipset: "esp32", Version: "1.0"}, BuildTestImage("esp32", "1.0"))
+	require.NoError(t, err)
+
+	// The ESP32 is left out until its support files exist.
+	manifest, err := BuildManifest("")
+	require.NoError(t, err)
+	assert.Equal(t, Manifest{
+		Name:    "Garden",
+		Version: "1.0",
+		Builds: []ManifestBuild{
+			{ChipFamily: "ESP8266", Parts: []ManifestPart{{Path: "/firmware/esp8266/firmware.bin", Offset: 0}}},
+		},
+	}, manifest)
+
+	for _, blob := range esp32Blobs {
+		require.NoError(t, os.WriteFile(path.Join("data/firmware/esp32", blob.Path), []byte("blob"), 0600))
+	}
+
+	manifest, err = BuildManifest("")
+	require.NoError(t, err)
+	require.Len(t, manifest.Builds, 2)
+	assert.Equal(t, "ESP32", manifest.Builds[0].ChipFamily)
+	assert.Len(t, manifest.Builds[0].Parts, 4)
+
+	_, err = StoreBuild(Upload{Chipset: "esp32", Version: "2.0"}, BuildTestImage("esp32", "2.0"))
+	require.NoError(t, err)
+
+	manifest, err = BuildManifest("1.0")
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", manifest.Version)
+	require.Len(t, manifest.Builds, 2)
+	assert.Equal(t, ManifestPart{Path: fmt.Sprintf("/fw/%d", esp32.ID), Offset: 0x10000}, manifest.Builds[0].Parts[3])
+
+	// Only the ESP32 has a build with this version.
+	manifest, err = BuildManifest("2.0")
+	require.NoError(t, err)
+	require.Len(t, manifest.Builds, 1)
+	assert.Equal(t, "2.0", manifest.Version)
+
+	_, err = BuildManifest("3.0")
+	assert.ErrorIs(t, err, ErrMissing)
+}
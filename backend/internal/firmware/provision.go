@@ -0,0 +1,122 @@
+package firmware
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ConfusedPolarBear/garden/internal/config"
+	"github.com/ConfusedPolarBear/garden/internal/littlefs"
+)
+
+// Settings that a new system needs to join the garden. Field names match the configuration accepted over serial so
+// the setup wizard can send them as is.
+type Provisioning struct {
+	Name string `json:",omitempty"`
+
+	MeshKey        string
+	MeshController string `json:",omitempty"`
+	MeshChannel    string `json:",omitempty"`
+
+	WifiSSID     string `json:",omitempty"`
+	WifiPassword string `json:",omitempty"`
+	MQTTHost     string `json:",omitempty"`
+	MQTTUsername string `json:",omitempty"`
+	MQTTPassword string `json:",omitempty"`
+}
+
+// Location and layout of the LittleFS data partition of a chipset.
+type filesystemLayout struct {
+	Offset    int
+	Size      int
+	BlockSize int
+}
+
+// Default data partitions of the boards in platformio.ini. The ESP8266 uses the eagle.flash.4m1m.ld layout and the
+// ESP32 uses the partition table in esp32.zip. Both can be overridden in the provisioning config section.
+var filesystemLayouts = map[string]filesystemLayout{
+	"esp8266": {Offset: 0x300000, Size: 0xFA000, BlockSize: 0x2000},
+	"esp32":   {Offset: 0x290000, Size: 0x170000, BlockSize: 0x1000},
+}
+
+// Longest file name supported by the ESP8266 LittleFS port.
+const filesystemNameMax = 32
+
+// Returns the files that the firmware reads its configuration from on boot.
+func (p Provisioning) Files() map[string][]byte {
+	files := map[string][]byte{
+		"/meshKey":    []byte(p.MeshKey),
+		"/configured": []byte("true"),
+	}
+
+	add := func(name, value string) {
+		if value != "" {
+			files[name] = []byte(value)
+		}
+	}
+
+	add("/name", p.Name)
+	add("/meshController", p.MeshController)
+	add("/meshChannel", p.MeshChannel)
+	add("/wifiSSID", p.WifiSSID)
+	add("/wifiPass", p.WifiPassword)
+	add("/mqttHost", p.MQTTHost)
+
+	if p.MQTTUsername != "" {
+		add("/mqttUser", p.MQTTUsername)
+		add("/mqttPass", p.MQTTPassword)
+	}
+
+	return files
+}
+
+// Returns the data partition layout of a chipset, taking overrides from the provisioning config section into account.
+func getFilesystemLayout(chipset string) (filesystemLayout, error) {
+	layout, ok := filesystemLayouts[chipset]
+	if !ok {
+		return layout, fmt.Errorf("%w %s", ErrUnknownChipset, chipset)
+	}
+
+	layout.Offset = config.GetInt("provisioning."+chipset+"_offset", layout.Offset)
+	layout.Size = config.GetInt("provisioning."+chipset+"_size", layout.Size)
+
+	return layout, nil
+}
+
+// Builds the data partition image for a new system.
+func BuildFilesystem(chipset string, p Provisioning) ([]byte, error) {
+	chipset = strings.ToLower(chipset)
+
+	layout, err := getFilesystemLayout(chipset)
+	if err != nil {
+		return nil, err
+	}
+
+	return littlefs.Build(littlefs.Geometry{
+		BlockSize:  uint32(layout.BlockSize),
+		BlockCount: uint32(layout.Size / layout.BlockSize),
+		NameMax:    filesystemNameMax,
+	}, p.Files())
+}
+
+// Generates a web flasher manifest that installs the default builds along with a provisioned data partition. The
+// partition of each chipset is downloaded from base followed by the chipset name.
+func BuildProvisioningManifest(base string) (Manifest, error) {
+	manifest, err := BuildManifest("")
+	if err != nil {
+		return manifest, err
+	}
+
+	for i, build := range manifest.Builds {
+		chipset := strings.ToLower(build.ChipFamily)
+
+		layout, err := getFilesystemLayout(chipset)
+		if err != nil {
+			return manifest, err
+		}
+
+		part := ManifestPart{Path: base + chipset, Offset: layout.Offset}
+		manifest.Builds[i].Parts = append(build.Parts, part)
+	}
+
+	return manifest, nil
+}
@@ -0,0 +1,72 @@
+package firmware
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ConfusedPolarBear/garden/internal/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvisioningFiles(t *testing.T) {
+	files := Provisioning{
+		Name:           "greenhouse",
+		MeshKey:        "key",
+		MeshController: "AA:BB:CC:DD:EE:FF",
+		MeshChannel:    "6",
+	}.Files()
+
+	assert.Equal(t, map[string][]byte{
+		"/name":           []byte("greenhouse"),
+		"/meshKey":        []byte("key"),
+		"/meshController": []byte("AA:BB:CC:DD:EE:FF"),
+		"/meshChannel":    []byte("6"),
+		"/configured":     []byte("true"),
+	}, files)
+
+	// MQTT credentials are only written if a username was provided.
+	files = Provisioning{MeshKey: "key", WifiSSID: "garden", WifiPassword: "secret", MQTTHost: "mqtt:1883"}.Files()
+	assert.Contains(t, files, "/wifiPass")
+	assert.NotContains(t, files, "/mqttPass")
+	assert.NotContains(t, files, "/meshController")
+}
+
+func TestBuildFilesystem(t *testing.T) {
+	image, err := BuildFilesystem("ESP32", Provisioning{MeshKey: "key"})
+	require.NoError(t, err)
+	assert.Len(t, image, filesystemLayouts["esp32"].Size)
+
+	image, err = BuildFilesystem("esp8266", Provisioning{MeshKey: "key"})
+	require.NoError(t, err)
+	assert.Len(t, image, filesystemLayouts["esp8266"].Size/0x2000*0x2000)
+
+	_, err = BuildFilesystem("esp32-s2", Provisioning{})
+	assert.ErrorIs(t, err, ErrUnknownChipset)
+}
+
+func TestBuildProvisioningManifest(t *testing.T) {
+	db.InitializeTestDatabase(t)
+
+	require.NoError(t, os.MkdirAll("data/firmware/esp32", 0700))
+
+	_, err := BuildProvisioningManifest("/provision/token/filesystem/")
+	assert.ErrorIs(t, err, ErrMissing)
+
+	for _, blob := range esp32Blobs {
+		require.NoError(t, os.WriteFile(path.Join("data/firmware/esp32", blob.Path), []byte("blob"), 0600))
+	}
+
+	_, err = StoreBuild(Upload{Chipset: "esp32", Version: "1.0"}, BuildTestImage("esp32", "1.0"))
+	require.NoError(t, err)
+
+	manifest, err := BuildProvisioningManifest("/provision/token/filesystem/")
+	require.NoError(t, err)
+	require.Len(t, manifest.Builds, 1)
+
+	parts := manifest.Builds[0].Parts
+	require.Len(t, parts, 5)
+	assert.Equal(t, ManifestPart{Path: "/provision/token/filesystem/esp32", Offset: 0x290000}, parts[4])
+}
@@ -0,0 +1,248 @@
+package firmware
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/ConfusedPolarBear/garden/internal/config"
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrInvalidVersion   = errors.New("versions must start with a letter or number and contain at most 32 letters, numbers, dots, dashes or underscores")
+	ErrDuplicateVersion = errors.New("a build with this version already exists")
+	ErrChecksumMismatch = errors.New("firmware image does not match the provided checksum")
+	ErrDefaultBuild     = errors.New("the default build cannot be deleted")
+)
+
+var versionRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,31}$`)
+
+// Serializes changes to stored builds and the default firmware images.
+var storeLock sync.Mutex
+
+// Metadata of a build that is being uploaded.
+type Upload struct {
+	Chipset string
+	Version string
+	Notes   string
+
+	// Optional hex encoded SHA256 checksum that the image must match.
+	SHA256 string
+
+	// If the build should become the default for its chipset. The first build of a chipset always becomes the default.
+	Default bool
+}
+
+// Returns the path of the default firmware image of a chipset, which is served from /fw82 and /fw32.
+func defaultImagePath(chipset string) string {
+	return path.Join("data/firmware", chipset, "firmware.bin")
+}
+
+// Returns the path that a build's image is stored at.
+func BuildPath(build util.FirmwareBuild) string {
+	return path.Join("data/firmware", build.Chipset, "builds", build.Version+".bin")
+}
+
+// Stores a new firmware build. Old builds beyond the number configured in firmware.retain are deleted.
+func StoreBuild(upload Upload, image []byte) (util.FirmwareBuild, error) {
+	build := util.FirmwareBuild{
+		Chipset: strings.ToLower(upload.Chipset),
+		Version: upload.Version,
+		Notes:   upload.Notes,
+		SHA256:  util.SHA256(image),
+		MD5:     util.MD5(image),
+		Size:    int64(len(image)),
+	}
+
+	switch {
+	case !SupportedChipset(build.Chipset):
+		return build, fmt.Errorf("%w %s", ErrUnknownChipset, upload.Chipset)
+
+	case !versionRegex.MatchString(build.Version):
+		return build, ErrInvalidVersion
+
+	case upload.SHA256 != "" && !strings.EqualFold(upload.SHA256, build.SHA256):
+		return build, ErrChecksumMismatch
+	}
+
+	info, err := validateImage(build.Chipset, image)
+	if err != nil {
+		return build, err
+	}
+
+	build.ImageVersion = info.Version
+
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	if _, err := db.GetFirmwareBuildByVersion(build.Chipset, build.Version); err == nil {
+		return build, ErrDuplicateVersion
+	}
+
+	if err := writeAtomic(BuildPath(build), image); err != nil {
+		return build, err
+	}
+
+	if err := db.CreateFirmwareBuild(&build); err != nil {
+		os.Remove(BuildPath(build))
+		return build, err
+	}
+
+	logrus.Printf("[firmware] stored %s build %s (%d bytes, sha256 %s)", build.Chipset, build.Version, build.Size, build.SHA256)
+
+	if _, err := db.GetDefaultFirmwareBuild(build.Chipset); err != nil || upload.Default {
+		if err := setDefault(build); err != nil {
+			return build, err
+		}
+
+		build.Default = true
+	}
+
+	pruneBuilds(build.Chipset)
+
+	return build, nil
+}
+
+// Makes a build the default for its chipset.
+func SetDefaultBuild(id uint) (util.FirmwareBuild, error) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	build, err := db.GetFirmwareBuild(id)
+	if err != nil {
+		return build, err
+	}
+
+	if err := setDefault(build); err != nil {
+		return build, err
+	}
+
+	build.Default = true
+
+	return build, nil
+}
+
+// Deletes a build and its image. The default build can't be deleted.
+func DeleteBuild(id uint) error {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	build, err := db.GetFirmwareBuild(id)
+	if err != nil {
+		return err
+	}
+
+	return deleteBuild(build)
+}
+
+// Returns a stored build by version. An empty version returns the default build.
+func GetBuild(chipset, version string) (util.FirmwareBuild, error) {
+	chipset = strings.ToLower(chipset)
+
+	if version == "" {
+		return db.GetDefaultFirmwareBuild(chipset)
+	}
+
+	return db.GetFirmwareBuildByVersion(chipset, version)
+}
+
+// Copies a build's image over the default image of its chipset and marks it as the default. Must be called with the
+// store lock held.
+func setDefault(build util.FirmwareBuild) error {
+	image, err := os.ReadFile(BuildPath(build))
+	if err != nil {
+		return err
+	}
+
+	if err := writeAtomic(defaultImagePath(build.Chipset), image); err != nil {
+		return err
+	}
+
+	if err := db.SetDefaultFirmwareBuild(build.ID); err != nil {
+		return err
+	}
+
+	logrus.Printf("[firmware] %s build %s is now the default", build.Chipset, build.Version)
+
+	return nil
+}
+
+// Must be called with the store lock held.
+func deleteBuild(build util.FirmwareBuild) error {
+	if build.Default {
+		return ErrDefaultBuild
+	}
+
+	if err := db.DeleteFirmwareBuild(build.ID); err != nil {
+		return err
+	}
+
+	if err := os.Remove(BuildPath(build)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logrus.Warnf("[firmware] unable to delete %s: %s", BuildPath(build), err)
+	}
+
+	logrus.Printf("[firmware] deleted %s build %s", build.Chipset, build.Version)
+
+	return nil
+}
+
+// Deletes the oldest builds of a chipset so that at most firmware.retain builds are kept. The default build is always
+// kept. Must be called with the store lock held.
+func pruneBuilds(chipset string) {
+	retain := config.GetInt("firmware.retain", 10)
+	if retain <= 0 {
+		return
+	}
+
+	kept := 0
+	for _, build := range db.GetFirmwareBuilds(chipset) {
+		if build.Default || kept < retain {
+			kept++
+			continue
+		}
+
+		if err := deleteBuild(build); err != nil {
+			logrus.Warnf("[firmware] unable to prune %s build %s: %s", chipset, build.Version, err)
+		}
+	}
+}
+
+// Writes a file to a temporary location and renames it into place so that a partially written file is never served.
+func writeAtomic(dst string, data []byte) error {
+	if err := os.MkdirAll(path.Dir(dst), 0700); err != nil {
+		return err
+	}
+
+	tmp := dst + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	// Removing the temporary file after a successful rename fails harmlessly.
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, dst)
+}
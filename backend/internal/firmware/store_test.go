@@ -0,0 +1,71 @@
+package firmware
+
+import (
+	"os"
+	"testing"
+
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreBuild(t *testing.T) {
+	db.InitializeTestDatabase(t)
+
+	v1, v2 := BuildTestImage("esp32", "1.0"), BuildTestImage("esp32", "2.0")
+
+	_, err := StoreBuild(Upload{Chipset: "esp32", Version: "../1.0"}, v1)
+	assert.ErrorIs(t, err, ErrInvalidVersion)
+
+	_, err = StoreBuild(Upload{Chipset: "esp32", Version: "1.0", SHA256: util.SHA256(v2)}, v1)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+
+	_, err = StoreBuild(Upload{Chipset: "esp8266", Version: "1.0"}, v1)
+	assert.ErrorIs(t, err, ErrChipsetMismatch)
+
+	// The first build of a chipset becomes the default.
+	first, err := StoreBuild(Upload{Chipset: "ESP32", Version: "1.0", SHA256: util.SHA256(v1)}, v1)
+	require.NoError(t, err)
+	assert.True(t, first.Default)
+	assert.Equal(t, util.MD5(v1), first.MD5)
+	assert.Equal(t, "1.0", first.ImageVersion)
+
+	_, err = StoreBuild(Upload{Chipset: "esp32", Version: "1.0"}, v2)
+	assert.ErrorIs(t, err, ErrDuplicateVersion)
+
+	second, err := StoreBuild(Upload{Chipset: "esp32", Version: "2.0", Default: true}, v2)
+	require.NoError(t, err)
+	assert.True(t, second.Default)
+
+	current, err := os.ReadFile(defaultImagePath("esp32"))
+	require.NoError(t, err)
+	assert.Equal(t, v2, current)
+
+	opts := UpdateOptions{SSID: "garden", PSK: "password", Host: "192.168.1.2:8081", Version: "1.0"}
+	update, err := BuildUpdate("ESP32", opts)
+	require.NoError(t, err)
+	assert.Equal(t, "192.168.1.2:8081/fw/1", update.URL)
+	assert.Equal(t, util.MD5(v1), update.Checksum)
+
+	opts.CurrentVersion = "1.0"
+	_, err = BuildUpdate("ESP32", opts)
+	assert.ErrorIs(t, err, ErrSameVersion)
+
+	opts.Version = "3.0"
+	_, err = BuildUpdate("ESP32", opts)
+	assert.ErrorIs(t, err, ErrMissing)
+
+	// Roll back to the first build.
+	assert.ErrorIs(t, DeleteBuild(second.ID), ErrDefaultBuild)
+	_, err = SetDefaultBuild(first.ID)
+	require.NoError(t, err)
+
+	current, err = os.ReadFile(defaultImagePath("esp32"))
+	require.NoError(t, err)
+	assert.Equal(t, v1, current)
+
+	require.NoError(t, DeleteBuild(second.ID))
+	assert.NoFileExists(t, BuildPath(second))
+}
@@ -0,0 +1,48 @@
+package firmware
+
+import "encoding/binary"
+
+// Builds a minimal single segment image for the provided chipset. ESP32 images embed the provided version in their app
+// descriptor and ESP8266 images embed it in a version marker. Used by the tests of packages that handle firmware.
+func BuildTestImage(chipset, version string) []byte {
+	if chipset == "esp8266" {
+		data := make([]byte, 32)
+		if version != "" {
+			copy(data, versionMarker+version)
+		}
+
+		image := []byte{imageMagic, 1, 0, 0, 0, 0, 0x10, 0x40}
+		image = appendUint32(image, 0x40100000)
+		image = appendUint32(image, uint32(len(data)))
+
+		return append(image, data...)
+	}
+
+	var id uint16
+	for chip, name := range chipIds {
+		if name == chipset {
+			id = chip
+		}
+	}
+
+	header := make([]byte, esp32HeaderSize)
+	header[0], header[1] = imageMagic, 1
+	binary.LittleEndian.PutUint16(header[12:], id)
+
+	desc := make([]byte, 256)
+	binary.LittleEndian.PutUint32(desc, appDescriptorMagic)
+	copy(desc[16:48], version)
+	copy(desc[48:80], "garden")
+
+	image := appendUint32(header, 0x3F400020)
+	image = appendUint32(image, uint32(len(desc)))
+
+	return append(image, desc...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	raw := make([]byte, 4)
+	binary.LittleEndian.PutUint32(raw, v)
+
+	return append(b, raw...)
+}
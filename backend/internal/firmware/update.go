@@ -0,0 +1,166 @@
+package firmware
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrUnknownChipset = errors.New("unknown chipset")
+	ErrInvalidNetwork = errors.New("ssid or psk are invalid")
+	ErrMissing        = errors.New("firmware not found")
+	ErrUnknownError   = errors.New("unknown forced error type")
+	ErrSameVersion    = errors.New("system already runs this version")
+)
+
+// Command that tells a system to download and install a firmware update.
+type Update struct {
+	Command  string
+	SSID     string `json:"S"`
+	PSK      string `json:"P"`
+	URL      string `json:"U"`
+	Size     int64  `json:"L"`
+	Checksum string `json:"C"`
+}
+
+// Settings used to build an update.
+type UpdateOptions struct {
+	// Wi-Fi network the system connects to while downloading the update.
+	SSID, PSK string
+
+	// Host (and optional port) of this server as reachable by systems.
+	Host string
+
+	// Version of a stored build to send. Optional, defaults to the default build of the chipset.
+	Version string
+
+	// Firmware version the system announced. Updates to the same version are refused. Optional.
+	CurrentVersion string
+
+	// Deliberately breaks the update to test error handling. One of ssid, psk, host, url, size or checksum.
+	ForceError string
+}
+
+// Returns true if the provided chipset (in lowercase) has firmware served by this server.
+func SupportedChipset(chipset string) bool {
+	return chipset == "esp8266" || chipset == "esp32"
+}
+
+// Builds the update command for a system with the provided chipset from the requested build, or the default firmware
+// binary if no version was requested.
+func BuildUpdate(chipset string, opts UpdateOptions) (Update, error) {
+	update := Update{Command: "Update", SSID: opts.SSID, PSK: opts.PSK}
+
+	chipset = strings.ToLower(chipset)
+	if !SupportedChipset(chipset) {
+		return update, fmt.Errorf("%w %s", ErrUnknownChipset, chipset)
+	}
+
+	if update.SSID == "" || len(update.SSID) > 32 || update.PSK == "" || len(update.PSK) > 64 {
+		return update, ErrInvalidNetwork
+	}
+
+	host := opts.Host
+	if opts.ForceError == "host" {
+		host = "127.0.0.1:6969"
+	}
+
+	host = strings.TrimSuffix(host, "/")
+
+	// Construct the short firmware download URL to use.
+	shortCode := "fw32"
+	if chipset == "esp8266" {
+		shortCode = "fw82"
+	}
+
+	// Read the firmware binary to get its length & checksum.
+	fw := defaultImagePath(chipset)
+
+	// The default image is usually a copy of the default build, but it can also be replaced by hand.
+	build, err := GetBuild(chipset, opts.Version)
+
+	if opts.Version != "" {
+		if err != nil {
+			return update, fmt.Errorf("%w: no %s build with version %s", ErrMissing, chipset, opts.Version)
+		}
+
+		fw = BuildPath(build)
+		shortCode = fmt.Sprintf("fw/%d", build.ID)
+	}
+
+	f, err := os.Open(fw)
+	if err != nil {
+		return update, fmt.Errorf("%w: %s", ErrMissing, err)
+	}
+
+	defer f.Close()
+
+	// Calculate the checksum with MD5 (terrible, but it's the best algorithm natively supported).
+	contents, err := io.ReadAll(f)
+	if err != nil {
+		return update, fmt.Errorf("%w: %s", ErrMissing, err)
+	}
+
+	// Never send an image that wouldn't boot on the system.
+	info, err := validateImage(chipset, contents)
+	if err != nil {
+		return update, err
+	}
+
+	version := info.Version
+	if version == "" && build.MD5 == util.MD5(contents) {
+		version = build.AppVersion()
+	}
+
+	if version != "" && version == opts.CurrentVersion {
+		return update, fmt.Errorf("%w %s", ErrSameVersion, version)
+	}
+
+	update.Size = int64(len(contents))
+	update.Checksum = util.MD5(contents)
+
+	if opts.ForceError == "url" {
+		shortCode = "dead"
+	}
+
+	update.URL = fmt.Sprintf("%s/%s", host, shortCode)
+
+	// If a forced error was requested it, make it happen
+	if opts.ForceError != "" {
+		logrus.Errorf("[firmware] injecting %s error in update", opts.ForceError)
+
+		random := hex.EncodeToString(util.SecureRandom(16))
+
+		switch opts.ForceError {
+		case "ssid":
+			update.SSID = random
+
+		case "psk":
+			update.PSK = random
+
+		case "host", "url":
+			// handled above
+
+		case "size":
+			update.Size /= 2
+
+		case "checksum":
+			update.Checksum = random
+
+		default:
+			return update, fmt.Errorf("%w %s", ErrUnknownError, opts.ForceError)
+		}
+	}
+
+	logrus.Debugf("[firmware] set OTA url to %s (used host %s)", update.URL, host)
+
+	return update, nil
+}
@@ -0,0 +1,83 @@
+package firmware
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildUpdate(t *testing.T) {
+	db.InitializeTestDatabase(t)
+
+	image := BuildTestImage("esp8266", "")
+	require.NoError(t, os.MkdirAll("data/firmware/esp8266", 0700))
+	require.NoError(t, os.WriteFile(path.Join("data/firmware/esp8266", "firmware.bin"), image, 0600))
+
+	opts := UpdateOptions{SSID: "garden", PSK: "password", Host: "192.168.1.2:8081/"}
+
+	update, err := BuildUpdate("ESP8266", opts)
+	require.NoError(t, err)
+	assert.Equal(t, Update{
+		Command:  "Update",
+		SSID:     "garden",
+		PSK:      "password",
+		URL:      "192.168.1.2:8081/fw82",
+		Size:     int64(len(image)),
+		Checksum: util.MD5(image),
+	}, update)
+
+	_, err = BuildUpdate("ESP32", opts)
+	assert.ErrorIs(t, err, ErrMissing)
+
+	_, err = BuildUpdate("ESP32-S2", opts)
+	assert.ErrorIs(t, err, ErrUnknownChipset)
+
+	_, err = BuildUpdate("ESP8266", UpdateOptions{SSID: "garden"})
+	assert.ErrorIs(t, err, ErrInvalidNetwork)
+
+	opts.ForceError = "size"
+	update, err = BuildUpdate("ESP8266", opts)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(image)/2), update.Size)
+
+	// Images for a different chipset are never sent.
+	require.NoError(t, os.WriteFile(path.Join("data/firmware/esp8266", "firmware.bin"), BuildTestImage("esp32", "2.0.0"), 0600))
+	_, err = BuildUpdate("ESP8266", UpdateOptions{SSID: "garden", PSK: "password"})
+	assert.ErrorIs(t, err, ErrChipsetMismatch)
+	require.NoError(t, os.WriteFile(path.Join("data/firmware/esp8266", "firmware.bin"), image, 0600))
+
+	require.NoError(t, os.MkdirAll("data/firmware/esp32", 0700))
+	require.NoError(t, os.WriteFile(path.Join("data/firmware/esp32", "firmware.bin"), BuildTestImage("esp32", "2.0.0"), 0600))
+
+	_, err = BuildUpdate("ESP32", UpdateOptions{SSID: "garden", PSK: "password", CurrentVersion: "2.0.0"})
+	assert.ErrorIs(t, err, ErrSameVersion)
+
+	_, err = BuildUpdate("ESP32", UpdateOptions{SSID: "garden", PSK: "password", CurrentVersion: "1.0.0"})
+	assert.NoError(t, err)
+
+	// Images without a version marker are expected to announce the version they were stored as.
+	stored, err := StoreBuild(Upload{Chipset: "esp8266", Version: "3.0.0"}, image)
+	require.NoError(t, err)
+	require.True(t, stored.Default)
+	assert.Equal(t, "3.0.0", stored.AppVersion())
+
+	_, err = BuildUpdate("ESP8266", UpdateOptions{SSID: "garden", PSK: "password", CurrentVersion: "3.0.0"})
+	assert.ErrorIs(t, err, ErrSameVersion)
+
+	// A hand placed default image doesn't inherit the version of the default build.
+	require.NoError(t, os.WriteFile(path.Join("data/firmware/esp8266", "firmware.bin"), BuildTestImage("esp8266", "4.0.0"), 0600))
+	_, err = BuildUpdate("ESP8266", UpdateOptions{SSID: "garden", PSK: "password", CurrentVersion: "3.0.0"})
+	assert.NoError(t, err)
+	_, err = BuildUpdate("ESP8266", UpdateOptions{SSID: "garden", PSK: "password", CurrentVersion: "4.0.0"})
+	assert.ErrorIs(t, err, ErrSameVersion)
+
+	opts.ForceError = "bogus"
+	_, err = BuildUpdate("ESP8266", opts)
+	assert.ErrorIs(t, err, ErrUnknownError)
+}
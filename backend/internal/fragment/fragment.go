@@ -0,0 +1,196 @@
+// Package fragment implements the wire format used to split MQTT messages into ESP-NOW sized fragments.
+//
+// Mesh clients can't publish to MQTT directly. Instead, they split the MQTT topic and payload into fragments which
+// are broadcast over ESP-NOW until they reach the coordinator, which publishes each fragment to the
+// garden/module/<coordinator>/tele/packet topic unmodified. Every fragment has the following layout:
+//
+//	| Index   | Description    |
+//	|---------|----------------|
+//	| 0 - 3   | Correlation ID |
+//	| 4       | Fragment number|
+//	| 5       | Total fragments|
+//	| 6 - end | Data           |
+//
+// Correlation IDs are random big endian 32 bit unsigned integers generated by the node that created the message.
+// They are used by the backend server to group fragments of the same message together.
+//
+// Fragment numbers and the total number of fragments start at 1 and can go up to 255. Concatenating the data of each
+// fragment in order produces the message, which is the original MQTT topic, the byte 0x01, and the MQTT payload.
+//
+// The firmware sends fixed size buffers, so the final fragment may be padded with NUL bytes. As there is no length
+// field, messages can't end with a NUL byte.
+package fragment
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// Size of the fragment header.
+	HeaderSize = 6
+
+	// Maximum number of data bytes in a fragment. ESP-NOW packets are limited to 250 bytes and the firmware reserves
+	// the remainder for the HMAC.
+	MaxDataSize = 210
+
+	// Maximum size of a fragment, including the header.
+	MaxSize = HeaderSize + MaxDataSize
+
+	// Maximum number of fragments in a message.
+	MaxFragments = 255
+
+	// Maximum size of a message, including the topic and separator.
+	MaxMessageSize = MaxDataSize * MaxFragments
+
+	// Separates the topic from the payload in a message.
+	separator = 0x01
+)
+
+var (
+	ErrTooShort      = errors.New("fragment is shorter than the header")
+	ErrTooLong       = errors.New("fragment is longer than the maximum fragment size")
+	ErrInvalidNumber = errors.New("fragment number or total is out of range")
+	ErrShortFragment = errors.New("only the final fragment can be shorter than the maximum size")
+	ErrNoSeparator   = errors.New("message does not contain a topic separator")
+	ErrInvalidTopic  = errors.New("topic is empty or contains control characters")
+	ErrTrailingNul   = errors.New("message can't end with a NUL byte")
+	ErrTooLarge      = errors.New("message is too large to be fragmented")
+)
+
+// A single fragment of a message.
+type Fragment struct {
+	Correlation uint32
+
+	// Fragment number, starting at 1.
+	Number uint8
+
+	// Total number of fragments in the message.
+	Total uint8
+
+	// Part of the message carried by this fragment. Any padding is removed by Decode.
+	Data []byte
+}
+
+// Returns the correlation ID formatted as a hex string.
+func (f Fragment) CorrelationID() string {
+	return fmt.Sprintf("%08x", f.Correlation)
+}
+
+// Returns true if this is the last fragment of the message.
+func (f Fragment) Final() bool {
+	return f.Number == f.Total
+}
+
+// Parses and validates a raw fragment. The returned fragment's data does not alias raw.
+func Decode(raw []byte) (Fragment, error) {
+	var f Fragment
+
+	if len(raw) < HeaderSize {
+		return f, ErrTooShort
+	} else if len(raw) > MaxSize {
+		return f, ErrTooLong
+	}
+
+	f.Correlation = binary.BigEndian.Uint32(raw[:4])
+	f.Number = raw[4]
+	f.Total = raw[5]
+
+	if f.Total == 0 || f.Number == 0 || f.Number > f.Total {
+		return f, ErrInvalidNumber
+	}
+
+	data := raw[HeaderSize:]
+
+	// Only the final fragment can contain padding as every other fragment is completely filled.
+	if f.Final() {
+		data = bytes.TrimRight(data, "\x00")
+	} else if len(data) != MaxDataSize {
+		return f, ErrShortFragment
+	}
+
+	f.Data = append([]byte{}, data...)
+
+	return f, nil
+}
+
+// Encodes a fragment into its wire format.
+func (f Fragment) Encode() []byte {
+	raw := make([]byte, HeaderSize, HeaderSize+len(f.Data))
+
+	binary.BigEndian.PutUint32(raw, f.Correlation)
+	raw[4] = f.Number
+	raw[5] = f.Total
+
+	return append(raw, f.Data...)
+}
+
+// Splits an MQTT message into fragments that share the provided correlation ID.
+func Split(correlation uint32, topic string, payload []byte) ([]Fragment, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+
+	message := make([]byte, 0, len(topic)+1+len(payload))
+	message = append(message, topic...)
+	message = append(message, separator)
+	message = append(message, payload...)
+
+	if message[len(message)-1] == 0x00 {
+		return nil, ErrTrailingNul
+	} else if len(message) > MaxMessageSize {
+		return nil, ErrTooLarge
+	}
+
+	total := (len(message) + MaxDataSize - 1) / MaxDataSize
+	fragments := make([]Fragment, 0, total)
+
+	for i := 0; i < total; i++ {
+		end := (i + 1) * MaxDataSize
+		if end > len(message) {
+			end = len(message)
+		}
+
+		fragments = append(fragments, Fragment{
+			Correlation: correlation,
+			Number:      uint8(i + 1),
+			Total:       uint8(total),
+			Data:        message[i*MaxDataSize : end],
+		})
+	}
+
+	return fragments, nil
+}
+
+// Separates a reassembled message into its MQTT topic and payload. The payload is binary safe and may contain the
+// separator byte.
+func Join(message []byte) (topic string, payload []byte, err error) {
+	i := bytes.IndexByte(message, separator)
+	if i < 0 {
+		return "", nil, ErrNoSeparator
+	}
+
+	topic = string(message[:i])
+	if err := validateTopic(topic); err != nil {
+		return "", nil, err
+	}
+
+	return topic, message[i+1:], nil
+}
+
+// Topics must be non-empty and can't contain control characters, which includes the separator.
+func validateTopic(topic string) error {
+	if topic == "" {
+		return ErrInvalidTopic
+	}
+
+	for _, c := range []byte(topic) {
+		if c < 0x20 || c == 0x7f {
+			return ErrInvalidTopic
+		}
+	}
+
+	return nil
+}
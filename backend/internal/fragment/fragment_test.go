@@ -0,0 +1,174 @@
+package fragment
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func header(correlation uint32, number, total uint8) []byte {
+	return Fragment{Correlation: correlation, Number: number, Total: total}.Encode()
+}
+
+func TestDecode(t *testing.T) {
+	full := append(header(0xdeadbeef, 1, 2), bytes.Repeat([]byte{'a'}, MaxDataSize)...)
+	padded := append(header(0xdeadbeef, 2, 2), 'b', 0x01, 0x00, 'c', 0x00, 0x00)
+
+	tests := []struct {
+		name     string
+		raw      []byte
+		expected Fragment
+		err      error
+	}{
+		{
+			name:     "full fragment",
+			raw:      full,
+			expected: Fragment{Correlation: 0xdeadbeef, Number: 1, Total: 2, Data: full[HeaderSize:]},
+		},
+		{
+			name:     "padded final fragment",
+			raw:      padded,
+			expected: Fragment{Correlation: 0xdeadbeef, Number: 2, Total: 2, Data: []byte{'b', 0x01, 0x00, 'c'}},
+		},
+		{
+			// The correlation ID was previously truncated to its first three bytes.
+			name:     "correlation uses all four bytes",
+			raw:      append(header(0x01020304, 1, 1), 'x'),
+			expected: Fragment{Correlation: 0x01020304, Number: 1, Total: 1, Data: []byte{'x'}},
+		},
+		{name: "empty", raw: nil, err: ErrTooShort},
+		{name: "truncated header", raw: []byte{1, 2, 3, 4, 1}, err: ErrTooShort},
+		{name: "too long", raw: append(full, 'a'), err: ErrTooLong},
+		{name: "zero number", raw: header(1, 0, 1), err: ErrInvalidNumber},
+		{name: "zero total", raw: header(1, 1, 0), err: ErrInvalidNumber},
+		{name: "number after total", raw: header(1, 3, 2), err: ErrInvalidNumber},
+		{name: "short fragment", raw: append(header(1, 1, 2), 'a'), err: ErrShortFragment},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := Decode(test.raw)
+			if test.err != nil {
+				assert.ErrorIs(t, err, test.err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+			assert.Equal(t, "deadbeef", Fragment{Correlation: 0xdeadbeef}.CorrelationID())
+		})
+	}
+}
+
+func TestSplit(t *testing.T) {
+	topic := "garden/module/1234567890ab/tele/data"
+
+	// Binary payloads can contain the separator and NUL bytes.
+	payload := bytes.Repeat([]byte{0x00, 0x01, 0xff}, 200)
+	payload = append(payload, 'z')
+
+	fragments, err := Split(42, topic, payload)
+	require.NoError(t, err)
+	require.Len(t, fragments, 4)
+
+	var message []byte
+	for i, f := range fragments {
+		decoded, err := Decode(f.Encode())
+		require.NoError(t, err)
+		assert.Equal(t, f, decoded)
+		assert.Equal(t, uint8(i+1), decoded.Number)
+		assert.Equal(t, uint8(4), decoded.Total)
+
+		message = append(message, decoded.Data...)
+	}
+
+	actualTopic, actualPayload, err := Join(message)
+	require.NoError(t, err)
+	assert.Equal(t, topic, actualTopic)
+	assert.Equal(t, payload, actualPayload)
+}
+
+func TestSplitErrors(t *testing.T) {
+	_, err := Split(1, "", []byte("a"))
+	assert.ErrorIs(t, err, ErrInvalidTopic)
+
+	_, err = Split(1, "a\x01b", []byte("a"))
+	assert.ErrorIs(t, err, ErrInvalidTopic)
+
+	_, err = Split(1, "topic", []byte{'a', 0x00})
+	assert.ErrorIs(t, err, ErrTrailingNul)
+
+	_, err = Split(1, "topic", bytes.Repeat([]byte{'a'}, MaxMessageSize))
+	assert.ErrorIs(t, err, ErrTooLarge)
+
+	// The largest possible message must fit in exactly MaxFragments fragments.
+	fragments, err := Split(1, "topic", bytes.Repeat([]byte{'a'}, MaxMessageSize-len("topic")-1))
+	require.NoError(t, err)
+	assert.Len(t, fragments, MaxFragments)
+}
+
+func TestJoinErrors(t *testing.T) {
+	_, _, err := Join([]byte("no separator"))
+	assert.ErrorIs(t, err, ErrNoSeparator)
+
+	_, _, err = Join([]byte("\x01payload"))
+	assert.ErrorIs(t, err, ErrInvalidTopic)
+
+	_, _, err = Join([]byte("bad\x00topic\x01payload"))
+	assert.ErrorIs(t, err, ErrInvalidTopic)
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add(append(header(0xdeadbeef, 1, 1), "topic\x01payload"...))
+	f.Add(header(0, 0, 0))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		decoded, err := Decode(raw)
+		if err != nil {
+			return
+		}
+
+		if decoded.Number == 0 || decoded.Number > decoded.Total || len(decoded.Data) > MaxDataSize {
+			t.Fatalf("decoded invalid fragment %+v", decoded)
+		}
+
+		// Re-encoding a decoded fragment must produce the original bytes, minus any padding.
+		if !bytes.HasPrefix(raw, decoded.Encode()) {
+			t.Fatalf("re-encoding %x produced %x", raw, decoded.Encode())
+		}
+	})
+}
+
+func FuzzSplitJoin(f *testing.F) {
+	f.Add(uint32(0), "garden/module/discovery/1234567890ab", []byte(`{"CV":"1.0.0"}`))
+	f.Add(uint32(0xffffffff), "t", []byte{0x01, 0x00, 0x01})
+
+	f.Fuzz(func(t *testing.T, correlation uint32, topic string, payload []byte) {
+		fragments, err := Split(correlation, topic, payload)
+		if err != nil {
+			return
+		}
+
+		var message []byte
+		for _, fragment := range fragments {
+			decoded, err := Decode(fragment.Encode())
+			if err != nil {
+				t.Fatalf("unable to decode fragment %+v: %s", fragment, err)
+			}
+
+			message = append(message, decoded.Data...)
+		}
+
+		actualTopic, actualPayload, err := Join(message)
+		if err != nil {
+			t.Fatalf("unable to join message: %s", err)
+		}
+
+		if actualTopic != topic || !bytes.Equal(actualPayload, payload) {
+			t.Fatalf("round trip of %q %x produced %q %x", topic, payload, actualTopic, actualPayload)
+		}
+	})
+}
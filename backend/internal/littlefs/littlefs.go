@@ -0,0 +1,170 @@
+// Package littlefs builds LittleFS (v2) filesystem images containing small files. Every file is stored inline in the
+// root directory's metadata pair, which is enough for the configuration files that garden systems read on boot.
+package littlefs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrInvalidGeometry = errors.New("invalid filesystem geometry")
+	ErrInvalidName     = errors.New("invalid file name")
+	ErrTooLarge        = errors.New("files do not fit in the root directory")
+)
+
+// On disk version 2.0, which every LittleFS v2 release can mount.
+const diskVersion = 0x00020000
+
+const (
+	typeReg          = 0x001
+	typeSuperblock   = 0x0ff
+	typeCreate       = 0x401
+	typeInlineStruct = 0x201
+	typeCRC          = 0x500
+
+	// Largest size a single tag can describe. 0x3ff marks deleted tags.
+	maxTagSize = 0x3fe
+
+	// Commits are padded to a multiple of this so that they end on a program boundary for any prog_size up to it.
+	commitAlignment = 256
+)
+
+// Layout of the flash partition that the image is written to. Must match the configuration used by the firmware.
+type Geometry struct {
+	BlockSize  uint32
+	BlockCount uint32
+
+	// Maximum file name length. Mounting fails if this is larger than the firmware's limit.
+	NameMax uint32
+}
+
+// Size of the partition in bytes.
+func (g Geometry) Size() int {
+	return int(g.BlockSize * g.BlockCount)
+}
+
+// Builds a filesystem image containing the provided files in the root directory. File names may start with a slash.
+func Build(geometry Geometry, files map[string][]byte) ([]byte, error) {
+	if geometry.BlockSize < 512 || geometry.BlockSize%commitAlignment != 0 || geometry.BlockCount < 2 {
+		return nil, ErrInvalidGeometry
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		trimmed := strings.TrimPrefix(name, "/")
+		if trimmed == "" || strings.Contains(trimmed, "/") || uint32(len(trimmed)) > geometry.NameMax {
+			return nil, fmt.Errorf("%w %q", ErrInvalidName, name)
+		}
+
+		if len(files[name]) > maxTagSize {
+			return nil, fmt.Errorf("%w: %s is %d bytes long", ErrTooLarge, name, len(files[name]))
+		}
+
+		names = append(names, name)
+	}
+
+	// Directory entries are kept in name order.
+	sort.Slice(names, func(i, j int) bool {
+		return strings.TrimPrefix(names[i], "/") < strings.TrimPrefix(names[j], "/")
+	})
+
+	superblock := make([]byte, 24)
+	binary.LittleEndian.PutUint32(superblock[0:], diskVersion)
+	binary.LittleEndian.PutUint32(superblock[4:], geometry.BlockSize)
+	binary.LittleEndian.PutUint32(superblock[8:], geometry.BlockCount)
+	binary.LittleEndian.PutUint32(superblock[12:], geometry.NameMax)
+	binary.LittleEndian.PutUint32(superblock[16:], 0x7fffffff)
+	binary.LittleEndian.PutUint32(superblock[20:], 1022)
+
+	c := newCommit(1)
+	c.tag(typeCreate, 0, nil)
+	c.tag(typeSuperblock, 0, []byte("littlefs"))
+	c.tag(typeInlineStruct, 0, superblock)
+
+	// The superblock has id 0, files in the root directory follow it.
+	for i, name := range names {
+		id := uint32(i + 1)
+
+		c.tag(typeCreate, id, nil)
+		c.tag(typeReg, id, []byte(strings.TrimPrefix(name, "/")))
+		c.tag(typeInlineStruct, id, files[name])
+	}
+
+	block := c.finish()
+	if len(block) > int(geometry.BlockSize) {
+		return nil, fmt.Errorf("%w: metadata is %d bytes long", ErrTooLarge, len(block))
+	}
+
+	// Unused space is left in the erased state. Only the first block of the superblock pair is written.
+	image := bytes.Repeat([]byte{0xff}, geometry.Size())
+	copy(image, block)
+
+	return image, nil
+}
+
+// A single commit to a metadata block.
+type commit struct {
+	buf  bytes.Buffer
+	crc  uint32
+	ptag uint32
+}
+
+func newCommit(revision uint32) *commit {
+	c := &commit{crc: 0xffffffff, ptag: 0xffffffff}
+
+	rev := make([]byte, 4)
+	binary.LittleEndian.PutUint32(rev, revision)
+	c.write(rev)
+
+	return c
+}
+
+// Appends a tag and its data. Tags are stored big endian and XORed with the previous tag.
+func (c *commit) tag(kind, id uint32, data []byte) {
+	tag := kind<<20 | id<<10 | uint32(len(data))
+
+	raw := make([]byte, 4)
+	binary.BigEndian.PutUint32(raw, tag^c.ptag)
+	c.write(raw)
+	c.write(data)
+
+	c.ptag = tag
+}
+
+// Appends the CRC tag, padded so that the commit ends on an aligned offset, and returns the block contents.
+func (c *commit) finish() []byte {
+	end := (c.buf.Len() + 8 + commitAlignment - 1) / commitAlignment * commitAlignment
+
+	// The padding is part of the CRC tag. The first byte after the commit is erased, so the valid bit isn't flipped.
+	tag := uint32(typeCRC)<<20 | 0x3ff<<10 | uint32(end-c.buf.Len()-4)
+
+	raw := make([]byte, 4)
+	binary.BigEndian.PutUint32(raw, tag^c.ptag)
+	c.write(raw)
+
+	binary.LittleEndian.PutUint32(raw, c.crc)
+	c.buf.Write(raw)
+
+	for c.buf.Len() < end {
+		c.buf.WriteByte(0xff)
+	}
+
+	return c.buf.Bytes()
+}
+
+// Writes data to the commit and updates the running CRC.
+func (c *commit) write(data []byte) {
+	c.buf.Write(data)
+	c.crc = crc(c.crc, data)
+}
+
+// LittleFS uses the standard CRC-32 polynomial without inverting the result.
+func crc(seed uint32, data []byte) uint32 {
+	return ^crc32.Update(^seed, crc32.IEEETable, data)
+}
@@ -0,0 +1,129 @@
+package littlefs
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testGeometry = Geometry{BlockSize: 4096, BlockCount: 16, NameMax: 32}
+
+// Reads back the root directory the same way LittleFS fetches a metadata block. Returns the superblock and files.
+func readImage(t *testing.T, image []byte) ([]byte, map[string][]byte) {
+	block := image[:testGeometry.BlockSize]
+
+	names := make(map[uint32]string)
+	contents := make(map[uint32][]byte)
+	var superblock []byte
+
+	sum := crc(0xffffffff, block[:4])
+	ptag := uint32(0xffffffff)
+	off := 4
+
+	for {
+		raw := block[off : off+4]
+		tag := binary.BigEndian.Uint32(raw) ^ ptag
+		require.Zero(t, tag>>31, "invalid tag at offset %d", off)
+
+		kind, id, size := tag>>20&0x7ff, tag>>10&0x3ff, int(tag&0x3ff)
+		data := block[off+4 : off+4+size]
+		sum = crc(sum, raw)
+
+		if kind&0x700 == typeCRC {
+			assert.Equal(t, sum, binary.LittleEndian.Uint32(data))
+			assert.Zero(t, (off+4+size)%commitAlignment)
+
+			// The next tag must be invalid as the rest of the block is erased.
+			next := binary.BigEndian.Uint32(block[off+4+size:]) ^ tag
+			assert.NotZero(t, next>>31)
+
+			break
+		}
+
+		sum = crc(sum, data)
+
+		switch kind {
+		case typeSuperblock:
+			assert.Equal(t, "littlefs", string(data))
+
+		case typeReg:
+			names[id] = string(data)
+
+		case typeInlineStruct:
+			if id == 0 {
+				superblock = data
+			} else {
+				contents[id] = data
+			}
+		}
+
+		ptag = tag
+		off += 4 + size
+	}
+
+	files := make(map[string][]byte)
+	for id, name := range names {
+		files[name] = contents[id]
+	}
+
+	return superblock, files
+}
+
+func TestBuild(t *testing.T) {
+	files := map[string][]byte{
+		"/meshKey":     []byte("0123456789abcdef0123456789abcdef"),
+		"/meshChannel": []byte("6"),
+		"configured":   []byte("true"),
+		"/empty":       {},
+	}
+
+	image, err := Build(testGeometry, files)
+	require.NoError(t, err)
+	require.Len(t, image, testGeometry.Size())
+
+	assert.Equal(t, uint32(1), binary.LittleEndian.Uint32(image))
+
+	// The second block of the superblock pair is erased.
+	for _, b := range image[testGeometry.BlockSize : 2*testGeometry.BlockSize] {
+		require.Equal(t, byte(0xff), b)
+	}
+
+	superblock, read := readImage(t, image)
+	assert.Equal(t, map[string][]byte{
+		"meshKey":     []byte("0123456789abcdef0123456789abcdef"),
+		"meshChannel": []byte("6"),
+		"configured":  []byte("true"),
+		"empty":       {},
+	}, read)
+
+	require.Len(t, superblock, 24)
+	assert.Equal(t, uint32(diskVersion), binary.LittleEndian.Uint32(superblock))
+	assert.Equal(t, testGeometry.BlockSize, binary.LittleEndian.Uint32(superblock[4:]))
+	assert.Equal(t, testGeometry.BlockCount, binary.LittleEndian.Uint32(superblock[8:]))
+	assert.Equal(t, testGeometry.NameMax, binary.LittleEndian.Uint32(superblock[12:]))
+}
+
+func TestBuildErrors(t *testing.T) {
+	_, err := Build(Geometry{BlockSize: 4000, BlockCount: 16, NameMax: 32}, nil)
+	assert.ErrorIs(t, err, ErrInvalidGeometry)
+
+	_, err = Build(testGeometry, map[string][]byte{"/dir/file": nil})
+	assert.ErrorIs(t, err, ErrInvalidName)
+
+	_, err = Build(testGeometry, map[string][]byte{"/a_name_that_is_longer_than_32_chars": nil})
+	assert.ErrorIs(t, err, ErrInvalidName)
+
+	_, err = Build(testGeometry, map[string][]byte{"/large": make([]byte, 2000)})
+	assert.ErrorIs(t, err, ErrTooLarge)
+
+	// Every file fits on its own but together they overflow the metadata block.
+	files := make(map[string][]byte)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		files[name] = make([]byte, 1000)
+	}
+
+	_, err = Build(testGeometry, files)
+	assert.ErrorIs(t, err, ErrTooLarge)
+}
@@ -0,0 +1,103 @@
+package monitor
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/config"
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/notify"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+	"github.com/ConfusedPolarBear/garden/internal/websocket"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Websocket message sent whenever a system goes online or offline.
+type StatusMessage struct {
+	Identifier string
+	Online     bool
+	LastSeen   time.Time
+}
+
+// Starts the background monitor that marks systems as offline once they miss too many telemetry intervals.
+func Start() {
+	interval := config.GetDuration("monitor.telemetry_interval", time.Minute)
+	if interval < time.Second {
+		logrus.Warnf("[monitor] telemetry interval must be at least 1s, using 1m instead of %s", interval)
+		interval = time.Minute
+	}
+
+	missed := config.GetInt("monitor.missed_intervals", 3)
+	if missed <= 0 {
+		logrus.Warnf("[monitor] missed intervals must be positive, using 3 instead of %d", missed)
+		missed = 3
+	}
+	timeout := interval * time.Duration(missed)
+
+	logrus.Debugf("[monitor] systems will be marked offline after %s of silence", timeout)
+
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+
+		for range ticker.C {
+			checkSystems(time.Now().Add(-timeout))
+		}
+	}()
+}
+
+// Marks every online system that hasn't been seen since the provided time as offline.
+func checkSystems(since time.Time) {
+	for _, id := range db.GetStaleSystems(since) {
+		change, err := db.MarkSystemOffline(id, since)
+		if errors.Is(err, db.ErrStatusUnchanged) {
+			// The system sent a message after it was found to be stale.
+			continue
+		} else if err != nil {
+			logrus.Errorf("[monitor] unable to mark %s as offline: %s", id, err)
+			continue
+		}
+
+		system, err := db.GetSystem(id, false)
+		if err != nil {
+			continue
+		}
+
+		logrus.Warnf("[monitor] system %s went offline, last seen %s", id, system.LastSeen.Format(time.RFC3339))
+
+		notify.Send(notify.EventSystemOffline, id, "System offline", "%s (%s) went offline, last seen %s",
+			system.Name, id, system.LastSeen.Format(time.RFC1123))
+
+		broadcast(change, system.LastSeen)
+	}
+}
+
+// Records that a system was seen and marks it as online. Both are written to the database immediately; the caller is
+// responsible for saving any other changes to the system.
+func MarkSeen(system *util.GardenSystem) {
+	system.LastSeen = time.Now()
+	system.Online = true
+
+	change, err := db.MarkSystemSeen(system.Identifier, system.LastSeen)
+	if errors.Is(err, db.ErrStatusUnchanged) {
+		return
+	} else if err != nil {
+		logrus.Errorf("[monitor] unable to mark %s as online: %s", system.Identifier, err)
+		return
+	}
+
+	logrus.Printf("[monitor] system %s is online", system.Identifier)
+
+	notify.Send(notify.EventSystemOnline, system.Identifier, "System online", "%s (%s) is online",
+		system.Name, system.Identifier)
+
+	broadcast(change, system.LastSeen)
+}
+
+func broadcast(change util.SystemStatusChange, lastSeen time.Time) {
+	websocket.BroadcastWebsocketMessage("status", StatusMessage{
+		Identifier: change.GardenSystemID,
+		Online:     change.Online,
+		LastSeen:   lastSeen,
+	})
+}
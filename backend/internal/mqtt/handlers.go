@@ -0,0 +1,83 @@
+package mqtt
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/ConfusedPolarBear/garden/internal/util"
+)
+
+// Handles a telemetry message. Changes made to the system are saved once the handler returns. Handlers run inside the
+// MQTT callback, so any messages they publish must be published from a new goroutine.
+type TelemetryHandler func(system *util.GardenSystem, payload []byte)
+
+// Called in a separate goroutine whenever a system announces itself. Handlers can safely publish messages.
+type DiscoveryHandler func(system util.GardenSystem)
+
+// Called for every message from a known system, before the message is handled. Name is the last part of the topic,
+// or "discovery" for discovery messages.
+type MessageHandler func(id, name string, payload []byte)
+
+var handlersLock sync.RWMutex
+var telemetryHandlers = map[string]TelemetryHandler{}
+var discoveryHandlers []DiscoveryHandler
+var messageHandlers []MessageHandler
+
+// Registers a handler for telemetry published to garden/module/<id>/tele/<name>. Allows packages that send commands
+// to handle responses without creating an import cycle.
+func HandleTelemetry(name string, handler TelemetryHandler) {
+	handlersLock.Lock()
+	defer handlersLock.Unlock()
+
+	telemetryHandlers["/tele/"+name] = handler
+}
+
+// Registers a handler that is called whenever a system announces itself.
+func OnDiscovery(handler DiscoveryHandler) {
+	handlersLock.Lock()
+	defer handlersLock.Unlock()
+
+	discoveryHandlers = append(discoveryHandlers, handler)
+}
+
+// Registers a handler that is called for every message received from a system.
+func OnMessage(handler MessageHandler) {
+	handlersLock.Lock()
+	defer handlersLock.Unlock()
+
+	messageHandlers = append(messageHandlers, handler)
+}
+
+func runMessageHandlers(id, name string, payload []byte) {
+	handlersLock.RLock()
+	defer handlersLock.RUnlock()
+
+	for _, handler := range messageHandlers {
+		handler(id, name, payload)
+	}
+}
+
+// Returns the handler registered for the telemetry topic, if any.
+func getTelemetryHandler(topic string) (TelemetryHandler, bool) {
+	handlersLock.RLock()
+	defer handlersLock.RUnlock()
+
+	for suffix, handler := range telemetryHandlers {
+		if strings.HasSuffix(topic, suffix) {
+			return handler, true
+		}
+	}
+
+	return nil, false
+}
+
+// Calls every discovery handler. Handlers run in their own goroutine as publishing from within an MQTT callback can
+// deadlock the client.
+func runDiscoveryHandlers(system util.GardenSystem) {
+	handlersLock.RLock()
+	defer handlersLock.RUnlock()
+
+	for _, handler := range discoveryHandlers {
+		go handler(system)
+	}
+}
@@ -1,21 +1,20 @@
 package mqtt
 
 import (
-	"bytes"
-	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net"
 	"regexp"
-	"sort"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/ConfusedPolarBear/garden/internal/alert"
 	"github.com/ConfusedPolarBear/garden/internal/config"
 	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/fragment"
+	"github.com/ConfusedPolarBear/garden/internal/monitor"
 	"github.com/ConfusedPolarBear/garden/internal/util"
 	"github.com/ConfusedPolarBear/garden/internal/websocket"
 
@@ -26,18 +25,8 @@ import (
 var clientIdRe *regexp.Regexp = regexp.MustCompile("^garden/module/([a-fA-F0-9]+)/")
 var mqttClient mqtt.Client
 
-// TODO: warn when a packet has been queued for longer than 5 seconds
-type meshPacket struct {
-	ArrivalTime time.Time
-
-	Number  uint16
-	Total   uint16
-	Topic   string
-	Payload []byte
-}
-
-var meshPacketsLock sync.Mutex
-var meshPackets map[string][]meshPacket = map[string][]meshPacket{}
+// Fragmented mesh messages that haven't been fully received within 5 seconds are dropped.
+var meshReassembler = newReassembler(5*time.Second, 64)
 
 func Setup(isServer bool) {
 	// Get configuration from environment variables
@@ -91,9 +80,20 @@ func Setup(isServer bool) {
 
 	if isServer {
 		Subscribe("garden/module/#", onMqttMessage)
+
+		go func() {
+			for range time.Tick(time.Second) {
+				meshReassembler.cleanup(time.Now())
+			}
+		}()
 	}
 }
 
+// Returns statistics about mesh message reassembly.
+func ReassemblyStatistics() ReassemblyStats {
+	return meshReassembler.Stats()
+}
+
 // Publishes to the provided topic or panics.
 func Publish(topic, payload string) {
 	PublishAdvanced(topic, payload, 0, false)
@@ -121,8 +121,6 @@ func onMqttMessage(c mqtt.Client, m mqtt.Message) {
 	handleMqttMessage(client, topic, payload)
 }
 
-// TODO: create a function that loops through all queued packets and alerts if any are older than 5 seconds.
-
 func handleMqttMessage(client, topic string, payload []byte) {
 	// Minified discovery message. Must be compatible with the full GardenSystemInfo struct.
 	type miniInfo struct {
@@ -133,9 +131,12 @@ func handleMqttMessage(client, topic string, payload []byte) {
 		RestartReason       string `json:"RR"`
 		CoreVersion         string `json:"CV"`
 		SdkVersion          string `json:"SV"`
+		AppVersion          string `json:"AV"`
 		Chipset             string `json:"TY"`
 		FilesystemUsedSize  int    `json:"FU"`
 		FilesystemTotalSize int    `json:"FT"`
+		EnvelopeVersion     int    `json:"EV"`
+		KeyRotation         bool   `json:"KR"`
 		Sensors             []util.Sensor
 	}
 
@@ -166,10 +167,17 @@ func handleMqttMessage(client, topic string, payload []byte) {
 			return
 		}
 
+		// Provisioned systems announce the name they were given until they're renamed.
+		var named struct {
+			Name string `json:"NM"`
+		}
+		json.Unmarshal(payload, &named)
+
 		info := util.GardenSystemInfo(miniInfo)
 		system := util.GardenSystem{
 			UpdatedAt:    time.Now(),
 			Identifier:   id,
+			Name:         named.Name,
 			Announcement: info,
 			UpdateStatus: util.OTAStatus{
 				Success: true,
@@ -177,12 +185,22 @@ func handleMqttMessage(client, topic string, payload []byte) {
 			},
 		}
 
+		if previous, err := db.GetSystem(id, false); err == nil && previous.Name != "" {
+			system.Name = previous.Name
+		}
+
+		// Re-announcing systems keep their online state, so they only record a transition if they were offline.
 		if err := db.CreateSystem(system); err != nil {
 			logrus.Errorf("[mqtt] unable to update system: %s", err)
 		}
 
+		monitor.MarkSeen(&system)
+
 		websocket.BroadcastWebsocketMessage("update", system)
 
+		runMessageHandlers(id, "discovery", payload)
+		runDiscoveryHandlers(system)
+
 		return
 	}
 
@@ -193,6 +211,9 @@ func handleMqttMessage(client, topic string, payload []byte) {
 	}
 
 	system.UpdatedAt = time.Now()
+	monitor.MarkSeen(&system)
+
+	runMessageHandlers(client, topic[strings.LastIndex(topic, "/")+1:], payload)
 
 	if strings.Contains(topic, "/tele/") {
 		if strings.HasSuffix(topic, "/data") {
@@ -206,20 +227,23 @@ func handleMqttMessage(client, topic string, payload []byte) {
 
 			system.Readings = append(system.Readings, reading)
 
+			alert.Evaluate(client, reading)
+
 		} else if strings.HasSuffix(topic, "/networks") {
 			// Wi-Fi scan results
-			type network struct {
-				Known bool
-				MAC   string
-				RSSI  int
-			}
-
-			var results []network
+			var results []util.ScannedNetwork
 			if err := json.Unmarshal(payload, &results); err != nil {
 				logrus.Warnf("[mqtt] unable to unmarshal scan results: %s\n", err)
 				return
 			}
 
+			scan := util.NetworkScan{GardenSystemID: client, Networks: results}
+			if err := db.CreateNetworkScan(&scan); err != nil {
+				logrus.Warnf("[mqtt] unable to store scan results from %s: %s", client, err)
+			} else {
+				websocket.BroadcastWebsocketMessage("networks", scan)
+			}
+
 			logrus.Debugf("[mqtt] found %d networks", len(results))
 			for i, n := range results {
 				// RSSI ranges from 0 to -100 (ish)
@@ -232,79 +256,35 @@ func handleMqttMessage(client, topic string, payload []byte) {
 			}
 
 		} else if strings.HasSuffix(topic, "/packet") {
-			/*
-				| Payload index | Description    |
-				|---------------|----------------|
-				| 0 - 3         | Correlation ID |
-				| 4             | Packet number  |
-				| 5             | Total packets  |
-				| 6 - end       | Payload        |
-
-				Correlation IDs are random 32 bit unsigned integers generated by the node that created the packet.
-					They are used by the backend server to recombine fragmented ESP-NOW packets.
-
-				Packet numbers and the total number of packets start at 1 and can go up to 255. The theoretical maximum
-					payload size is 62,220 bytes, or about 60 KB (244 * 255 bytes).
-			*/
-
+			// A fragment of a message published by a mesh client. The wire format is documented in the fragment package.
 			logrus.Tracef("[mqtt] raw packet is %s", hex.EncodeToString(payload))
 
-			correlation := hex.EncodeToString(payload[:3])
-
-			// Nodes only send 8 bit unsigned integers but the smallest number in the binary package is uint16
-			number := binary.BigEndian.Uint16([]byte{0x00, payload[4]})
-			total := binary.BigEndian.Uint16([]byte{0x00, payload[5]})
-
-			// In the first packet, the payload is: the original MQTT topic, the byte 0x01, and the MQTT payload.
-			// In the second and later packets, the payload is just the remaining bytes in the MQTT payload.
-			packetPayload := payload[6:]
-			for bytes.HasSuffix(packetPayload, []byte{0x00}) {
-				packetPayload = bytes.TrimSuffix(packetPayload, []byte{0x00})
-			}
-
-			// If this is the first packet, the payload has the topic prepended to it.
-			packetTopic := ""
-			if number == 1 {
-				if bytes.Contains(packetPayload, []byte{0x01}) {
-					parts := bytes.Split(packetPayload, []byte{0x01})
-					packetTopic = string(parts[0])
-					packetPayload = parts[1]
-				} else {
-					logrus.Warn("[mqtt] first mesh packet does not have separator")
-				}
+			f, err := fragment.Decode(payload)
+			if err != nil {
+				logrus.Warnf("[mqtt] dropping malformed mesh packet from %s: %s", client, err)
+				return
 			}
 
-			logrus.Tracef("[mqtt] got packet %s (%d/%d): %s", correlation, number, total, packetPayload)
-
-			// Store the packet
-			meshPacketsLock.Lock()
+			logrus.Tracef("[mqtt] got packet %s (%d/%d): %x", f.CorrelationID(), f.Number, f.Total, f.Data)
 
-			packets := meshPackets[correlation]
-			packets = append(packets, meshPacket{
-				ArrivalTime: time.Now(),
-				Number:      number,
-				Total:       total,
-				Topic:       packetTopic,
-				Payload:     packetPayload,
-			})
-			meshPackets[correlation] = packets
-
-			meshPacketsLock.Unlock()
-
-			first := packets[0]
-			if len(packets) != int(first.Total) {
+			message, complete, err := meshReassembler.add(f, time.Now())
+			if err != nil {
+				logrus.Warnf("[mqtt] dropping mesh packet %s (%d/%d): %s", f.CorrelationID(), f.Number, f.Total, err)
+				return
+			} else if !complete {
 				return
 			}
 
-			// Once all parts of the packet have been received, reassemble and handle it.
-			sort.Slice(packets, func(i, j int) bool {
-				return packets[i].Number < packets[j].Number
-			})
+			meshTopic, meshPayload, err := fragment.Join(message)
+			if err != nil {
+				logrus.Warnf("[mqtt] dropping mesh message %s: %s", f.CorrelationID(), err)
+				return
+			}
 
 			// MQTT topics are one of: garden/module/XXXXXXXXXX/tele/data OR garden/module/discovery/XXXXXXXXXX
 			clientId := ""
-			parts := strings.Split(first.Topic, "/")
-			if strings.Contains(first.Topic, "/tele/") {
+			parts := strings.Split(meshTopic, "/")
+			if strings.Contains(meshTopic, "/tele/") && len(parts) > 2 {
 				logrus.Tracef("[mqtt] mesh client id is a telemetry packet")
 				clientId = parts[2]
 			} else {
@@ -312,26 +292,7 @@ func handleMqttMessage(client, topic string, payload []byte) {
 				clientId = parts[len(parts)-1]
 			}
 
-			// Reassemble the payload and handle it
-			var meshPayload []byte
-			var expectedNumber uint16 = 0
-			handle := true
-			for _, packet := range packets {
-				if expectedNumber++; expectedNumber != packet.Number {
-					logrus.Warnf("[mqtt] encountered unexpected packet while reassembling packet chunks (expected %d, got %d",
-						expectedNumber,
-						packet.Number)
-
-					handle = false
-					break
-				}
-
-				meshPayload = append(meshPayload, packet.Payload...)
-			}
-
-			if handle {
-				handleMqttMessage(clientId, first.Topic, meshPayload)
-			}
+			handleMqttMessage(clientId, meshTopic, meshPayload)
 
 		} else if strings.HasSuffix(topic, "/ping") {
 			// A system has sent a pong in response to a ping, nothing else needs to be updated.
@@ -344,8 +305,27 @@ func handleMqttMessage(client, topic string, payload []byte) {
 				return
 			}
 
-			// TODO: store & expose to the frontend
-			logrus.Printf("mesh stats for %s: %#v", client, stats)
+			logrus.Debugf("[mqtt] mesh stats for %s: %#v", client, stats)
+
+			sample := util.MeshStatistics{
+				GardenSystemID:     client,
+				TotalSent:          stats.TotalSent,
+				TotalReceived:      stats.TotalReceived,
+				DroppedBadLength:   stats.DroppedBadLength,
+				DroppedInvalidAuth: stats.DroppedInvalidAuth,
+				TotalAccepted:      stats.TotalAccepted,
+			}
+
+			if err := db.CreateMeshStatistics(&sample); err != nil {
+				logrus.Warnf("[mqtt] unable to store mesh statistics for %s: %s", client, err)
+			}
+
+			now := time.Now()
+			websocket.BroadcastWebsocketMessage("mesh", util.MeshReport{
+				Identifier: client,
+				Statistics: sample,
+				Rates:      util.ComputeMeshRates(db.GetMeshStatistics(client, now.Add(-time.Hour), now.Add(time.Second))),
+			})
 
 		} else if strings.HasSuffix(topic, "/ota") {
 			var status util.OTAStatus
@@ -356,6 +336,9 @@ func handleMqttMessage(client, topic string, payload []byte) {
 
 			system.UpdateStatus = status
 
+		} else if handler, ok := getTelemetryHandler(topic); ok {
+			handler(&system, payload)
+
 		} else {
 			logrus.Warnf("[mqtt] unhandled MQTT topic: %s", topic)
 			return
@@ -0,0 +1,181 @@
+package mqtt
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/fragment"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errInvalidFragment   = errors.New("fragment number or total is out of range")
+	errTotalMismatch     = errors.New("fragment total does not match earlier fragments")
+	errDuplicateFragment = errors.New("duplicate fragment")
+)
+
+// Counters describing the health of mesh message reassembly.
+type ReassemblyStats struct {
+	// Messages that were successfully reassembled.
+	Completed uint64
+
+	// Fragments that were received more than once.
+	Duplicates uint64
+
+	// Fragments rejected for having an invalid number or total.
+	Rejected uint64
+
+	// Incomplete messages that were evicted because they timed out or too many messages were pending.
+	Expired uint64
+
+	// Messages currently waiting for more fragments.
+	Pending int
+}
+
+// A message that is still waiting for some of its fragments.
+type pendingMessage struct {
+	FirstArrival time.Time
+	Total        uint8
+	Fragments    map[uint8][]byte
+}
+
+// Recombines fragmented mesh messages. Fragments of a message share a correlation ID and can arrive in any order.
+type reassembler struct {
+	lock sync.Mutex
+
+	// Maximum time to wait for all fragments of a message.
+	timeout time.Duration
+
+	// Maximum number of messages that can be pending at once. The oldest message is evicted to make room.
+	maxPending int
+
+	pending map[uint32]*pendingMessage
+	stats   ReassemblyStats
+}
+
+func newReassembler(timeout time.Duration, maxPending int) *reassembler {
+	return &reassembler{
+		timeout:    timeout,
+		maxPending: maxPending,
+		pending:    map[uint32]*pendingMessage{},
+	}
+}
+
+// Adds a fragment to its message. Once every fragment of the message has arrived, the reassembled message is returned
+// with complete set to true.
+func (r *reassembler) add(f fragment.Fragment, arrival time.Time) (message []byte, complete bool, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.evictExpired(arrival)
+
+	if f.Total == 0 || f.Number == 0 || f.Number > f.Total {
+		r.stats.Rejected++
+		return nil, false, errInvalidFragment
+	}
+
+	msg, ok := r.pending[f.Correlation]
+	if !ok {
+		if len(r.pending) >= r.maxPending {
+			r.evictOldest()
+		}
+
+		msg = &pendingMessage{
+			FirstArrival: arrival,
+			Total:        f.Total,
+			Fragments:    map[uint8][]byte{},
+		}
+
+		r.pending[f.Correlation] = msg
+	}
+
+	if f.Total != msg.Total {
+		r.stats.Rejected++
+		return nil, false, errTotalMismatch
+	}
+
+	if _, ok := msg.Fragments[f.Number]; ok {
+		r.stats.Duplicates++
+		return nil, false, errDuplicateFragment
+	}
+
+	msg.Fragments[f.Number] = f.Data
+
+	if len(msg.Fragments) != int(msg.Total) {
+		return nil, false, nil
+	}
+
+	// Every fragment number between 1 and Total is present, so reassemble them in order.
+	delete(r.pending, f.Correlation)
+	r.stats.Completed++
+
+	for i := 1; i <= int(msg.Total); i++ {
+		message = append(message, msg.Fragments[uint8(i)]...)
+	}
+
+	return message, true, nil
+}
+
+// Evicts every message that has been pending for longer than the timeout.
+func (r *reassembler) evictExpired(now time.Time) int {
+	evicted := 0
+
+	for correlation, msg := range r.pending {
+		if now.Sub(msg.FirstArrival) < r.timeout {
+			continue
+		}
+
+		logrus.Warnf("[mqtt] dropping incomplete mesh message %08x after %s (received %d of %d fragments)",
+			correlation,
+			now.Sub(msg.FirstArrival).Round(time.Millisecond),
+			len(msg.Fragments),
+			msg.Total)
+
+		delete(r.pending, correlation)
+		r.stats.Expired++
+		evicted++
+	}
+
+	return evicted
+}
+
+func (r *reassembler) evictOldest() {
+	found := false
+	var oldest uint32
+	var oldestTime time.Time
+
+	for correlation, msg := range r.pending {
+		if !found || msg.FirstArrival.Before(oldestTime) {
+			found, oldest, oldestTime = true, correlation, msg.FirstArrival
+		}
+	}
+
+	if !found {
+		return
+	}
+
+	logrus.Warnf("[mqtt] too many pending mesh messages, dropping %08x", oldest)
+
+	delete(r.pending, oldest)
+	r.stats.Expired++
+}
+
+// Evicts expired messages. Called periodically so that messages are dropped even if no new fragments arrive.
+func (r *reassembler) cleanup(now time.Time) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.evictExpired(now)
+}
+
+func (r *reassembler) Stats() ReassemblyStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	stats := r.stats
+	stats.Pending = len(r.pending)
+
+	return stats
+}
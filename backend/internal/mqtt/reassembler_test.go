@@ -0,0 +1,150 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/fragment"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testFragment struct {
+	correlation uint32
+	number      uint8
+	total       uint8
+	data        string
+
+	// Offset from the start of the test that this fragment arrives at.
+	delay time.Duration
+}
+
+func TestReassembly(t *testing.T) {
+	tests := []struct {
+		name      string
+		fragments []testFragment
+		expected  []string
+		stats     ReassemblyStats
+	}{
+		{
+			name:      "single fragment",
+			fragments: []testFragment{{0xa, 1, 1, "hello", 0}},
+			expected:  []string{"hello"},
+			stats:     ReassemblyStats{Completed: 1},
+		},
+		{
+			name: "in order",
+			fragments: []testFragment{
+				{0xa, 1, 3, "one ", 0},
+				{0xa, 2, 3, "two ", 0},
+				{0xa, 3, 3, "three", 0},
+			},
+			expected: []string{"one two three"},
+			stats:    ReassemblyStats{Completed: 1},
+		},
+		{
+			name: "out of order",
+			fragments: []testFragment{
+				{0xa, 3, 3, "three", 0},
+				{0xa, 1, 3, "one ", 0},
+				{0xa, 2, 3, "two ", 0},
+			},
+			expected: []string{"one two three"},
+			stats:    ReassemblyStats{Completed: 1},
+		},
+		{
+			name: "interleaved correlations",
+			fragments: []testFragment{
+				{0xa, 1, 2, "a1", 0},
+				{0xb, 1, 2, "b1", 0},
+				{0xb, 2, 2, "b2", 0},
+				{0xa, 2, 2, "a2", 0},
+			},
+			expected: []string{"b1b2", "a1a2"},
+			stats:    ReassemblyStats{Completed: 2},
+		},
+		{
+			name: "duplicate fragment",
+			fragments: []testFragment{
+				{0xa, 1, 2, "one", 0},
+				{0xa, 1, 2, "one", 0},
+				{0xa, 2, 2, "two", 0},
+			},
+			expected: []string{"onetwo"},
+			stats:    ReassemblyStats{Completed: 1, Duplicates: 1},
+		},
+		{
+			name: "out of range fragments",
+			fragments: []testFragment{
+				{0xa, 0, 2, "zero", 0},
+				{0xa, 3, 2, "three", 0},
+				{0xa, 1, 0, "none", 0},
+			},
+			stats: ReassemblyStats{Rejected: 3},
+		},
+		{
+			name: "total mismatch",
+			fragments: []testFragment{
+				{0xa, 1, 2, "one", 0},
+				{0xa, 2, 3, "two", 0},
+			},
+			stats: ReassemblyStats{Rejected: 1, Pending: 1},
+		},
+		{
+			name: "timeout",
+			fragments: []testFragment{
+				{0xa, 1, 2, "one", 0},
+				{0xa, 2, 2, "two", 6 * time.Second},
+			},
+			stats: ReassemblyStats{Expired: 1, Pending: 1},
+		},
+		{
+			name: "too many pending",
+			fragments: []testFragment{
+				{0xa, 1, 2, "a1", 0},
+				{0xb, 1, 2, "b1", time.Millisecond},
+				{0xc, 1, 2, "c1", 2 * time.Millisecond},
+				{0xa, 2, 2, "a2", 3 * time.Millisecond},
+			},
+			// The late fragment of a starts a new message, evicting b.
+			stats: ReassemblyStats{Expired: 2, Pending: 2},
+		},
+	}
+
+	start := time.Date(2021, 12, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newReassembler(5*time.Second, 2)
+
+			var messages []string
+			for _, f := range test.fragments {
+				message, complete, _ := r.add(fragment.Fragment{
+					Correlation: f.correlation,
+					Number:      f.number,
+					Total:       f.total,
+					Data:        []byte(f.data),
+				}, start.Add(f.delay))
+
+				if complete {
+					messages = append(messages, string(message))
+				}
+			}
+
+			assert.Equal(t, test.expected, messages)
+			assert.Equal(t, test.stats, r.Stats())
+		})
+	}
+}
+
+func TestReassemblyCleanup(t *testing.T) {
+	start := time.Now()
+	r := newReassembler(5*time.Second, 10)
+
+	r.add(fragment.Fragment{Correlation: 1, Number: 1, Total: 2}, start)
+	r.add(fragment.Fragment{Correlation: 2, Number: 1, Total: 2}, start.Add(3*time.Second))
+
+	assert.Equal(t, 0, r.cleanup(start.Add(4*time.Second)))
+	assert.Equal(t, 1, r.cleanup(start.Add(5*time.Second)))
+	assert.Equal(t, ReassemblyStats{Expired: 1, Pending: 1}, r.Stats())
+}
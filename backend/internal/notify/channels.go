@@ -0,0 +1,186 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/util"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// Returns true if this notification is urgent enough to warrant a higher push priority.
+func urgent(n Notification) bool {
+	return n.Event == EventAlertRaised || n.Event == EventSystemOffline
+}
+
+func checkResponse(res *http.Response) error {
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("server responded with %s", res.Status)
+	}
+
+	return nil
+}
+
+// Posts notifications as JSON to an arbitrary URL.
+type WebhookChannel struct {
+	URL string
+}
+
+func NewWebhookChannel(url string) *WebhookChannel {
+	return &WebhookChannel{URL: url}
+}
+
+func (c *WebhookChannel) Name() string {
+	return "webhook"
+}
+
+func (c *WebhookChannel) Send(n Notification) error {
+	res, err := httpClient.Post(c.URL, "application/json", bytes.NewReader(util.Marshal(n)))
+	if err != nil {
+		return err
+	}
+
+	return checkResponse(res)
+}
+
+// Sends notifications as plain text emails. STARTTLS is used automatically if the server supports it.
+type EmailChannel struct {
+	// Server address with port.
+	Address string
+
+	// Optional credentials.
+	Username string
+	Password string
+
+	From string
+	To   []string
+}
+
+func (c *EmailChannel) Name() string {
+	return "email"
+}
+
+func (c *EmailChannel) Send(n Notification) error {
+	var auth smtp.Auth
+
+	if c.Username != "" {
+		host, _, err := net.SplitHostPort(c.Address)
+		if err != nil {
+			return err
+		}
+
+		auth = smtp.PlainAuth("", c.Username, c.Password, host)
+	}
+
+	var to []string
+	for _, addr := range c.To {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			to = append(to, addr)
+		}
+	}
+
+	if len(to) == 0 {
+		return fmt.Errorf("no recipients configured")
+	}
+
+	// Notification titles are generated internally but strip line breaks anyway to prevent header injection.
+	subject := strings.NewReplacer("\r", "", "\n", " ").Replace(n.Title)
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: [garden] %s\r\nDate: %s\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		c.From,
+		strings.Join(to, ", "),
+		subject,
+		n.Time.Format(time.RFC1123Z),
+		n.Message)
+
+	return smtp.SendMail(c.Address, auth, c.From, to, []byte(msg))
+}
+
+// Sends notifications to a push notification server. Supports ntfy and Gotify.
+type PushChannel struct {
+	// For ntfy, the full topic URL. For Gotify, the URL of the message endpoint.
+	URL string
+
+	// Either "ntfy" or "gotify".
+	Format string
+
+	// Optional access token (ntfy) or application token (Gotify).
+	Token string
+}
+
+func NewPushChannel(url, format, token string) *PushChannel {
+	if format == "" {
+		format = "ntfy"
+	}
+
+	return &PushChannel{URL: url, Format: format, Token: token}
+}
+
+func (c *PushChannel) Name() string {
+	return "push"
+}
+
+func (c *PushChannel) Send(n Notification) error {
+	var req *http.Request
+	var err error
+
+	switch c.Format {
+	case "ntfy":
+		req, err = http.NewRequest(http.MethodPost, c.URL, strings.NewReader(n.Message))
+		if err != nil {
+			return err
+		}
+
+		priority := "default"
+		if urgent(n) {
+			priority = "high"
+		}
+
+		req.Header.Set("Title", n.Title)
+		req.Header.Set("Priority", priority)
+		req.Header.Set("Tags", "seedling")
+
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+
+	case "gotify":
+		type gotifyMessage struct {
+			Title    string `json:"title"`
+			Message  string `json:"message"`
+			Priority int    `json:"priority"`
+		}
+
+		msg := gotifyMessage{Title: n.Title, Message: n.Message, Priority: 5}
+		if urgent(n) {
+			msg.Priority = 8
+		}
+
+		req, err = http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(util.Marshal(msg)))
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Gotify-Key", c.Token)
+
+	default:
+		return fmt.Errorf("unknown push format %s", c.Format)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	return checkResponse(res)
+}
@@ -0,0 +1,213 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Events that notifications are sent for.
+const (
+	EventAlertRaised   = "alert.raised"
+	EventAlertCleared  = "alert.cleared"
+	EventSystemOffline = "system.offline"
+	EventSystemOnline  = "system.online"
+	EventTest          = "test"
+)
+
+type Notification struct {
+	Event   string
+	System  string
+	Title   string
+	Message string
+	Time    time.Time
+}
+
+// Destination that notifications can be delivered to.
+type Channel interface {
+	Name() string
+	Send(n Notification) error
+}
+
+// Delivers notifications to every configured channel in the background, retrying failed deliveries with exponential
+// backoff and dropping notifications that repeat too quickly.
+type Dispatcher struct {
+	channels []Channel
+
+	// Number of times a failed delivery is retried.
+	retries int
+
+	// Delay before the first retry. Doubled after every failed attempt.
+	backoff time.Duration
+
+	// Minimum time between two notifications with the same event, system and title.
+	rateLimit time.Duration
+
+	lock     sync.Mutex
+	lastSent map[string]time.Time
+
+	queue chan Notification
+}
+
+func NewDispatcher(channels []Channel, retries int, backoff, rateLimit time.Duration) *Dispatcher {
+	return &Dispatcher{
+		channels:  channels,
+		retries:   retries,
+		backoff:   backoff,
+		rateLimit: rateLimit,
+		lastSent:  map[string]time.Time{},
+		queue:     make(chan Notification, 100),
+	}
+}
+
+// Starts delivering queued notifications.
+func (d *Dispatcher) Start() {
+	go func() {
+		for n := range d.queue {
+			for _, c := range d.channels {
+				d.deliver(c, n)
+			}
+		}
+	}()
+}
+
+// Queues a notification for delivery. Returns false if it was rate limited or the queue is full.
+func (d *Dispatcher) Enqueue(n Notification) bool {
+	if n.Time.IsZero() {
+		n.Time = time.Now()
+	}
+
+	key := n.Event + "/" + n.System + "/" + n.Title
+
+	d.lock.Lock()
+	if last, ok := d.lastSent[key]; ok && n.Time.Sub(last) < d.rateLimit {
+		d.lock.Unlock()
+		logrus.Debugf("[notify] rate limited notification %s", key)
+		return false
+	}
+	d.lastSent[key] = n.Time
+	d.lock.Unlock()
+
+	select {
+	case d.queue <- n:
+		return true
+	default:
+		logrus.Warnf("[notify] queue is full, dropping notification %s", key)
+		return false
+	}
+}
+
+// Sends a notification to a single channel, retrying on failure.
+func (d *Dispatcher) deliver(c Channel, n Notification) error {
+	delay := d.backoff
+
+	var err error
+	for attempt := 0; attempt <= d.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		if err = c.Send(n); err == nil {
+			logrus.Debugf("[notify] delivered %s notification via %s", n.Event, c.Name())
+			return nil
+		}
+
+		logrus.Warnf("[notify] attempt %d to deliver notification via %s failed: %s", attempt+1, c.Name(), err)
+	}
+
+	logrus.Errorf("[notify] giving up on delivering notification via %s", c.Name())
+
+	return err
+}
+
+// Synchronously sends a test notification to every channel and returns the result of each delivery. Bypasses
+// rate limiting and retries.
+func (d *Dispatcher) Test() map[string]string {
+	results := map[string]string{}
+
+	n := Notification{
+		Event:   EventTest,
+		Title:   "Test notification",
+		Message: "This is a test notification from the garden server.",
+		Time:    time.Now(),
+	}
+
+	for _, c := range d.channels {
+		if err := c.Send(n); err != nil {
+			results[c.Name()] = err.Error()
+		} else {
+			results[c.Name()] = "ok"
+		}
+	}
+
+	return results
+}
+
+var dispatcher *Dispatcher
+
+// Creates all channels configured in garden.ini and starts delivering notifications.
+func Setup() {
+	var channels []Channel
+
+	if url := config.GetString("notify_webhook.url"); url != "" {
+		channels = append(channels, NewWebhookChannel(url))
+	}
+
+	if host := config.GetString("notify_email.host"); host != "" {
+		channels = append(channels, &EmailChannel{
+			Address:  host,
+			Username: config.GetString("notify_email.username"),
+			Password: config.GetString("notify_email.password"),
+			From:     config.GetString("notify_email.from"),
+			To:       strings.Split(config.GetString("notify_email.to"), ","),
+		})
+	}
+
+	if url := config.GetString("notify_push.url"); url != "" {
+		channels = append(channels, NewPushChannel(
+			url,
+			config.GetString("notify_push.format"),
+			config.GetString("notify_push.token"),
+		))
+	}
+
+	dispatcher = NewDispatcher(
+		channels,
+		config.GetInt("notify.retries", 3),
+		config.GetDuration("notify.backoff", 2*time.Second),
+		config.GetDuration("notify.rate_limit", 5*time.Minute),
+	)
+
+	dispatcher.Start()
+
+	logrus.Debugf("[notify] configured %d notification channels", len(channels))
+}
+
+// Queues a notification for delivery to every configured channel.
+func Send(event, system, title, format string, args ...interface{}) {
+	if dispatcher == nil {
+		return
+	}
+
+	dispatcher.Enqueue(Notification{
+		Event:   event,
+		System:  system,
+		Title:   title,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Sends a test notification to every configured channel.
+func Test() map[string]string {
+	if dispatcher == nil {
+		return map[string]string{}
+	}
+
+	return dispatcher.Test()
+}
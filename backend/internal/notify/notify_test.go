@@ -0,0 +1,215 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testNotification = Notification{
+	Event:   EventAlertRaised,
+	System:  "84cca8abcdef",
+	Title:   "Greenhouse too hot",
+	Message: "temperature is 36.5 (> 35.0)",
+	Time:    time.Date(2021, 12, 1, 12, 0, 0, 0, time.UTC),
+}
+
+func TestWebhook(t *testing.T) {
+	var received Notification
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer server.Close()
+
+	require.NoError(t, NewWebhookChannel(server.URL).Send(testNotification))
+	assert.Equal(t, testNotification, received)
+}
+
+func TestWebhookError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	assert.Error(t, NewWebhookChannel(server.URL).Send(testNotification))
+}
+
+func TestPushNtfy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		assert.Equal(t, "/garden", r.URL.Path)
+		assert.Equal(t, testNotification.Title, r.Header.Get("Title"))
+		assert.Equal(t, "high", r.Header.Get("Priority"))
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		assert.Equal(t, testNotification.Message, string(body))
+	}))
+	defer server.Close()
+
+	require.NoError(t, NewPushChannel(server.URL+"/garden", "", "secret").Send(testNotification))
+}
+
+func TestPushGotify(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg map[string]interface{}
+
+		assert.Equal(t, "secret", r.Header.Get("X-Gotify-Key"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&msg))
+		assert.Equal(t, testNotification.Title, msg["title"])
+		assert.Equal(t, float64(8), msg["priority"])
+	}))
+	defer server.Close()
+
+	require.NoError(t, NewPushChannel(server.URL+"/message", "gotify", "secret").Send(testNotification))
+}
+
+// Minimal SMTP server that accepts a single message and sends its data over the returned channel.
+func startSmtpServer(t *testing.T) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	messages := make(chan string, 1)
+
+	go func() {
+		defer l.Close()
+
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+		reply("220 localhost ESMTP")
+
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+
+			case strings.HasPrefix(cmd, "DATA"):
+				reply("354 go ahead")
+
+				var data strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					data.WriteString(l)
+				}
+
+				messages <- data.String()
+				reply("250 queued")
+
+			case strings.HasPrefix(cmd, "QUIT"):
+				reply("221 bye")
+				return
+
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+
+	return l.Addr().String(), messages
+}
+
+func TestEmail(t *testing.T) {
+	addr, messages := startSmtpServer(t)
+
+	c := &EmailChannel{
+		Address: addr,
+		From:    "garden@example.com",
+		To:      []string{"alice@example.com", " bob@example.com"},
+	}
+
+	require.NoError(t, c.Send(testNotification))
+
+	msg := <-messages
+	assert.Contains(t, msg, "Subject: [garden] Greenhouse too hot\r\n")
+	assert.Contains(t, msg, "To: alice@example.com, bob@example.com\r\n")
+	assert.Contains(t, msg, testNotification.Message)
+}
+
+// Channel that fails a set number of times before succeeding.
+type flakyChannel struct {
+	failures int
+	attempts int
+	sent     chan Notification
+}
+
+func (c *flakyChannel) Name() string {
+	return "flaky"
+}
+
+func (c *flakyChannel) Send(n Notification) error {
+	c.attempts++
+	if c.attempts <= c.failures {
+		return errors.New("temporary failure")
+	}
+
+	if c.sent != nil {
+		c.sent <- n
+	}
+
+	return nil
+}
+
+func TestRetry(t *testing.T) {
+	c := &flakyChannel{failures: 2}
+	d := NewDispatcher([]Channel{c}, 3, time.Millisecond, time.Minute)
+
+	assert.NoError(t, d.deliver(c, testNotification))
+	assert.Equal(t, 3, c.attempts)
+
+	c = &flakyChannel{failures: 10}
+	assert.Error(t, d.deliver(c, testNotification))
+	assert.Equal(t, 4, c.attempts)
+}
+
+func TestRateLimit(t *testing.T) {
+	c := &flakyChannel{sent: make(chan Notification, 10)}
+	d := NewDispatcher([]Channel{c}, 0, time.Millisecond, time.Minute)
+	d.Start()
+
+	assert.True(t, d.Enqueue(testNotification))
+	assert.False(t, d.Enqueue(testNotification))
+
+	later := testNotification
+	later.Time = later.Time.Add(2 * time.Minute)
+	assert.True(t, d.Enqueue(later))
+
+	other := testNotification
+	other.System = "84cca8000000"
+	assert.True(t, d.Enqueue(other))
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-c.sent:
+		case <-time.After(time.Second):
+			t.Fatal("notification was not delivered")
+		}
+	}
+}
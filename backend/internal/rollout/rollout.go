@@ -0,0 +1,563 @@
+// Package rollout updates the firmware of a group of systems in stages.
+//
+// Systems are selected by chipset, tag or both and are updated to the stored build of the target version for their
+// chipset. The first system, the canary, is updated on its own. The remaining systems are only updated once the canary
+// announces the firmware version of that build, and are then updated in batches. Mesh coordinators are updated last so
+// that the rest of the mesh stays reachable.
+//
+// A system is updated once it announces itself with the expected firmware version. If a system reports a failed update
+// on its ota topic or doesn't announce the expected version in time, the rollout is paused. Resuming a paused rollout
+// retries every failed system.
+package rollout
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/command"
+	"github.com/ConfusedPolarBear/garden/internal/config"
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/firmware"
+	"github.com/ConfusedPolarBear/garden/internal/mqtt"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+	"github.com/ConfusedPolarBear/garden/internal/websocket"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrNoSystems  = errors.New("no systems match the rollout")
+	ErrNotRunning = errors.New("rollout is not running")
+	ErrNotPaused  = errors.New("rollout is not paused")
+)
+
+// Settings of a new rollout.
+type Options struct {
+	// Systems to update. At least one of these must be set.
+	Chipset string
+	Tag     string
+
+	// Version of the stored build to install. Every selected chipset must have a build with this version.
+	TargetVersion string
+
+	// Number of systems to update at once after the canary. Defaults to 1.
+	BatchSize int
+
+	// Wi-Fi network and server host that systems download the update with.
+	SSID, PSK, Host string
+}
+
+// Serializes changes to the active rollout.
+var lock sync.Mutex
+
+// How long a system has to announce the new version after the update is sent.
+var updateTimeout time.Duration
+
+// Sends update commands. Replaced by tests, which have no MQTT broker to publish to.
+var sendUpdate = command.Send
+
+// Registers the MQTT handlers used to track rollout progress. Must be called before MQTT is setup.
+func Setup() {
+	updateTimeout = config.GetDuration("rollouts.timeout", 15*time.Minute)
+
+	mqtt.OnMessage(handleMessage)
+	mqtt.OnDiscovery(handleDiscovery)
+
+	go func() {
+		for now := range time.Tick(5 * time.Second) {
+			checkDeadlines(now)
+		}
+	}()
+}
+
+// Starts a new rollout and sends the update to its canary.
+func Start(opts Options) (util.Rollout, error) {
+	opts.Chipset = strings.ToLower(opts.Chipset)
+
+	switch {
+	case opts.Chipset == "" && opts.Tag == "":
+		return util.Rollout{}, errors.New("chipset or tag is required")
+
+	case opts.Chipset != "" && !firmware.SupportedChipset(opts.Chipset):
+		return util.Rollout{}, fmt.Errorf("%w %s", firmware.ErrUnknownChipset, opts.Chipset)
+
+	case opts.TargetVersion == "":
+		return util.Rollout{}, errors.New("target version is required")
+
+	case opts.BatchSize < 0 || opts.BatchSize > 50:
+		return util.Rollout{}, errors.New("batch size must be between 1 and 50")
+	}
+
+	if opts.BatchSize == 0 {
+		opts.BatchSize = 1
+	}
+
+	// Catch invalid Wi-Fi settings before anything is sent.
+	if opts.SSID == "" || len(opts.SSID) > 32 || opts.PSK == "" || len(opts.PSK) > 64 {
+		return util.Rollout{}, firmware.ErrInvalidNetwork
+	}
+
+	targets, err := selectSystems(opts)
+	if err != nil {
+		return util.Rollout{}, err
+	} else if len(targets) == 0 {
+		return util.Rollout{}, ErrNoSystems
+	}
+
+	rollout := util.Rollout{
+		Chipset:       opts.Chipset,
+		Tag:           opts.Tag,
+		TargetVersion: opts.TargetVersion,
+		BatchSize:     opts.BatchSize,
+		SSID:          opts.SSID,
+		PSK:           opts.PSK,
+		Host:          opts.Host,
+		Status:        util.RolloutRunning,
+	}
+
+	for i, id := range targets {
+		rollout.Systems = append(rollout.Systems, util.RolloutSystem{
+			GardenSystemID: id,
+			Position:       i,
+			Canary:         i == 0,
+			Status:         util.RolloutSystemPending,
+		})
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := db.CreateRollout(&rollout); err != nil {
+		return rollout, err
+	}
+
+	logrus.Printf("[rollout] started rollout %d of version %s to %d systems, canary is %s",
+		rollout.ID, rollout.TargetVersion, len(targets), targets[0])
+
+	advance(rollout)
+
+	return broadcast(rollout.ID), nil
+}
+
+// Pauses a running rollout. Updates that were already sent are still tracked.
+func Pause(id uint) (util.Rollout, error) {
+	return changeStatus(id, util.RolloutRunning, util.RolloutPaused, "paused by user", ErrNotRunning)
+}
+
+// Resumes a paused rollout, retrying every system that failed.
+func Resume(id uint) (util.Rollout, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	rollout, err := db.GetRollout(id)
+	if err != nil {
+		return rollout, err
+	} else if rollout.Status != util.RolloutPaused {
+		return rollout, ErrNotPaused
+	}
+
+	for i := range rollout.Systems {
+		system := &rollout.Systems[i]
+		if system.Status != util.RolloutSystemFailed {
+			continue
+		}
+
+		system.Status = util.RolloutSystemPending
+		if err := db.UpdateRolloutSystem(system); err != nil {
+			return rollout, err
+		}
+	}
+
+	if err := db.SetRolloutStatus(id, util.RolloutRunning, ""); err != nil {
+		return rollout, err
+	}
+
+	logrus.Printf("[rollout] resumed rollout %d", id)
+
+	rollout.Status = util.RolloutRunning
+	advance(rollout)
+
+	return broadcast(id), nil
+}
+
+// Cancels an active rollout. Systems that haven't been sent the update yet are left alone.
+func Cancel(id uint) (util.Rollout, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	rollout, err := db.GetRollout(id)
+	if err != nil {
+		return rollout, err
+	} else if !rollout.Active() {
+		return rollout, errors.New("rollout is not active")
+	}
+
+	if err := db.SetRolloutStatus(id, util.RolloutCancelled, ""); err != nil {
+		return rollout, err
+	}
+
+	logrus.Warnf("[rollout] cancelled rollout %d", id)
+
+	return broadcast(id), nil
+}
+
+// Continues the active rollout. Called after systems are deleted since a deleted system will never announce the new
+// version.
+func Check() {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if rollout, err := db.GetActiveRollout(); err == nil {
+		advance(rollout)
+		broadcast(rollout.ID)
+	}
+}
+
+func changeStatus(id uint, from, to util.RolloutStatus, message string, invalid error) (util.Rollout, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	rollout, err := db.GetRollout(id)
+	if err != nil {
+		return rollout, err
+	} else if rollout.Status != from {
+		return rollout, invalid
+	}
+
+	if err := db.SetRolloutStatus(id, to, message); err != nil {
+		return rollout, err
+	}
+
+	logrus.Printf("[rollout] rollout %d is now %s", id, to)
+
+	return broadcast(id), nil
+}
+
+// Returns the identifiers of the systems to update, in the order they will be updated. Systems that already run the
+// target version are skipped. Fails if a selected chipset has no build of the target version.
+func selectSystems(opts Options) ([]string, error) {
+	tagged := map[string]bool{}
+	if opts.Tag != "" {
+		for _, id := range db.GetTaggedSystems(opts.Tag) {
+			tagged[id] = true
+		}
+	}
+
+	coordinator, _ := db.GetCoordinator()
+
+	builds := map[string]util.FirmwareBuild{}
+
+	var targets []util.GardenSystem
+	for _, system := range db.GetAllSystems() {
+		chipset := strings.ToLower(system.Announcement.Chipset)
+
+		switch {
+		case opts.Chipset != "" && chipset != opts.Chipset:
+			continue
+		case opts.Tag != "" && !tagged[system.Identifier]:
+			continue
+		case !firmware.SupportedChipset(chipset):
+			continue
+		}
+
+		if _, ok := builds[chipset]; !ok {
+			build, err := firmware.GetBuild(chipset, opts.TargetVersion)
+			if err != nil {
+				return nil, fmt.Errorf("%w: no %s build with version %s", firmware.ErrMissing, chipset, opts.TargetVersion)
+			}
+
+			builds[chipset] = build
+		}
+
+		if version := builds[chipset].AppVersion(); system.Announcement.AppVersion == version {
+			logrus.Debugf("[rollout] skipping %s, it already runs %s", system.Identifier, version)
+			continue
+		}
+
+		targets = append(targets, system)
+	}
+
+	// Online systems make the best canaries and coordinators must be updated last.
+	rank := func(s util.GardenSystem) int {
+		switch {
+		case s.Identifier == coordinator.Identifier:
+			return 2
+		case !s.Online:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		if a, b := rank(targets[i]), rank(targets[j]); a != b {
+			return a < b
+		}
+
+		return targets[i].Identifier < targets[j].Identifier
+	})
+
+	var ids []string
+	for _, system := range targets {
+		ids = append(ids, system.Identifier)
+	}
+
+	return ids, nil
+}
+
+// Sends the update to the next systems once every update that is in progress has finished. Must be called with the
+// lock held.
+func advance(rollout util.Rollout) {
+	if rollout.Status != util.RolloutRunning {
+		return
+	}
+
+	summary := rollout.Summary()
+	if summary.Updating > 0 {
+		return
+	}
+
+	if summary.Pending == 0 {
+		if err := db.SetRolloutStatus(rollout.ID, util.RolloutCompleted, ""); err != nil {
+			logrus.Errorf("[rollout] unable to complete rollout %d: %s", rollout.ID, err)
+			return
+		}
+
+		logrus.Printf("[rollout] completed rollout %d, %d systems updated", rollout.ID, summary.Updated)
+		return
+	}
+
+	// The canary is updated on its own.
+	batch := rollout.BatchSize
+	if len(rollout.Systems) > 0 && rollout.Systems[0].Status != util.RolloutSystemUpdated {
+		batch = 1
+	}
+
+	for i := range rollout.Systems {
+		system := &rollout.Systems[i]
+		if system.Status != util.RolloutSystemPending {
+			continue
+		}
+
+		if !send(&rollout, system) {
+			return
+		}
+
+		if batch--; batch == 0 {
+			return
+		}
+	}
+}
+
+// Sends the update to a system. Returns false if it couldn't be sent, which pauses the rollout.
+func send(rollout *util.Rollout, progress *util.RolloutSystem) bool {
+	id := progress.GardenSystemID
+
+	progress.Status = util.RolloutSystemUpdating
+	progress.Message = ""
+	progress.StartedAt = time.Now()
+	progress.FinishedAt = time.Time{}
+	progress.Deadline = progress.StartedAt.Add(updateTimeout)
+
+	err := func() error {
+		system, err := db.GetSystem(id, false)
+		if err != nil {
+			return err
+		}
+
+		// The build can be deleted while the rollout is running.
+		chipset := strings.ToLower(system.Announcement.Chipset)
+		build, err := firmware.GetBuild(chipset, rollout.TargetVersion)
+		if err != nil {
+			return fmt.Errorf("%w: no %s build with version %s", firmware.ErrMissing, chipset, rollout.TargetVersion)
+		}
+
+		progress.ExpectedVersion = build.AppVersion()
+
+		update, err := firmware.BuildUpdate(system.Announcement.Chipset, firmware.UpdateOptions{
+			SSID:    rollout.SSID,
+			PSK:     rollout.PSK,
+			Host:    rollout.Host,
+			Version: build.Version,
+
+			CurrentVersion: system.Announcement.AppVersion,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		entry, err := sendUpdate(id, string(util.Marshal(update)), true)
+		progress.CommandLogID = entry.ID
+
+		return err
+	}()
+
+	if err != nil {
+		fail(rollout, progress, err.Error())
+		return false
+	}
+
+	logrus.Printf("[rollout] sent update to %s for rollout %d", id, rollout.ID)
+
+	if err := db.UpdateRolloutSystem(progress); err != nil {
+		logrus.Errorf("[rollout] unable to save progress of %s: %s", id, err)
+	}
+
+	return true
+}
+
+// Marks the update of a system as failed and pauses the rollout. Must be called with the lock held.
+func fail(rollout *util.Rollout, progress *util.RolloutSystem, message string) {
+	progress.Status = util.RolloutSystemFailed
+	progress.Message = message
+	progress.FinishedAt = time.Now()
+
+	logrus.Warnf("[rollout] update of %s failed: %s", progress.GardenSystemID, message)
+
+	if err := db.UpdateRolloutSystem(progress); err != nil {
+		logrus.Errorf("[rollout] unable to save progress of %s: %s", progress.GardenSystemID, err)
+	}
+
+	if rollout.Status != util.RolloutRunning {
+		return
+	}
+
+	rollout.Status = util.RolloutPaused
+	rollout.Message = fmt.Sprintf("update of %s failed: %s", progress.GardenSystemID, message)
+
+	if err := db.SetRolloutStatus(rollout.ID, rollout.Status, rollout.Message); err != nil {
+		logrus.Errorf("[rollout] unable to pause rollout %d: %s", rollout.ID, err)
+	}
+
+	logrus.Warnf("[rollout] paused rollout %d", rollout.ID)
+}
+
+// Finds the progress of a system that is being updated by the active rollout. Must be called with the lock held.
+func findUpdating(id string) (util.Rollout, *util.RolloutSystem, bool) {
+	rollout, err := db.GetActiveRollout()
+	if err != nil {
+		return rollout, nil, false
+	}
+
+	for i := range rollout.Systems {
+		progress := &rollout.Systems[i]
+		if progress.GardenSystemID == id && progress.Status == util.RolloutSystemUpdating {
+			return rollout, progress, true
+		}
+	}
+
+	return rollout, nil, false
+}
+
+// Pauses the rollout when a system reports that its update failed. Runs inside the MQTT callback.
+func handleMessage(id, name string, payload []byte) {
+	if name != "ota" {
+		return
+	}
+
+	var status util.OTAStatus
+	if err := json.Unmarshal(payload, &status); err != nil || status.Success {
+		return
+	}
+
+	go func() {
+		lock.Lock()
+		defer lock.Unlock()
+
+		rollout, progress, ok := findUpdating(id)
+		if !ok {
+			return
+		}
+
+		fail(&rollout, progress, status.Message)
+		broadcast(rollout.ID)
+	}()
+}
+
+// Marks a system as updated once it announces the version of the build it was sent.
+func handleDiscovery(system util.GardenSystem) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	rollout, progress, ok := findUpdating(system.Identifier)
+	if !ok {
+		return
+	}
+
+	// Systems can announce themselves while still downloading the update, so another version isn't a failure yet.
+	version := system.Announcement.AppVersion
+	if version != progress.ExpectedVersion {
+		progress.Message = fmt.Sprintf("announced version %s", version)
+
+		if err := db.UpdateRolloutSystem(progress); err != nil {
+			logrus.Errorf("[rollout] unable to save progress of %s: %s", progress.GardenSystemID, err)
+		}
+
+		broadcast(rollout.ID)
+		return
+	}
+
+	progress.Status = util.RolloutSystemUpdated
+	progress.Message = ""
+	progress.FinishedAt = time.Now()
+
+	if err := db.UpdateRolloutSystem(progress); err != nil {
+		logrus.Errorf("[rollout] unable to save progress of %s: %s", progress.GardenSystemID, err)
+		return
+	}
+
+	logrus.Printf("[rollout] %s was updated to %s", system.Identifier, version)
+
+	advance(rollout)
+	broadcast(rollout.ID)
+}
+
+// Fails every update that didn't finish in time.
+func checkDeadlines(now time.Time) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	rollout, err := db.GetActiveRollout()
+	if err != nil {
+		return
+	}
+
+	changed := false
+	for i := range rollout.Systems {
+		progress := &rollout.Systems[i]
+		if progress.Status != util.RolloutSystemUpdating || now.Before(progress.Deadline) {
+			continue
+		}
+
+		message := fmt.Sprintf("did not announce version %s within %s", progress.ExpectedVersion, updateTimeout)
+		if progress.Message != "" {
+			message += " (" + progress.Message + ")"
+		}
+
+		fail(&rollout, progress, message)
+		changed = true
+	}
+
+	if changed {
+		broadcast(rollout.ID)
+	}
+}
+
+// Sends the current state of a rollout to websocket clients and returns it.
+func broadcast(id uint) util.Rollout {
+	rollout, err := db.GetRollout(id)
+	if err != nil {
+		logrus.Errorf("[rollout] unable to get rollout %d: %s", id, err)
+		return rollout
+	}
+
+	websocket.BroadcastWebsocketMessage("rollout", rollout)
+
+	return rollout
+}
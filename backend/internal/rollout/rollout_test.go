@@ -0,0 +1,168 @@
+package rollout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/command"
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/firmware"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Creates an empty database with a coordinator (aaaaaaaaaaaa), three mesh systems and a stored build of version 2.0.
+// Returns the identifiers that updates were sent to.
+func setupRollout(t *testing.T) *[]string {
+	db.InitializeTestDatabase(t)
+
+	updateTimeout = time.Minute
+
+	sent := &[]string{}
+	t.Cleanup(func() { sendUpdate = command.Send })
+
+	sendUpdate = func(id, command string, encrypt bool) (util.CommandLog, error) {
+		*sent = append(*sent, id)
+		return util.CommandLog{ID: uint(len(*sent))}, nil
+	}
+
+	for _, id := range []string{"aaaaaaaaaaaa", "dddddddddddd", "cccccccccccc", "bbbbbbbbbbbb"} {
+		system := util.GardenSystem{
+			Identifier: id,
+			Announcement: util.GardenSystemInfo{
+				IsMesh:     id != "aaaaaaaaaaaa",
+				Channel:    6,
+				Chipset:    "ESP8266",
+				AppVersion: "1.0",
+			},
+		}
+
+		require.NoError(t, db.CreateSystem(system))
+	}
+
+	_, err := firmware.StoreBuild(firmware.Upload{Chipset: "esp8266", Version: "2.0"}, firmware.BuildTestImage("esp8266", "2.0"))
+	require.NoError(t, err)
+
+	return sent
+}
+
+func startTestRollout(t *testing.T) util.Rollout {
+	rollout, err := Start(Options{Chipset: "esp8266", TargetVersion: "2.0", SSID: "garden", PSK: "password"})
+	require.NoError(t, err)
+
+	return rollout
+}
+
+// Announces a system with the provided firmware version.
+func announce(t *testing.T, id, version string) {
+	system, err := db.GetSystem(id, false)
+	require.NoError(t, err)
+
+	system.Announcement.AppVersion = version
+	require.NoError(t, db.CreateSystem(system))
+
+	handleDiscovery(system)
+}
+
+func statuses(rollout util.Rollout) []util.RolloutSystemStatus {
+	var statuses []util.RolloutSystemStatus
+	for _, system := range rollout.Systems {
+		statuses = append(statuses, system.Status)
+	}
+
+	return statuses
+}
+
+func TestRolloutOrder(t *testing.T) {
+	sent := setupRollout(t)
+
+	// Systems that already run the target version are skipped.
+	announce(t, "dddddddddddd", "2.0")
+
+	_, err := Start(Options{Chipset: "esp8266", TargetVersion: "3.0", SSID: "garden", PSK: "password"})
+	assert.ErrorIs(t, err, firmware.ErrMissing)
+
+	rollout := startTestRollout(t)
+
+	var order []string
+	for _, system := range rollout.Systems {
+		order = append(order, system.GardenSystemID)
+	}
+
+	// The canary is first and the coordinator is last.
+	assert.Equal(t, []string{"bbbbbbbbbbbb", "cccccccccccc", "aaaaaaaaaaaa"}, order)
+	assert.True(t, rollout.Systems[0].Canary)
+	assert.Equal(t, "2.0", rollout.Systems[0].ExpectedVersion)
+	assert.Equal(t, []string{"bbbbbbbbbbbb"}, *sent)
+
+	// Announcing the old version while the update is downloading isn't a failure.
+	announce(t, "bbbbbbbbbbbb", "1.0")
+	assert.Len(t, *sent, 1)
+
+	for i, id := range order {
+		announce(t, id, "2.0")
+		assert.Equal(t, order[:min(i+2, len(order))], *sent)
+	}
+
+	rollout, err = db.GetRollout(rollout.ID)
+	require.NoError(t, err)
+	assert.Equal(t, util.RolloutCompleted, rollout.Status)
+}
+
+func TestRolloutFailure(t *testing.T) {
+	sent := setupRollout(t)
+	rollout := startTestRollout(t)
+
+	// A failed update of the canary pauses the rollout.
+	handleMessage("bbbbbbbbbbbb", "ota", []byte(`{"Success":false,"Message":"checksum mismatch"}`))
+
+	assert.Eventually(t, func() bool {
+		rollout, _ = db.GetRollout(rollout.ID)
+		return rollout.Status == util.RolloutPaused
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, "checksum mismatch", rollout.Systems[0].Message)
+	assert.Equal(t, []util.RolloutSystemStatus{
+		util.RolloutSystemFailed, util.RolloutSystemPending, util.RolloutSystemPending, util.RolloutSystemPending,
+	}, statuses(rollout))
+
+	// Resuming retries the failed canary before anything else.
+	rollout, err := Resume(rollout.ID)
+	require.NoError(t, err)
+	assert.Equal(t, util.RolloutRunning, rollout.Status)
+	assert.Equal(t, []string{"bbbbbbbbbbbb", "bbbbbbbbbbbb"}, *sent)
+	assert.Equal(t, util.RolloutSystemUpdating, rollout.Systems[0].Status)
+
+	_, err = Resume(rollout.ID)
+	assert.ErrorIs(t, err, ErrNotPaused)
+
+	// Updates that don't finish in time fail and pause the rollout again.
+	checkDeadlines(time.Now().Add(2 * updateTimeout))
+
+	rollout, err = db.GetRollout(rollout.ID)
+	require.NoError(t, err)
+	assert.Equal(t, util.RolloutPaused, rollout.Status)
+	assert.Equal(t, util.RolloutSystemFailed, rollout.Systems[0].Status)
+	assert.Contains(t, rollout.Systems[0].Message, "did not announce version 2.0")
+
+	// A build that was deleted after the rollout started can't be sent.
+	build, err := firmware.GetBuild("esp8266", "2.0")
+	require.NoError(t, err)
+	require.NoError(t, db.DeleteFirmwareBuild(build.ID))
+
+	rollout, err = Resume(rollout.ID)
+	require.NoError(t, err)
+	assert.Equal(t, util.RolloutPaused, rollout.Status)
+	assert.Contains(t, rollout.Message, "no esp8266 build with version 2.0")
+	assert.Len(t, *sent, 2)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
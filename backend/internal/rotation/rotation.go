@@ -0,0 +1,265 @@
+// Package rotation replaces the mesh key without reflashing systems.
+//
+// Only systems that announce "KR":true in their discovery message support the commands below. A rotation can't be
+// started while any known system doesn't, as that system would never acknowledge the new key.
+//
+// Starting a rotation generates a new key and sends it to every system as an encrypted command, which is encrypted
+// with the current key:
+//
+//	{"Command":"rotate","Key":"<new key>"}
+//
+// Systems must store the new key without discarding the current one and keep accepting mesh messages and commands
+// authenticated with either key. Once stored, systems acknowledge the new key by publishing the following to
+// garden/module/<id>/tele/key, where proof is the hex encoded HMAC-SHA256 of "key-rotation-ack-<id>" keyed with the new
+// key and <id> is the system's lowercase identifier:
+//
+//	{"Proof":"<proof>"}
+//
+// Systems that are offline or fail to acknowledge the key are sent it again whenever they next announce themselves.
+// Once every system has acknowledged the new key, the backend switches to it and sends each system the following
+// command, encrypted with the new key. Systems must then discard the old key.
+//
+//	{"Command":"rotate-commit"}
+//
+// If a rotation is cancelled, systems are sent {"Command":"rotate-abort"} encrypted with the current key and must
+// discard the new key.
+package rotation
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ConfusedPolarBear/garden/internal/command"
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/mqtt"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+	"github.com/ConfusedPolarBear/garden/internal/websocket"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrUnsupported = errors.New("key rotation is not supported by")
+
+// Send commands to systems. Replaced by tests, which have no MQTT broker to publish to.
+var (
+	sendCommand    = command.Send
+	sendCommandNow = command.SendNow
+)
+
+// Registers the MQTT handlers used to track rotation progress. Must be called before MQTT is setup.
+func Setup() {
+	mqtt.HandleTelemetry("key", handleAcknowledgement)
+	mqtt.OnDiscovery(handleDiscovery)
+}
+
+// Starts a new key rotation and sends the new key to every known system. Fails if any system doesn't support key
+// rotation.
+func Start() (util.KeyRotation, error) {
+	var ids, unsupported []string
+	for _, system := range db.GetAllSystems() {
+		ids = append(ids, system.Identifier)
+
+		if !system.Announcement.KeyRotation {
+			unsupported = append(unsupported, system.Identifier)
+		}
+	}
+
+	if len(ids) == 0 {
+		return util.KeyRotation{}, errors.New("no systems to rotate the key of")
+	} else if len(unsupported) > 0 {
+		return util.KeyRotation{}, fmt.Errorf("%w %s", ErrUnsupported, strings.Join(unsupported, ", "))
+	}
+
+	key := util.NewMeshKey()
+
+	rotation, err := db.StartKeyRotation(key, ids)
+	if err != nil {
+		return rotation, err
+	}
+
+	logrus.Printf("[rotation] started key rotation %d for %d systems", rotation.ID, len(ids))
+
+	for _, id := range ids {
+		sendKey(rotation.ID, id, key)
+	}
+
+	return broadcast(), nil
+}
+
+// Cancels the active rotation and tells every system to discard the new key.
+func Cancel() error {
+	rotation, err := db.GetActiveKeyRotation()
+	if err != nil {
+		return err
+	}
+
+	if err := db.CancelKeyRotation(rotation.ID); err != nil {
+		return err
+	}
+
+	logrus.Warnf("[rotation] cancelled key rotation %d", rotation.ID)
+
+	for _, system := range rotation.Systems {
+		if _, err := sendCommand(system.GardenSystemID, `{"Command":"rotate-abort"}`, true); err != nil {
+			logrus.Warnf("[rotation] unable to abort key rotation on %s: %s", system.GardenSystemID, err)
+		}
+	}
+
+	broadcast()
+
+	return nil
+}
+
+// Completes the active rotation if every system in it has acknowledged the new key. Called after systems are deleted
+// since a deleted system will never acknowledge the key.
+func CheckComplete() {
+	rotation, err := db.GetActiveKeyRotation()
+	if err != nil {
+		return
+	}
+
+	for _, system := range rotation.Systems {
+		if system.Status != util.RotationAcknowledged {
+			return
+		}
+	}
+
+	complete(rotation)
+}
+
+// Sends the pending key to a system and records the attempt. The key is resent whenever the system announces itself,
+// so it bypasses the offline command queue.
+func sendKey(rotationId uint, id, key string) {
+	payload := util.Marshal(struct {
+		Command string
+		Key     string
+	}{Command: "rotate", Key: key})
+
+	_, err := sendCommandNow(id, string(payload), true)
+	if err != nil {
+		logrus.Warnf("[rotation] unable to send new key to %s: %s", id, err)
+	}
+
+	if err := db.SetKeyRotationSent(rotationId, id, err); err != nil {
+		logrus.Errorf("[rotation] unable to record progress for %s: %s", id, err)
+	}
+}
+
+// Switches to the new key and tells every system to discard the old one.
+func complete(rotation util.KeyRotation) {
+	if err := db.CompleteKeyRotation(rotation.ID); err != nil {
+		logrus.Errorf("[rotation] unable to complete key rotation %d: %s", rotation.ID, err)
+		return
+	}
+
+	command.ResetSealer()
+
+	logrus.Printf("[rotation] every system acknowledged the new key, completed key rotation %d", rotation.ID)
+
+	for _, system := range rotation.Systems {
+		if _, err := sendCommand(system.GardenSystemID, `{"Command":"rotate-commit"}`, true); err != nil {
+			logrus.Warnf("[rotation] unable to commit new key on %s: %s", system.GardenSystemID, err)
+		}
+	}
+
+	broadcast()
+}
+
+func handleAcknowledgement(system *util.GardenSystem, payload []byte) {
+	var ack struct {
+		Proof string
+	}
+
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		logrus.Warnf("[rotation] unable to unmarshal key acknowledgement from %s: %s", system.Identifier, err)
+		return
+	}
+
+	rotation, err := db.GetActiveKeyRotation()
+	if err != nil {
+		logrus.Warnf("[rotation] ignoring key acknowledgement from %s as no rotation is in progress", system.Identifier)
+		return
+	}
+
+	config, err := db.GetConfiguration()
+	if err != nil {
+		return
+	}
+
+	proof, err := hex.DecodeString(ack.Proof)
+	if err != nil || !hmac.Equal(proof, util.KeyRotationProof(config.PendingMeshKey, system.Identifier)) {
+		logrus.Warnf("[rotation] rejecting key acknowledgement from %s: invalid proof", system.Identifier)
+		return
+	}
+
+	remaining, err := db.AcknowledgeKeyRotation(rotation.ID, system.Identifier)
+	if err != nil {
+		logrus.Errorf("[rotation] unable to record acknowledgement from %s: %s", system.Identifier, err)
+		return
+	}
+
+	logrus.Printf("[rotation] %s acknowledged the new key, %d systems remaining", system.Identifier, remaining)
+
+	// Unlike discovery handlers, telemetry handlers run inside the MQTT callback, so the commit commands sent when the
+	// rotation completes must be published from a new goroutine.
+	if remaining == 0 {
+		go CheckComplete()
+	} else {
+		broadcast()
+	}
+}
+
+// Sends the pending key to systems that restarted or were discovered during a rotation.
+func handleDiscovery(system util.GardenSystem) {
+	rotation, err := db.GetActiveKeyRotation()
+	if err != nil {
+		return
+	}
+
+	progress, err := db.AddKeyRotationSystem(rotation.ID, system.Identifier)
+	if err != nil {
+		logrus.Errorf("[rotation] unable to add %s to key rotation: %s", system.Identifier, err)
+		return
+	} else if progress.Status == util.RotationAcknowledged {
+		return
+	}
+
+	// The rotation can't complete until the system is updated to firmware that supports it or is deleted.
+	if !system.Announcement.KeyRotation {
+		logrus.Warnf("[rotation] %s joined key rotation %d but doesn't support key rotation", system.Identifier, rotation.ID)
+
+		err := fmt.Errorf("%w %s", ErrUnsupported, system.Identifier)
+		if err := db.SetKeyRotationSent(rotation.ID, system.Identifier, err); err != nil {
+			logrus.Errorf("[rotation] unable to record progress for %s: %s", system.Identifier, err)
+		}
+
+		broadcast()
+		return
+	}
+
+	config, err := db.GetConfiguration()
+	if err != nil {
+		return
+	}
+
+	logrus.Debugf("[rotation] resending new key to %s", system.Identifier)
+
+	sendKey(rotation.ID, system.Identifier, config.PendingMeshKey)
+	broadcast()
+}
+
+// Sends the progress of the active or most recent rotation to websocket clients and returns it.
+func broadcast() util.KeyRotation {
+	var rotation util.KeyRotation
+	if rotations := db.GetKeyRotations(1); len(rotations) > 0 {
+		rotation = rotations[0]
+	}
+
+	websocket.BroadcastWebsocketMessage("rotation", rotation)
+
+	return rotation
+}
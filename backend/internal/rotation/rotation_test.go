@@ -0,0 +1,210 @@
+package rotation
+
+import (
+	"encoding/hex"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/command"
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Commands sent to systems during a test, keyed by system identifier.
+type sentCommands struct {
+	lock     sync.Mutex
+	commands map[string][]string
+}
+
+func (s *sentCommands) get(id string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]string(nil), s.commands[id]...)
+}
+
+// Creates an empty database with two systems that support key rotation.
+func setupRotation(t *testing.T) *sentCommands {
+	db.InitializeTestDatabase(t)
+
+	sent := &sentCommands{commands: map[string][]string{}}
+	record := func(id, cmd string, encrypt bool) (util.CommandLog, error) {
+		sent.lock.Lock()
+		defer sent.lock.Unlock()
+
+		sent.commands[id] = append(sent.commands[id], cmd)
+		return util.CommandLog{}, nil
+	}
+
+	sendCommand, sendCommandNow = record, record
+	t.Cleanup(func() { sendCommand, sendCommandNow = command.Send, command.SendNow })
+
+	for _, id := range []string{"aaaaaaaaaaaa", "bbbbbbbbbbbb"} {
+		createSystem(t, id, true)
+	}
+
+	return sent
+}
+
+func createSystem(t *testing.T, id string, supported bool) util.GardenSystem {
+	system := util.GardenSystem{
+		Identifier:   id,
+		Announcement: util.GardenSystemInfo{IsMesh: true, KeyRotation: supported},
+	}
+
+	require.NoError(t, db.CreateSystem(system))
+
+	return system
+}
+
+// Acknowledges the pending key on behalf of a system with a proof made from the provided key.
+func acknowledge(t *testing.T, id, key string) {
+	system, err := db.GetSystem(id, false)
+	require.NoError(t, err)
+
+	proof := hex.EncodeToString(util.KeyRotationProof(key, id))
+	handleAcknowledgement(&system, []byte(`{"Proof":"`+proof+`"}`))
+}
+
+func getProgress(t *testing.T, id string) util.KeyRotationProgress {
+	rotation, err := db.GetActiveKeyRotation()
+	require.NoError(t, err)
+
+	for _, progress := range rotation.Systems {
+		if progress.GardenSystemID == id {
+			return progress
+		}
+	}
+
+	require.Failf(t, "system not found", "%s is not part of the rotation", id)
+	return util.KeyRotationProgress{}
+}
+
+func TestStartUnsupported(t *testing.T) {
+	sent := setupRotation(t)
+	createSystem(t, "cccccccccccc", false)
+
+	_, err := Start()
+	assert.ErrorIs(t, err, ErrUnsupported)
+	assert.Contains(t, err.Error(), "cccccccccccc")
+	assert.Empty(t, sent.get("aaaaaaaaaaaa"))
+
+	_, err = db.GetActiveKeyRotation()
+	assert.Error(t, err)
+}
+
+func TestAcknowledgement(t *testing.T) {
+	sent := setupRotation(t)
+
+	before, err := db.GetConfiguration()
+	require.NoError(t, err)
+
+	_, err = Start()
+	require.NoError(t, err)
+
+	config, err := db.GetConfiguration()
+	require.NoError(t, err)
+	key := config.PendingMeshKey
+
+	for _, id := range []string{"aaaaaaaaaaaa", "bbbbbbbbbbbb"} {
+		assert.Equal(t, []string{`{"Command":"rotate","Key":"` + key + `"}`}, sent.get(id))
+	}
+
+	// Proofs must be made with the new key for the acknowledging system.
+	acknowledge(t, "aaaaaaaaaaaa", before.MeshKey)
+	acknowledge(t, "aaaaaaaaaaaa", util.NewMeshKey())
+
+	system, err := db.GetSystem("aaaaaaaaaaaa", false)
+	require.NoError(t, err)
+	other := hex.EncodeToString(util.KeyRotationProof(key, "bbbbbbbbbbbb"))
+	handleAcknowledgement(&system, []byte(`{"Proof":"`+other+`"}`))
+	handleAcknowledgement(&system, []byte(`{"Proof":"not hex"}`))
+
+	assert.Equal(t, util.RotationSent, getProgress(t, "aaaaaaaaaaaa").Status)
+
+	acknowledge(t, "aaaaaaaaaaaa", key)
+	assert.Equal(t, util.RotationAcknowledged, getProgress(t, "aaaaaaaaaaaa").Status)
+
+	// The new key is only used once every system acknowledged it.
+	config, err = db.GetConfiguration()
+	require.NoError(t, err)
+	assert.Equal(t, before.MeshKey, config.MeshKey)
+
+	acknowledge(t, "bbbbbbbbbbbb", key)
+
+	assert.Eventually(t, func() bool {
+		_, err := db.GetActiveKeyRotation()
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+
+	config, err = db.GetConfiguration()
+	require.NoError(t, err)
+	assert.Equal(t, key, config.MeshKey)
+
+	assert.Eventually(t, func() bool {
+		commands := sent.get("bbbbbbbbbbbb")
+		return len(commands) == 2 && commands[1] == `{"Command":"rotate-commit"}`
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCheckCompleteAfterDelete(t *testing.T) {
+	sent := setupRotation(t)
+
+	_, err := Start()
+	require.NoError(t, err)
+
+	config, err := db.GetConfiguration()
+	require.NoError(t, err)
+
+	acknowledge(t, "aaaaaaaaaaaa", config.PendingMeshKey)
+
+	// The rotation waits for the remaining system until it's deleted.
+	CheckComplete()
+	_, err = db.GetActiveKeyRotation()
+	require.NoError(t, err)
+
+	require.NoError(t, db.DeleteSystem("bbbbbbbbbbbb"))
+	CheckComplete()
+
+	_, err = db.GetActiveKeyRotation()
+	assert.Error(t, err)
+
+	assert.Equal(t, `{"Command":"rotate-commit"}`, sent.get("aaaaaaaaaaaa")[1])
+	assert.Len(t, sent.get("bbbbbbbbbbbb"), 1)
+}
+
+func TestResendOnDiscovery(t *testing.T) {
+	sent := setupRotation(t)
+
+	_, err := Start()
+	require.NoError(t, err)
+
+	config, err := db.GetConfiguration()
+	require.NoError(t, err)
+
+	// Systems that didn't acknowledge the key are sent it again when they announce themselves.
+	system, err := db.GetSystem("bbbbbbbbbbbb", false)
+	require.NoError(t, err)
+	handleDiscovery(system)
+
+	assert.Len(t, sent.get("bbbbbbbbbbbb"), 2)
+	assert.Equal(t, 2, getProgress(t, "bbbbbbbbbbbb").Attempts)
+
+	acknowledge(t, "bbbbbbbbbbbb", config.PendingMeshKey)
+	handleDiscovery(system)
+	assert.Len(t, sent.get("bbbbbbbbbbbb"), 2)
+
+	// Systems discovered during the rotation join it, but are never sent a key they can't use.
+	handleDiscovery(createSystem(t, "cccccccccccc", true))
+	assert.Len(t, sent.get("cccccccccccc"), 1)
+	assert.Equal(t, util.RotationSent, getProgress(t, "cccccccccccc").Status)
+
+	handleDiscovery(createSystem(t, "dddddddddddd", false))
+	assert.Empty(t, sent.get("dddddddddddd"))
+	assert.Equal(t, util.RotationFailed, getProgress(t, "dddddddddddd").Status)
+	assert.Contains(t, getProgress(t, "dddddddddddd").Error, "not supported")
+}
@@ -0,0 +1,77 @@
+// Package scheduler sends commands to systems according to cron expressions.
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ConfusedPolarBear/garden/internal/command"
+	"github.com/ConfusedPolarBear/garden/internal/cron"
+	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/util"
+	"github.com/ConfusedPolarBear/garden/internal/websocket"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Runs that are late by more than this, usually because the server wasn't running, are skipped instead of sent.
+// Catching up could otherwise restart every system at once when the server starts.
+const missedRunGrace = time.Minute
+
+// Starts sending scheduled commands in the background.
+func Start() {
+	go func() {
+		for now := range time.Tick(10 * time.Second) {
+			for _, schedule := range db.GetDueSchedules(now) {
+				run(schedule, now)
+			}
+		}
+	}()
+}
+
+// Validates the schedule's cron expression and calculates its next run.
+func Prepare(schedule *util.Schedule, now time.Time) error {
+	expression, err := cron.Parse(schedule.Expression)
+	if err != nil {
+		return err
+	}
+
+	schedule.NextRun = time.Time{}
+	if schedule.Enabled {
+		schedule.NextRun = expression.Next(now)
+	}
+
+	return nil
+}
+
+// Sends the command of a due schedule and records the run.
+func run(schedule util.Schedule, now time.Time) {
+	next := time.Time{}
+	if expression, err := cron.Parse(schedule.Expression); err == nil {
+		next = expression.Next(now)
+	}
+
+	result := util.ScheduleRun{ScheduleID: schedule.ID, CreatedAt: now}
+
+	if late := now.Sub(schedule.NextRun); late > missedRunGrace {
+		result.Error = fmt.Sprintf("skipped run that was due %s ago", late.Round(time.Second))
+		logrus.Warnf("[scheduler] %s for schedule %d (%s)", result.Error, schedule.ID, schedule.Name)
+	} else {
+		logrus.Printf("[scheduler] sending %s command to %s for schedule %d (%s)",
+			schedule.CommandName, schedule.GardenSystemID, schedule.ID, schedule.Name)
+
+		entry, err := command.Send(schedule.GardenSystemID, schedule.Command, true)
+		result.CommandLogID = entry.ID
+
+		if err != nil {
+			result.Error = err.Error()
+			logrus.Warnf("[scheduler] unable to send command for schedule %d: %s", schedule.ID, err)
+		}
+	}
+
+	if err := db.RecordScheduleRun(&result, next); err != nil {
+		logrus.Errorf("[scheduler] unable to record run of schedule %d: %s", schedule.ID, err)
+	}
+
+	websocket.BroadcastWebsocketMessage("schedule", result)
+}
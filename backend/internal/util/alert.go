@@ -0,0 +1,103 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Rule that raises an alert when a metric crosses a threshold for a period of time.
+type AlertRule struct {
+	ID        uint
+	CreatedAt time.Time
+
+	Name string
+
+	// System that this rule applies to. Rules without a system apply to every system.
+	GardenSystemID string
+
+	// Reading field to check. Either "temperature" or "humidity".
+	Metric string
+
+	// Comparison between the metric and the threshold. One of >, >=, < or <=.
+	Operator  string
+	Threshold float32
+
+	// Number of seconds the condition must hold for before an alert is raised.
+	Duration int
+
+	Enabled bool
+}
+
+// Validates the rule's metric, operator and system.
+func (r AlertRule) Validate() error {
+	if r.Name == "" || len(r.Name) > 64 {
+		return errors.New("name must be between 1 and 64 characters")
+	}
+
+	if r.Metric != "temperature" && r.Metric != "humidity" {
+		return fmt.Errorf("unknown metric %s", r.Metric)
+	}
+
+	if r.Operator != ">" && r.Operator != ">=" && r.Operator != "<" && r.Operator != "<=" {
+		return fmt.Errorf("unknown operator %s", r.Operator)
+	}
+
+	if r.GardenSystemID != "" && !SystemIdentifierRegex.MatchString(r.GardenSystemID) {
+		return errors.New("invalid system identifier")
+	}
+
+	if r.Duration < 0 {
+		return errors.New("duration cannot be negative")
+	}
+
+	return nil
+}
+
+// Returns the value of this rule's metric from the reading.
+func (r AlertRule) Value(reading Reading) float32 {
+	if r.Metric == "humidity" {
+		return reading.Humidity
+	}
+
+	return reading.Temperature
+}
+
+// Returns true if the reading violates this rule.
+func (r AlertRule) Matches(reading Reading) bool {
+	v := r.Value(reading)
+
+	switch r.Operator {
+	case ">":
+		return v > r.Threshold
+	case ">=":
+		return v >= r.Threshold
+	case "<":
+		return v < r.Threshold
+	case "<=":
+		return v <= r.Threshold
+	}
+
+	return false
+}
+
+// An alert raised by a rule for a single system. Alerts that have not been cleared are active.
+type Alert struct {
+	ID             uint
+	AlertRuleID    uint
+	GardenSystemID string
+
+	Message string
+
+	// Value of the metric when the alert was raised.
+	Value float32
+
+	RaisedAt time.Time
+
+	// Zero while the alert is active.
+	ClearedAt time.Time
+}
+
+func (a Alert) Active() bool {
+	return a.ClearedAt.IsZero()
+}
@@ -0,0 +1,44 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertRuleMatches(t *testing.T) {
+	reading := Reading{Temperature: 30, Humidity: 80}
+
+	tests := []struct {
+		metric    string
+		operator  string
+		threshold float32
+		expected  bool
+	}{
+		{"temperature", ">", 25, true},
+		{"temperature", ">", 30, false},
+		{"temperature", ">=", 30, true},
+		{"temperature", "<", 30, false},
+		{"humidity", "<=", 80, true},
+		{"humidity", "<", 50, false},
+	}
+
+	for _, test := range tests {
+		rule := AlertRule{Metric: test.metric, Operator: test.operator, Threshold: test.threshold}
+		assert.Equal(t, test.expected, rule.Matches(reading), "%s %s %f", test.metric, test.operator, test.threshold)
+	}
+}
+
+func TestAlertRuleValidate(t *testing.T) {
+	rule := AlertRule{Name: "Hot", Metric: "temperature", Operator: ">", Threshold: 35, Duration: 600}
+	assert.NoError(t, rule.Validate())
+
+	rule.Operator = "=="
+	assert.Error(t, rule.Validate())
+
+	rule.Operator, rule.Metric = ">", "pressure"
+	assert.Error(t, rule.Validate())
+
+	rule.Metric, rule.GardenSystemID = "humidity", "invalid"
+	assert.Error(t, rule.Validate())
+}
@@ -0,0 +1,91 @@
+package util
+
+import "time"
+
+// Tracks the sequence numbers of encrypted commands sent to a system. See the envelope package for details.
+type CommandSequence struct {
+	GardenSystemID string `gorm:"primaryKey"`
+
+	// Sequence number of the last command sent to this system, including broadcasts.
+	LastSent uint64
+
+	// Sequence number of the last command this system acknowledged.
+	LastAccepted uint64
+}
+
+type CommandStatus string
+
+const (
+	// The command was logged but hasn't been published yet.
+	CommandQueued CommandStatus = "queued"
+
+	// The command was published and is waiting for a reply.
+	CommandSent CommandStatus = "sent"
+
+	// The system replied to the command.
+	CommandAcked CommandStatus = "acked"
+
+	// The command couldn't be sent or the system reported that it failed.
+	CommandFailed CommandStatus = "failed"
+
+	// The system didn't reply before the deadline.
+	CommandTimeout CommandStatus = "timeout"
+)
+
+// A command sent to a system. Command payloads can contain secrets like Wi-Fi passwords, so only the command's name
+// is stored.
+type CommandLog struct {
+	ID        uint
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// Destination of the command. Broadcast commands use FFFFFFFFFFFF.
+	GardenSystemID string `gorm:"index"`
+
+	// Name of the command, such as "restart". Empty if the command isn't a JSON object.
+	Name      string
+	Encrypted bool
+
+	// Sequence number the command was encrypted with, if any.
+	Sequence uint64
+
+	Status CommandStatus `gorm:"index"`
+
+	// Telemetry topic that acknowledges this command, such as "ping" or "discovery". Commands without a reply are
+	// never acknowledged.
+	Reply string
+
+	// Reason the command failed or the reply from the system.
+	Message string
+
+	SentAt  time.Time
+	AckedAt time.Time
+
+	// Time the command times out at if it hasn't been acknowledged. Zero if the command doesn't time out.
+	Deadline time.Time
+}
+
+// Returns true if the command has reached a final state.
+func (c CommandLog) Finished() bool {
+	return c.Status == CommandAcked || c.Status == CommandFailed || c.Status == CommandTimeout
+}
+
+// A command waiting for an offline or sleeping system to wake up. The payload must be stored so that it can be
+// delivered later, so unlike the command log, queued commands can contain secrets. The payload is never returned by the
+// API.
+type QueuedCommand struct {
+	ID        uint
+	CreatedAt time.Time
+
+	GardenSystemID string `gorm:"index"`
+
+	// Log entry that records the outcome of this command. The entry stays queued until the command is delivered.
+	CommandLogID uint
+
+	Name      string
+	Command   string `json:"-"`
+	Encrypted bool
+
+	// The command is discarded if the system doesn't wake up before this time.
+	ExpiresAt time.Time
+}
@@ -1,11 +1,21 @@
 package util
 
+import "encoding/base64"
+
 type Configuration struct {
 	ID uint
 
 	// Raw mesh key. Used to authenticate mesh messages & derive all other keys.
 	MeshKey string
 
+	// Replacement mesh key that is being distributed to systems. Empty unless a key rotation is in progress.
+	PendingMeshKey string
+
 	// Derived symmetric key for ChaCha20-Poly1305 operations.
 	ChaChaKey []byte `gorm:"-"`
 }
+
+// Generates a new random mesh key.
+func NewMeshKey() string {
+	return base64.RawStdEncoding.EncodeToString(SecureRandom(48))
+}
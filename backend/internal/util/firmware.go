@@ -0,0 +1,38 @@
+package util
+
+import "time"
+
+// A firmware image uploaded to the server. Images are stored in data/firmware/<chipset>/builds/<version>.bin.
+type FirmwareBuild struct {
+	ID uint
+
+	// Time the build was uploaded.
+	CreatedAt time.Time
+
+	// Lowercase chipset the build is for, either "esp8266" or "esp32".
+	Chipset string `gorm:"index:idx_firmware_version,unique"`
+	Version string `gorm:"index:idx_firmware_version,unique"`
+
+	// Hex encoded checksums of the image.
+	SHA256 string
+	MD5    string
+
+	Size  int64
+	Notes string
+
+	// Version embedded in the image, which systems announce once they run it. Empty for images that don't embed one.
+	ImageVersion string
+
+	// The default build of a chipset is served from /fw82 or /fw32 and sent to systems when no version is requested.
+	Default bool `gorm:"column:is_default"`
+}
+
+// Returns the version that systems announce after installing this build. Builds without an embedded version are
+// expected to announce the version they were uploaded as.
+func (b FirmwareBuild) AppVersion() string {
+	if b.ImageVersion != "" {
+		return b.ImageVersion
+	}
+
+	return b.Version
+}
@@ -0,0 +1,80 @@
+package util
+
+import "time"
+
+// Mesh counters reported by a system. Counters are cumulative since the system last booted.
+type MeshStatistics struct {
+	ID             uint      `json:"-"`
+	GardenSystemID string    `gorm:"index"`
+	CreatedAt      time.Time `gorm:"index"`
+
+	TotalSent          int
+	TotalReceived      int
+	DroppedBadLength   int
+	DroppedInvalidAuth int
+	TotalAccepted      int
+}
+
+// Latest mesh statistics of a system along with recent rates.
+type MeshReport struct {
+	Identifier string
+	Statistics MeshStatistics
+	Rates      MeshRates
+}
+
+// Average hourly rate of each mesh counter over a span of time.
+type MeshRates struct {
+	From time.Time
+	To   time.Time
+
+	SentPerHour               float64
+	ReceivedPerHour           float64
+	DroppedBadLengthPerHour   float64
+	DroppedInvalidAuthPerHour float64
+	AcceptedPerHour           float64
+}
+
+// Computes hourly rates from samples sorted oldest first. Counters that decrease between two samples are assumed to
+// have been reset by a reboot, so the newer value is used as the increase.
+func ComputeMeshRates(samples []MeshStatistics) MeshRates {
+	var rates MeshRates
+
+	if len(samples) < 2 {
+		return rates
+	}
+
+	rates.From = samples[0].CreatedAt
+	rates.To = samples[len(samples)-1].CreatedAt
+
+	hours := rates.To.Sub(rates.From).Hours()
+	if hours <= 0 {
+		return rates
+	}
+
+	delta := func(previous, current int) float64 {
+		if current < previous {
+			return float64(current)
+		}
+
+		return float64(current - previous)
+	}
+
+	var sent, received, badLength, invalidAuth, accepted float64
+	for i := 1; i < len(samples); i++ {
+		p, c := samples[i-1], samples[i]
+
+		sent += delta(p.TotalSent, c.TotalSent)
+		received += delta(p.TotalReceived, c.TotalReceived)
+		badLength += delta(p.DroppedBadLength, c.DroppedBadLength)
+		invalidAuth += delta(p.DroppedInvalidAuth, c.DroppedInvalidAuth)
+		accepted += delta(p.TotalAccepted, c.TotalAccepted)
+	}
+
+	rates.SentPerHour = sent / hours
+	rates.ReceivedPerHour = received / hours
+	rates.DroppedBadLengthPerHour = badLength / hours
+	rates.DroppedInvalidAuthPerHour = invalidAuth / hours
+	rates.AcceptedPerHour = accepted / hours
+
+	return rates
+}
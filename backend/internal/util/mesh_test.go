@@ -0,0 +1,31 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeMeshRates(t *testing.T) {
+	base := time.Date(2021, 12, 1, 12, 0, 0, 0, time.UTC)
+
+	samples := []MeshStatistics{
+		{CreatedAt: base, TotalSent: 10, DroppedInvalidAuth: 4},
+		{CreatedAt: base.Add(30 * time.Minute), TotalSent: 20, DroppedInvalidAuth: 6},
+
+		// Rebooted, so every counter starts over
+		{CreatedAt: base.Add(2 * time.Hour), TotalSent: 5, DroppedInvalidAuth: 2},
+	}
+
+	rates := ComputeMeshRates(samples)
+	assert.Equal(t, base, rates.From)
+	assert.Equal(t, base.Add(2*time.Hour), rates.To)
+	assert.Equal(t, 7.5, rates.SentPerHour)
+	assert.Equal(t, float64(2), rates.DroppedInvalidAuthPerHour)
+	assert.Equal(t, float64(0), rates.AcceptedPerHour)
+}
+
+func TestComputeMeshRatesSingleSample(t *testing.T) {
+	assert.Equal(t, MeshRates{}, ComputeMeshRates([]MeshStatistics{{TotalSent: 10}}))
+}
@@ -0,0 +1,26 @@
+package util
+
+import "time"
+
+// Results of a Wi-Fi scan performed by a system.
+type NetworkScan struct {
+	ID             uint
+	GardenSystemID string `gorm:"index"`
+	CreatedAt      time.Time
+
+	Networks []ScannedNetwork
+}
+
+// A single access point found by a Wi-Fi scan.
+type ScannedNetwork struct {
+	ID            uint `json:"-"`
+	NetworkScanID uint `json:"-" gorm:"index"`
+
+	// If this access point broadcasts the SSID that the system is configured to connect to.
+	Known bool
+
+	MAC string
+
+	// Signal strength in dBm. Ranges from 0 to -100 (ish).
+	RSSI int
+}
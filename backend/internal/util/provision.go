@@ -0,0 +1,38 @@
+package util
+
+import "time"
+
+// One-time link that gives a single new system the mesh key, either as a flashable filesystem image or as the settings
+// the setup wizard sends over serial. The mesh key is read when the link is used, so links survive key rotations.
+type ProvisioningLink struct {
+	ID        uint
+	CreatedAt time.Time
+	ExpiresAt time.Time
+
+	// Time the link was used. Links can only be used once.
+	UsedAt time.Time
+
+	// SHA256 hash of the raw token. The raw token is only ever shown once, when the link is created.
+	Hash string `gorm:"uniqueIndex;notNull" json:"-"`
+
+	// Username of the administrator that created the link.
+	CreatedBy string
+
+	// Name the system announces on first boot. Optional.
+	Name string
+
+	// If the system connects to Wi-Fi and MQTT itself and acts as the mesh controller. Otherwise it joins the mesh
+	// through the current coordinator.
+	Controller bool
+
+	WifiSSID     string
+	WifiPassword string `json:"-"`
+	MQTTHost     string
+	MQTTUsername string
+	MQTTPassword string `json:"-"`
+}
+
+// Returns true if this link hasn't been used and hasn't expired.
+func (l ProvisioningLink) Usable() bool {
+	return l.UsedAt.IsZero() && time.Now().Before(l.ExpiresAt)
+}
@@ -0,0 +1,124 @@
+package util
+
+import "time"
+
+type RolloutStatus string
+
+const (
+	// Systems are being updated.
+	RolloutRunning RolloutStatus = "running"
+
+	// An update failed. No more updates are started until the rollout is resumed.
+	RolloutPaused RolloutStatus = "paused"
+
+	// Every system was updated.
+	RolloutCompleted RolloutStatus = "completed"
+
+	RolloutCancelled RolloutStatus = "cancelled"
+)
+
+type RolloutSystemStatus string
+
+const (
+	// The update hasn't been sent yet.
+	RolloutSystemPending RolloutSystemStatus = "pending"
+
+	// The update was sent and the system hasn't announced the expected version yet.
+	RolloutSystemUpdating RolloutSystemStatus = "updating"
+
+	// The system announced the expected version.
+	RolloutSystemUpdated RolloutSystemStatus = "updated"
+
+	// The update failed, timed out or the system announced a different version.
+	RolloutSystemFailed RolloutSystemStatus = "failed"
+)
+
+// Number of systems in each state of a rollout.
+type RolloutStatusSummary struct {
+	Pending, Updating, Updated, Failed int
+}
+
+// A firmware update of a group of systems. The canary is updated first and the remaining systems are only updated
+// once it announces the expected version.
+type Rollout struct {
+	ID        uint
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// Systems were selected by chipset, tag or both. Empty fields match every system.
+	Chipset string
+	Tag     string
+
+	// Version of the stored build that systems are updated to. Builds are looked up by this version for every chipset.
+	TargetVersion string
+
+	// Number of systems that are updated at once after the canary.
+	BatchSize int
+
+	// Wi-Fi network and server host that systems download the update with. The PSK is never returned by the API.
+	SSID string
+	PSK  string `json:"-"`
+	Host string
+
+	Status RolloutStatus `gorm:"index"`
+
+	// Reason the rollout was paused.
+	Message string
+
+	CompletedAt time.Time
+
+	Systems []RolloutSystem
+}
+
+// Progress of a single system in a rollout.
+type RolloutSystem struct {
+	ID             uint `json:"-"`
+	RolloutID      uint `gorm:"index" json:"-"`
+	GardenSystemID string
+
+	// Order that systems are updated in. The canary is first.
+	Position int
+	Canary   bool
+
+	Status RolloutSystemStatus
+
+	// Log entry of the most recent update command.
+	CommandLogID uint
+
+	// Firmware version the system announces once it runs the target build. Set when the update is sent.
+	ExpectedVersion string
+
+	// Reason the update failed.
+	Message string
+
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	// Time the update fails at if the system hasn't announced the expected version.
+	Deadline time.Time
+}
+
+// Returns true if the rollout hasn't completed or been cancelled.
+func (r Rollout) Active() bool {
+	return r.Status == RolloutRunning || r.Status == RolloutPaused
+}
+
+// Counts the systems in each state.
+func (r Rollout) Summary() RolloutStatusSummary {
+	var summary RolloutStatusSummary
+
+	for _, s := range r.Systems {
+		switch s.Status {
+		case RolloutSystemPending:
+			summary.Pending++
+		case RolloutSystemUpdating:
+			summary.Updating++
+		case RolloutSystemUpdated:
+			summary.Updated++
+		case RolloutSystemFailed:
+			summary.Failed++
+		}
+	}
+
+	return summary
+}
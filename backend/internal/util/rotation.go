@@ -0,0 +1,63 @@
+package util
+
+import (
+	"strings"
+	"time"
+)
+
+type KeyRotationStatus string
+
+const (
+	// The new key hasn't been sent to the system yet.
+	RotationPending KeyRotationStatus = "pending"
+
+	// The new key was sent but the system hasn't acknowledged it.
+	RotationSent KeyRotationStatus = "sent"
+
+	// The system acknowledged the new key.
+	RotationAcknowledged KeyRotationStatus = "acknowledged"
+
+	// The new key couldn't be sent. It will be sent again when the system next announces itself.
+	RotationFailed KeyRotationStatus = "failed"
+)
+
+// A replacement of the mesh key. Systems keep accepting the old key until every system has acknowledged the new one.
+type KeyRotation struct {
+	ID        uint
+	CreatedAt time.Time
+
+	// Set once every system acknowledged the new key and it replaced the old one.
+	CompletedAt time.Time
+
+	// Set if the rotation was cancelled before it completed.
+	CancelledAt time.Time
+
+	Systems []KeyRotationProgress
+}
+
+// Progress of a single system through a key rotation.
+type KeyRotationProgress struct {
+	ID             uint   `json:"-"`
+	KeyRotationID  uint   `json:"-" gorm:"index"`
+	GardenSystemID string `gorm:"index"`
+
+	Status   KeyRotationStatus
+	Attempts int
+
+	// Reason the last attempt to send the key failed.
+	Error string
+
+	SentAt         time.Time
+	AcknowledgedAt time.Time
+}
+
+// Returns true if the rotation has neither completed nor been cancelled.
+func (r KeyRotation) Active() bool {
+	return r.CompletedAt.IsZero() && r.CancelledAt.IsZero()
+}
+
+// Returns the proof a system must send to acknowledge that it received the new key. Proving possession of the key
+// prevents anyone who can publish to MQTT from completing a rotation on a system's behalf.
+func KeyRotationProof(key, id string) []byte {
+	return DeriveKey("key-rotation-ack-"+strings.ToLower(id), key)
+}
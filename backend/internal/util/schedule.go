@@ -0,0 +1,46 @@
+package util
+
+import "time"
+
+// A command that is sent automatically according to a cron expression.
+type Schedule struct {
+	ID        uint
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Name string
+
+	// Five field cron expression, evaluated in the server's time zone.
+	Expression string
+
+	// System the command is sent to, or FFFFFFFFFFFF to send it to every system.
+	GardenSystemID string `gorm:"index"`
+
+	// Name of the typed command that is sent, such as "restart".
+	CommandName string
+
+	// JSON object of the command's parameters. Secret parameters like passwords are not included.
+	Parameters string
+
+	// Complete command that is sent. Can contain secrets, so it is never returned by the API.
+	Command string `json:"-"`
+
+	Enabled bool
+
+	// Next time the command will be sent. Zero if the schedule is disabled or its expression never matches again.
+	NextRun time.Time `gorm:"index"`
+	LastRun time.Time
+}
+
+// A single run of a schedule.
+type ScheduleRun struct {
+	ID         uint
+	ScheduleID uint `gorm:"index"`
+	CreatedAt  time.Time
+
+	// Log entry of the command that was sent. Zero if the command couldn't be sent.
+	CommandLogID uint
+
+	// Reason the command couldn't be sent, or why the run was skipped.
+	Error string
+}
@@ -6,7 +6,7 @@ import (
 )
 
 // Structs can be generated from JSON strings with https://mholt.github.io/json-to-go/
-// TODO: track alerts per system. possible alerts: flash size mismatch, temperature/humidity out of bounds, etc.
+// TODO: alert on non-threshold conditions like a flash size mismatch.
 
 // Regular expression that all incoming system identifiers must match.
 var SystemIdentifierRegex regexp.Regexp = *regexp.MustCompile("^[a-fA-F0-9]{12}$")
@@ -18,6 +18,12 @@ type GardenSystem struct {
 	UpdatedAt  time.Time
 	DeletedAt  time.Time
 
+	// If this system has sent a message recently. Maintained by the offline monitor.
+	Online bool
+
+	// Last time any message was received from this system.
+	LastSeen time.Time
+
 	Announcement GardenSystemInfo
 
 	LastReading Reading `gorm:"-"`
@@ -45,12 +51,21 @@ type GardenSystemInfo struct {
 	CoreVersion string
 	SdkVersion  string
 
+	// Version of the garden firmware. Empty if the firmware predates version announcements.
+	AppVersion string
+
 	// The chipset this system uses. Currently either "ESP8266" or "ESP32".
 	Chipset string
 
 	FilesystemUsedSize  int
 	FilesystemTotalSize int
 
+	// Newest encrypted command envelope version this system supports. Zero if the system didn't announce one.
+	EnvelopeVersion int
+
+	// If this system can rotate its mesh key without being reflashed (see the rotation package).
+	KeyRotation bool
+
 	Sensors []Sensor
 }
 
@@ -64,7 +79,121 @@ type Reading struct {
 	Humidity       float32
 }
 
+// Records a system going online or offline.
+type SystemStatusChange struct {
+	ID             uint
+	GardenSystemID string `gorm:"index"`
+	CreatedAt      time.Time
+	Online         bool
+}
+
+// Summary of all readings reported by a system during a span of time.
+type ReadingRollup struct {
+	GardenSystemID string    `gorm:"primaryKey"`
+	Start          time.Time `gorm:"primaryKey"`
+
+	// Number of readings summarized by this rollup.
+	Count int
+
+	MinTemperature float32
+	MaxTemperature float32
+	AvgTemperature float32
+
+	MinHumidity float32
+	MaxHumidity float32
+	AvgHumidity float32
+}
+
+// Rollups of raw readings that are older than the raw reading retention period.
+type HourlyReading struct {
+	ReadingRollup
+}
+
+// Rollups of hourly readings that are older than the hourly reading retention period.
+type DailyReading struct {
+	ReadingRollup
+}
+
+// Creates a rollup that summarizes a single reading.
+func NewReadingRollup(reading Reading) ReadingRollup {
+	return ReadingRollup{
+		GardenSystemID: reading.GardenSystemID,
+		Start:          reading.CreatedAt,
+		Count:          1,
+		MinTemperature: reading.Temperature,
+		MaxTemperature: reading.Temperature,
+		AvgTemperature: reading.Temperature,
+		MinHumidity:    reading.Humidity,
+		MaxHumidity:    reading.Humidity,
+		AvgHumidity:    reading.Humidity,
+	}
+}
+
+// Merges another rollup into this one. The start time is not changed.
+func (r *ReadingRollup) Merge(other ReadingRollup) {
+	if other.Count == 0 {
+		return
+	}
+
+	if r.Count == 0 {
+		start := r.Start
+		*r = other
+		r.Start = start
+		return
+	}
+
+	total := float32(r.Count + other.Count)
+	weight := float32(other.Count) / total
+
+	r.AvgTemperature += (other.AvgTemperature - r.AvgTemperature) * weight
+	r.AvgHumidity += (other.AvgHumidity - r.AvgHumidity) * weight
+
+	r.MinTemperature = min32(r.MinTemperature, other.MinTemperature)
+	r.MaxTemperature = max32(r.MaxTemperature, other.MaxTemperature)
+	r.MinHumidity = min32(r.MinHumidity, other.MinHumidity)
+	r.MaxHumidity = max32(r.MaxHumidity, other.MaxHumidity)
+
+	r.Count += other.Count
+}
+
+func min32(a, b float32) float32 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func max32(a, b float32) float32 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// Aggregated readings over a span of time.
+type ReadingBucket struct {
+	// Start of the time span this bucket covers.
+	Start time.Time
+
+	// Number of readings aggregated into this bucket.
+	Count int
+
+	Temperature float32
+	Humidity    float32
+}
+
 type OTAStatus struct {
 	Success  bool
 	Message string
 }
+
+// Regular expression that system tags must match.
+var TagRegex = regexp.MustCompile("^[a-zA-Z0-9_.-]{1,32}$")
+
+// A label attached to a system, used to select groups of systems such as "greenhouse".
+type SystemTag struct {
+	GardenSystemID string `gorm:"primaryKey"`
+	Tag            string `gorm:"primaryKey"`
+}
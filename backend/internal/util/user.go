@@ -0,0 +1,91 @@
+package util
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Permission level granted to a user. Every role includes the permissions of the roles below it.
+type Role string
+
+const (
+	// Read only access to systems and their readings.
+	RoleViewer Role = "viewer"
+
+	// Viewer permissions plus the ability to command, update and delete systems.
+	RoleOperator Role = "operator"
+
+	// Full access, including user management and mesh secrets.
+	RoleAdmin Role = "admin"
+)
+
+var roleLevels = map[Role]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// Returns true if this is a known role.
+func (r Role) Valid() bool {
+	return roleLevels[r] > 0
+}
+
+// Returns true if this role has all of the permissions of the other role.
+func (r Role) Includes(other Role) bool {
+	return r.Valid() && roleLevels[r] >= roleLevels[other]
+}
+
+type User struct {
+	ID        uint
+	Username  string `gorm:"uniqueIndex;notNull"`
+	Role      Role   `gorm:"default:viewer"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// bcrypt hash of the user's password. Never sent to clients.
+	PasswordHash string `json:"-"`
+}
+
+// Hashes and sets the user's password. Passwords must be between 8 and 72 characters long.
+func (u *User) SetPassword(password string) error {
+	// bcrypt silently ignores everything after the 72nd byte.
+	if len(password) < 8 || len(password) > 72 {
+		return errors.New("passwords must be between 8 and 72 characters long")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	u.PasswordHash = string(hash)
+
+	return nil
+}
+
+// Checks if the provided password matches the stored hash.
+func (u User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// Bearer token issued to a user. Session tokens are created by logging in and expire, API tokens are created
+// explicitly and are valid until deleted.
+type Token struct {
+	ID        uint
+	UserID    uint
+	Name      string
+	CreatedAt time.Time
+
+	// Zero if this token never expires.
+	ExpiresAt time.Time
+
+	// SHA256 hash of the raw token. The raw token is only ever shown once, when it is created.
+	Hash string `gorm:"uniqueIndex;notNull" json:"-"`
+}
+
+// Returns true if this token has an expiration time that has passed.
+func (t Token) Expired() bool {
+	return !t.ExpiresAt.IsZero() && time.Now().After(t.ExpiresAt)
+}
@@ -0,0 +1,32 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPassword(t *testing.T) {
+	var user User
+
+	assert.Error(t, user.SetPassword("short"))
+	assert.NoError(t, user.SetPassword("correct horse battery staple"))
+
+	assert.True(t, user.CheckPassword("correct horse battery staple"))
+	assert.False(t, user.CheckPassword("incorrect horse battery staple"))
+}
+
+func TestTokenExpiration(t *testing.T) {
+	assert.False(t, Token{}.Expired())
+	assert.False(t, Token{ExpiresAt: time.Now().Add(time.Hour)}.Expired())
+	assert.True(t, Token{ExpiresAt: time.Now().Add(-time.Hour)}.Expired())
+}
+
+func TestRoles(t *testing.T) {
+	assert.True(t, RoleAdmin.Includes(RoleOperator))
+	assert.True(t, RoleOperator.Includes(RoleOperator))
+	assert.False(t, RoleViewer.Includes(RoleOperator))
+	assert.False(t, Role("").Includes(RoleViewer))
+	assert.False(t, Role("superuser").Valid())
+}
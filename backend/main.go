@@ -4,9 +4,16 @@ import (
 	"os"
 
 	"github.com/ConfusedPolarBear/garden/internal/api"
+	"github.com/ConfusedPolarBear/garden/internal/command"
 	"github.com/ConfusedPolarBear/garden/internal/config"
 	"github.com/ConfusedPolarBear/garden/internal/db"
+	"github.com/ConfusedPolarBear/garden/internal/firmware"
+	"github.com/ConfusedPolarBear/garden/internal/monitor"
 	"github.com/ConfusedPolarBear/garden/internal/mqtt"
+	"github.com/ConfusedPolarBear/garden/internal/notify"
+	"github.com/ConfusedPolarBear/garden/internal/rollout"
+	"github.com/ConfusedPolarBear/garden/internal/rotation"
+	"github.com/ConfusedPolarBear/garden/internal/scheduler"
 
 	"github.com/sirupsen/logrus"
 )
@@ -16,16 +23,29 @@ func main() {
 	setupLogrus()
 	config.Load()
 
-	// Setup database and archive old readings
+	// Subcommands don't need the database or the server.
+	if code, ok := runCommand(os.Args[1:]); ok {
+		os.Exit(code)
+	}
+
+	// Setup database and start rolling up old readings
 	db.InitializeDatabase()
+	db.StartRetention()
 
 	/*
 		db.PopulateTestData()
-		db.ArchiveOldReadings()
 	*/
 
-	// Setup MQTT and HTTP API
+	// Setup notifications, firmware directories, command tracking, key rotation, firmware rollouts, MQTT, offline
+	// detection, scheduled commands and HTTP API
+	notify.Setup()
+	firmware.Setup()
+	command.Start()
+	rotation.Setup()
+	rollout.Setup()
 	mqtt.Setup(true)
+	monitor.Start()
+	scheduler.Start()
 	api.StartServer()
 }
 
@@ -43,6 +43,9 @@
 
 #define FILE_SECURE_MODE     "/secure"
 
+// Name announced to the backend. Written by provisioned images.
+#define FILE_NAME "/name"
+
 // ========== Command handling ==========
 // Checks if the Serial connection has a command. If it does, handle it.
 void parseSerial();
@@ -52,6 +55,15 @@ void processCommand(String command, bool secure = false);
 
 void queueCommand(String command);
 
+// ========== Versioning ==========
+// Version announced to the backend. Release builds set it with -D FIRMWARE_VERSION=\"1.0.0\".
+#ifndef FIRMWARE_VERSION
+#define FIRMWARE_VERSION "dev-" __DATE__ "-" __TIME__
+#endif
+
+// Returns the version of this firmware. The backend reads the same version from firmware images before updating.
+const char* getAppVersion();
+
 // ========== Utility functions ==========
 uint32_t secureRandom();
 String secureRandomNonce();
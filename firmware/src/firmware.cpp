@@ -346,7 +346,9 @@ void processCommand(String command, bool secure) {
             #ifdef ESP32
             esp_deep_sleep(period * 1e6);
             #else
-            ESP.deepSleep(period * 1e6, RF_DISABLED);
+            // The ESP8266 can't sleep for longer than its RTC timer allows. The backend rejects longer periods.
+            uint64_t duration = (uint64_t)period * 1000000;
+            ESP.deepSleep(min(duration, ESP.deepSleepMax()), RF_DISABLED);
             #endif
         }
 
@@ -466,6 +468,11 @@ void processCommand(String command, bool secure) {
         changed = true;
     }
 
+    if (data.containsKey("Name")) {
+        WriteFile(FILE_NAME, data["Name"]);
+        changed = true;
+    }
+
     if (data.containsKey("MeshPeers")) {
         String peers = data["MeshPeers"];
         String current = ReadFile(FILE_MESH_PEERS);
@@ -116,7 +116,7 @@ void processNetworkScan() {
 
 #warning pass a string vector with discovered sensors
 void sendDiscoveryMessage(bool useMqtt) {
-    StaticJsonDocument<250> info;
+    StaticJsonDocument<384> info;
     
     // Store reset reason and sdk version. Since the ESP32 does not expose the sdk version, it's only sent by the ESP8266.
     #ifdef ESP8266
@@ -128,6 +128,7 @@ void sendDiscoveryMessage(bool useMqtt) {
     #endif
 
     info["SV"] = ESP.getSdkVersion();
+    info["AV"] = getAppVersion();
 
     // Store filesystem used and total byte counts.
     info["FU"] = 0;
@@ -138,6 +139,12 @@ void sendDiscoveryMessage(bool useMqtt) {
         info["FT"] = fsInfo.totalBytes;
     }
 
+    // Announce the name this system was provisioned with, if any.
+    String name = ReadFile(FILE_NAME);
+    if (name.length() > 0) {
+        info["NM"] = name;
+    }
+
     // If this uses the mesh or not. If not (i.e. connected through MQTT), report the wifi channel.
     info["ME"] = !useMqtt;
     if (useMqtt) {
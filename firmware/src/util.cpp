@@ -1,5 +1,12 @@
 #include <firmware.h>
 
+// The version is stored with a prefix so that the backend can find it in firmware images.
+static const char versionMarker[] = "garden-version:" FIRMWARE_VERSION;
+
+const char* getAppVersion() {
+    return versionMarker + strlen("garden-version:");
+}
+
 uint32_t secureRandom() {
     #ifdef ESP32
     return esp_random();
@@ -1,3 +1,10 @@
+import router from "@/router";
+
+// Returns the session token stored at login, if any.
+export function getToken(): string | null {
+  return window.localStorage.getItem("token");
+}
+
 export default function api(
   url: string,
   options: RequestInit = {}
@@ -15,7 +22,26 @@ export default function api(
   }
   where += url;
 
+  // Authenticate the request
+  const token = getToken();
+  if (token) {
+    const headers = new Headers(options.headers);
+    headers.set("Authorization", `Bearer ${token}`);
+    options = { ...options, headers: headers };
+  }
+
   // Send it
   console.debug(`[api] fetching ${where}`);
-  return fetch(where, options);
+  return fetch(where, options).then((r) => {
+    // The session expired or was revoked, so the user has to log in again.
+    if (r.status === 401) {
+      window.localStorage.removeItem("token");
+
+      if (router.currentRoute.name !== "login") {
+        router.push("/login");
+      }
+    }
+
+    return r;
+  });
 }
@@ -1,6 +1,7 @@
 import Vue from "vue";
 import VueRouter, { RouteConfig } from "vue-router";
 import Setup from "@/views/Setup.vue";
+import Login from "@/views/Login.vue";
 import Systems from "@/views/Systems.vue";
 import Graph from "@/views/Graph.vue";
 import SystemWizard from "@/views/SystemWizard.vue";
@@ -14,6 +15,11 @@ const routes: Array<RouteConfig> = [
     name: "setup",
     component: Setup
   },
+  {
+    path: "/login",
+    name: "login",
+    component: Login
+  },
   {
     path: "/systems",
     name: "systems",
@@ -42,4 +48,16 @@ const router = new VueRouter({
   routes
 });
 
+// Every page other than setup and login needs a session.
+router.beforeEach((to, from, next) => {
+  const isPublic = to.name === "setup" || to.name === "login";
+
+  if (!isPublic && !window.localStorage.getItem("token")) {
+    next("/login");
+    return;
+  }
+
+  next();
+});
+
 export default router;
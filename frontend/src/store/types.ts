@@ -40,6 +40,9 @@ export type GardenSystemInfo = {
   CoreVersion: string;
   SdkVersion: string;
 
+  // Version of the garden firmware. Empty if the firmware predates version announcements.
+  AppVersion: string;
+
   FilesystemUsedSize: number;
   FilesystemTotalSize: number;
 